@@ -0,0 +1,136 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExpireNever is the Expire value when the server never deletes messages
+const ExpireNever = -1
+
+// Capabilities holds the capabilities advertised by the server in response to CAPA (RFC 2449)
+type Capabilities struct {
+	// Top is set when the TOP command is supported
+	Top bool
+	// UIDL is set when the UIDL command is supported
+	UIDL bool
+	// User is set when USER/PASS authentication is supported
+	User bool
+	// SASL holds the SASL mechanisms supported by AUTH
+	SASL []string
+	// STLS is set when the STLS command is supported
+	STLS bool
+	// Pipelining is set when the server accepts multiple commands before replying
+	Pipelining bool
+	// RespCodes is set when the server returns extended response codes
+	RespCodes bool
+	// HasExpire is set when the server advertised an EXPIRE policy
+	HasExpire bool
+	// Expire holds the minimum number of days messages are kept, or ExpireNever
+	Expire int
+	// ExpirePerUser is set when the EXPIRE policy may change once authenticated
+	ExpirePerUser bool
+	// HasLoginDelay is set when the server advertised a LOGIN-DELAY
+	HasLoginDelay bool
+	// LoginDelay holds the minimum number of seconds between logins
+	LoginDelay int
+	// LoginDelayPerUser is set when the LOGIN-DELAY may change once authenticated
+	LoginDelayPerUser bool
+	// Implementation holds the server implementation string
+	Implementation string
+	// UTF8 is set when the UTF8 command is supported (RFC 6856)
+	UTF8 bool
+	// UTF8User is set when UTF-8 usernames and passwords are accepted
+	UTF8User bool
+	// Raw holds every capability line as returned by the server
+	Raw []string
+}
+
+// NewCapabilities creates a new empty set of capabilities
+func NewCapabilities() *Capabilities {
+	return &Capabilities{}
+}
+
+// ParseLine parses a single capability line, e.g. SASL PLAIN LOGIN. A malformed line
+// returns an error leaving the capabilities unchanged apart from Raw
+func (c *Capabilities) ParseLine(line string) error {
+	line = strings.Trim(line, " \r\n\t")
+	items := strings.Fields(line)
+	if len(items) == 0 {
+		return fmt.Errorf("Incorrect capability, empty line returned")
+	}
+
+	c.Raw = append(c.Raw, line)
+	args := items[1:]
+
+	switch strings.ToUpper(items[0]) {
+	case "TOP":
+		c.Top = true
+	case "UIDL":
+		c.UIDL = true
+	case "USER":
+		c.User = true
+	case "SASL":
+		for _, mech := range args {
+			c.SASL = append(c.SASL, strings.ToUpper(mech))
+		}
+	case "STLS":
+		c.STLS = true
+	case "PIPELINING":
+		c.Pipelining = true
+	case "RESP-CODES":
+		c.RespCodes = true
+	case "EXPIRE":
+		if len(args) == 0 {
+			return fmt.Errorf("Incorrect capability, EXPIRE has no policy '%v'", line)
+		}
+
+		days := uint64(0)
+		if !strings.EqualFold(args[0], "NEVER") {
+			var err error
+			days, err = strconv.ParseUint(args[0], 10, 31)
+			if err != nil {
+				return fmt.Errorf("Incorrect EXPIRE policy returned %v, error was %v", args[0], err)
+			}
+		}
+
+		c.HasExpire = true
+		c.ExpirePerUser = len(args) > 1 && strings.EqualFold(args[1], "USER")
+		c.Expire = int(days)
+		if strings.EqualFold(args[0], "NEVER") {
+			c.Expire = ExpireNever
+		}
+	case "LOGIN-DELAY":
+		if len(args) == 0 {
+			return fmt.Errorf("Incorrect capability, LOGIN-DELAY has no delay '%v'", line)
+		}
+
+		delay, err := strconv.ParseUint(args[0], 10, 31)
+		if err != nil {
+			return fmt.Errorf("Incorrect LOGIN-DELAY returned %v, error was %v", args[0], err)
+		}
+
+		c.HasLoginDelay = true
+		c.LoginDelay = int(delay)
+		c.LoginDelayPerUser = len(args) > 1 && strings.EqualFold(args[1], "USER")
+	case "IMPLEMENTATION":
+		c.Implementation = strings.Join(args, " ")
+	case "UTF8":
+		c.UTF8 = true
+		c.UTF8User = len(args) > 0 && strings.EqualFold(args[0], "USER")
+	}
+
+	return nil
+}
+
+// SupportsSASL checks whether the named SASL mechanism was advertised
+func (c *Capabilities) SupportsSASL(mechanism string) bool {
+	for _, mech := range c.SASL {
+		if strings.EqualFold(mech, mechanism) {
+			return true
+		}
+	}
+
+	return false
+}
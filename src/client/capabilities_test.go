@@ -0,0 +1,78 @@
+package client
+
+import (
+    "testing"
+)
+
+// Test_CapabilitiesParseLineOk checks that capability lines are parsed correctly
+func Test_CapabilitiesParseLineOk(t *testing.T) {
+    toTest := NewCapabilities()
+
+    lines := []string {
+        "TOP",
+        "UIDL",
+        "USER",
+        "SASL PLAIN cram-md5",
+        "STLS",
+        "PIPELINING",
+        "RESP-CODES",
+        "EXPIRE 31 USER",
+        "LOGIN-DELAY 900",
+        "IMPLEMENTATION Shlemazle Plotz v302",
+        "UTF8 USER",
+        "X-UNKNOWN",
+    }
+    for _, line := range lines {
+        err := toTest.ParseLine(line)
+        if err != nil {
+            t.Error(err)
+        }
+    }
+
+    if !toTest.Top || !toTest.UIDL || !toTest.User || !toTest.STLS || !toTest.Pipelining || !toTest.RespCodes {
+        t.Errorf("Incorrect capabilities %+v", toTest)
+    }
+    if !toTest.SupportsSASL("PLAIN") || !toTest.SupportsSASL("CRAM-MD5") || toTest.SupportsSASL("LOGIN") {
+        t.Errorf("Incorrect SASL mechanisms %v", toTest.SASL)
+    }
+    if !toTest.HasExpire || toTest.Expire != 31 || !toTest.ExpirePerUser {
+        t.Error("Incorrect EXPIRE")
+    }
+    if !toTest.HasLoginDelay || toTest.LoginDelay != 900 || toTest.LoginDelayPerUser {
+        t.Error("Incorrect LOGIN-DELAY")
+    }
+    if toTest.Implementation != "Shlemazle Plotz v302" {
+        t.Errorf("Incorrect implementation %v", toTest.Implementation)
+    }
+    if !toTest.UTF8 || !toTest.UTF8User {
+        t.Error("Incorrect UTF8")
+    }
+    if len(toTest.Raw) != len(lines) {
+        t.Error("Incorrect raw capabilities")
+    }
+}
+
+// Test_CapabilitiesParseLineExpireNever checks that EXPIRE NEVER is parsed
+func Test_CapabilitiesParseLineExpireNever(t *testing.T) {
+    toTest := NewCapabilities()
+
+    err := toTest.ParseLine("EXPIRE NEVER")
+    if err != nil {
+        t.Error(err)
+    }
+    if toTest.Expire != ExpireNever || toTest.ExpirePerUser {
+        t.Error("Incorrect EXPIRE")
+    }
+}
+
+// Test_CapabilitiesParseLineErrorsReturned checks that an error is returned correctly
+func Test_CapabilitiesParseLineErrorsReturned(t *testing.T) {
+    toTest := NewCapabilities()
+
+    for _, line := range []string { "", "EXPIRE", "EXPIRE soon", "LOGIN-DELAY", "LOGIN-DELAY -1" } {
+        err := toTest.ParseLine(line)
+        if err == nil {
+            t.Errorf("Expected error for '%v'", line)
+        }
+    }
+}
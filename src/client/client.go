@@ -1,91 +1,358 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/benmj87/gogo-pop3gadget/src/config"
+	"github.com/benmj87/gogo-pop3gadget/src/internal/pop3"
 )
 
-const (
-	// singleLineMessageTerminator is the standard terminator for single line commands
-	// e.g. STAT
-	singleLineMessageTerminator = "\r\n"
-	// multiLineMessageTerminator is the standard terminator for multi-line commands
-	// e.g. LIST
-	multiLineMessageTerminator = "\r\n.\r\n"
-)
+// ErrUnsupported is returned when the server rejects an optional command, e.g. UIDL
+var ErrUnsupported = errors.New("command not supported by server")
 
-// Client holds code for the connection
+// Client holds code for the connection. It's safe for concurrent use, each command and
+// its response are exchanged in turn
 type Client struct {
 	// the config for the connection
 	config config.Config
 	// the connection
 	connection net.Conn
+	// reader reads responses from the connection
+	reader *responseReader
+	// greeting holds the server greeting received when connecting
+	greeting string
+	// capabilities holds the last CAPA response, nil if unknown
+	capabilities *Capabilities
+	// capaUnsupported is set when the server rejected CAPA
+	capaUnsupported bool
+	// inAuth is set during a SASL exchange to avoid logging credentials
+	inAuth bool
+	// logger receives log messages, set using WithLogger
+	logger Logger
+	// transcript records the session when set using WithTranscript
+	transcript *transcript
+	// state holds the state of the session
+	state State
+	// cmdLock serialises commands so their bytes and responses aren't interleaved
+	cmdLock sync.Mutex
+	// ioLock guards the deadline state shared with the goroutine watching for cancellation,
+	// along with the state and greeting read by State and Greeting
+	ioLock sync.Mutex
+	// deadline holds the deadline of the current command, zero if there isn't one
+	deadline time.Time
+	// cancelled is set when the context of the current command is done
+	cancelled bool
 	// the dialer
 	Dialer func(string, string) (net.Conn, error)
 	// the tls dialer to create new tls connections
 	TLSDialer func(string, string, *tls.Config) (net.Conn, error)
+	// TLSClient wraps an existing connection with TLS when upgrading using STLS
+	TLSClient func(net.Conn, *tls.Config) net.Conn
 }
 
-// NewClient returns a new default instance of the Client
-func NewClient(conf config.Config) *Client {
-	return &Client{
-		config: conf,
-		Dialer: net.Dial,
-		TLSDialer: func(network string, addr string, config *tls.Config) (net.Conn, error) {
-			return tls.Dial(network, addr, config)
+// NewClient returns a new default instance of the Client, configured by opts
+func NewClient(conf config.Config, opts ...Option) *Client {
+	dialer := &proxyDialer{conf: conf.ProxyURL, forward: &familyDialer{conf: conf}, timeout: conf.ConnectTimeout}
+	c := &Client{
+		config:    conf,
+		logger:    pop3.NopLogger{},
+		Dialer:    dialer.Dial,
+		TLSDialer: dialer.DialTLS,
+		TLSClient: func(conn net.Conn, config *tls.Config) net.Conn {
+			return tls.Client(conn, config)
 		},
 	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
 }
 
 // Connect opens the connection and initiates
 func (c *Client) Connect() error {
-	var err error
+	return c.ConnectContext(context.Background())
+}
 
-	if c.config.UseTLS {
-		fmt.Printf("Connecting using TLS to %v:%v\n", c.config.Server, c.config.Port)
-		c.connection, err = c.TLSDialer("tcp", fmt.Sprintf("%v:%v", c.config.Server, c.config.Port), &tls.Config{})
-	} else {
-		fmt.Printf("Connecting to %v:%v\n", c.config.Server, c.config.Port)
-		c.connection, err = c.Dialer("tcp", fmt.Sprintf("%v:%v", c.config.Server, c.config.Port))
+// connect implements Connect
+func (c *Client) connect(ctx context.Context) error {
+	if c.state != StateDisconnected && c.state != StateClosed {
+		return fmt.Errorf("%w: CONNECT in the %v state", ErrInvalidState, c.state)
 	}
 
+	mode := c.config.EffectiveTLSMode()
+	conn, err := c.dial(ctx, mode == config.TLSImplicit)
 	if err != nil {
 		return err
 	}
 
-	msg := ""
-	msg, err = c.readMsg(singleLineMessageTerminator)
+	c.transcript.note("connected to %v port %v, TLS %v", c.config.Server, c.config.Port, mode == config.TLSImplicit)
+	c.setConnection(conn)
+	c.capabilities = nil
+	c.capaUnsupported = false
+
+	err = c.withDeadline(ctx, c.config.ConnectTimeout, "CONNECT", func() error {
+		return c.initiate(mode)
+	})
+	if err != nil {
+		// the session can't continue without a greeting or the required TLS
+		c.connection.Close()
+		c.setState(StateClosed)
+	}
+
+	return err
+}
+
+// dial opens the connection, giving up if ctx is done first
+func (c *Client) dial(ctx context.Context, useTLS bool) (net.Conn, error) {
+	// IPv6 literals may be given with or without brackets
+	addr := net.JoinHostPort(strings.Trim(c.config.Server, "[]"), strconv.Itoa(c.config.Port))
+
+	var tlsConf *tls.Config
+	if useTLS {
+		var err error
+		tlsConf, err = c.config.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	proxy, err := c.config.ProxyURL()
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		c.logger.Info("Connecting through proxy", "proxy", proxy.Redacted())
+	}
+
+	dial := func() (net.Conn, error) {
+		if useTLS {
+			c.logger.Info("Connecting", "server", addr, "tls", true)
+			return c.TLSDialer("tcp", addr, tlsConf)
+		}
+
+		c.logger.Info("Connecting", "server", addr, "tls", false)
+		return c.Dialer("tcp", addr)
+	}
+
+	if ctx.Done() == nil {
+		return dial()
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		results <- result{conn, err}
+	}()
+
+	select {
+	case res := <-results:
+		return res.conn, res.err
+	case <-ctx.Done():
+		// the dialer can't be interrupted so close the connection if it's made later
+		go func() {
+			res := <-results
+			if res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// initiate reads the greeting and negotiates capabilities and TLS once connected
+func (c *Client) initiate(mode config.TLSMode) error {
+	msg, err := c.readStatus()
 	if err != nil {
 		return err
 	}
 
 	if c.isError(msg) {
-		return errors.New(msg)
+		return newProtocolError("", msg, nil)
+	}
+	c.setState(StateAuthorization)
+
+	c.ioLock.Lock()
+	c.greeting = strings.TrimRight(msg, "\r\n")
+	c.ioLock.Unlock()
+
+	err = c.refreshCapabilities()
+	if err != nil {
+		return err
+	}
+
+	if mode == config.TLSStartRequired || mode == config.TLSStartOpportunistic {
+		return c.startTLS(mode == config.TLSStartRequired)
 	}
 
 	return nil
 }
 
-// Auth calls USER + PASS
+// startTLS upgrades the connection using STLS (RFC 2595) if the server advertises it.
+// If required is set then a server not advertising STLS returns an error
+func (c *Client) startTLS(required bool) error {
+	if c.capabilities == nil || !c.capabilities.STLS {
+		if required {
+			return fmt.Errorf("%w: STLS is required but not advertised by the server", ErrUnsupported)
+		}
+
+		c.logger.Warn("STLS not advertised, continuing without TLS", "server", c.config.Server)
+		return nil
+	}
+
+	tlsConf, err := c.config.TLSConfig()
+	if err != nil {
+		return err
+	}
+
+	err = c.writeMsg("STLS\r\n")
+	if err != nil {
+		return err
+	}
+
+	msg, err := c.readStatus()
+	if err != nil {
+		return err
+	}
+	if c.isError(msg) {
+		return newProtocolError("STLS", msg, ErrUnsupported)
+	}
+
+	c.logger.Info("Upgrading connection using STLS", "server", c.config.Server)
+
+	// anything sent before the handshake could have been injected by an attacker
+	if c.reader.Buffered() > 0 {
+		c.connection.Close()
+		return errors.New("Unexpected data received before the TLS handshake")
+	}
+
+	conn := c.TLSClient(c.connection, tlsConf)
+	if handshaker, ok := conn.(interface{ Handshake() error }); ok {
+		err = handshaker.Handshake()
+		if err != nil {
+			c.connection.Close()
+			return err
+		}
+	}
+	c.transcript.note("upgraded to TLS")
+	c.setConnection(conn)
+
+	// anything learnt before the upgrade must be discarded
+	c.capabilities = nil
+	return c.refreshCapabilities()
+}
+
+// Greeting returns the greeting sent by the server when connecting
+func (c *Client) Greeting() string {
+	c.ioLock.Lock()
+	defer c.ioLock.Unlock()
+
+	return c.greeting
+}
+
+// Auth authenticates using the method set in the config, by default USER + PASS
 func (c *Client) Auth() error {
+	return c.AuthContext(context.Background())
+}
+
+// auth implements Auth
+func (c *Client) auth() error {
+	err := c.checkState("AUTH", StateAuthorization)
+	if err != nil {
+		return err
+	}
+
+	switch c.config.AuthMethod {
+	case config.AuthAPOP:
+		err = c.authAPOP()
+	case config.AuthSASL:
+		var mech Mechanism
+		mech, err = c.selectMechanism()
+		if err == nil {
+			err = c.authSASL(mech)
+		}
+	default:
+		err = c.authUserPass()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return c.authenticated()
+}
+
+// AuthWith authenticates using AUTH with the given SASL mechanism
+func (c *Client) AuthWith(mech Mechanism) error {
+	return c.AuthWithContext(context.Background(), mech)
+}
+
+// authWith implements AuthWith
+func (c *Client) authWith(mech Mechanism) error {
+	err := c.checkState("AUTH", StateAuthorization)
+	if err != nil {
+		return err
+	}
+
+	err = c.authSASL(mech)
+	if err != nil {
+		return err
+	}
+
+	return c.authenticated()
+}
+
+// authenticated is called once logged in
+func (c *Client) authenticated() error {
+	c.logger.Info("Authenticated", "server", c.config.Server)
+	c.setState(StateTransaction)
+
+	// capabilities may change once authenticated so fetch them again. A server rejecting
+	// CAPA is handled by refreshCapabilities, any other error leaves the response part
+	// read so the connection can't be used
+	err := c.refreshCapabilities()
+	if err != nil {
+		c.logger.Warn("Unable to refresh capabilities after authenticating, closing connection", "server", c.config.Server, "error", err)
+		c.connection.Close()
+		c.setState(StateClosed)
+		return fmt.Errorf("Refreshing capabilities after authenticating: %w", err)
+	}
+
+	return nil
+}
+
+// authUserPass calls USER + PASS
+func (c *Client) authUserPass() error {
+	if !c.supports(func(caps *Capabilities) bool { return caps.User }) {
+		return fmt.Errorf("%w: USER", ErrUnsupported)
+	}
+
 	err := c.writeMsg(fmt.Sprintf("USER %v\r\n", c.config.Username))
 	if err != nil {
 		return err
 	}
 
-	msg, err := c.readMsg(singleLineMessageTerminator)
+	msg, err := c.readStatus()
 	if err != nil {
 		return err
 	}
 	if c.isError(msg) {
-		return errors.New(msg)
+		return newProtocolError("USER", msg, ErrAuthFailed)
 	}
 
 	err = c.writeMsg(fmt.Sprintf("PASS %v\r\n", c.config.Password))
@@ -93,35 +360,255 @@ func (c *Client) Auth() error {
 		return err
 	}
 
-	msg, err = c.readMsg(singleLineMessageTerminator)
+	msg, err = c.readStatus()
+	if err != nil {
+		return err
+	}
+	if c.isError(msg) {
+		return newProtocolError("PASS", msg, ErrAuthFailed)
+	}
+
+	return nil
+}
+
+// authAPOP calls APOP with the MD5 digest of the greeting timestamp followed by the password
+func (c *Client) authAPOP() error {
+	timestamp := c.timestamp()
+	if timestamp == "" {
+		return fmt.Errorf("%w: APOP, no timestamp in greeting '%v'", ErrUnsupported, c.greeting)
+	}
+
+	err := c.writeMsg(fmt.Sprintf("APOP %v %v\r\n", c.config.Username, pop3.APOPDigest(timestamp, c.config.Password)))
+	if err != nil {
+		return err
+	}
+
+	msg, err := c.readStatus()
+	if err != nil {
+		return err
+	}
+	if c.isError(msg) {
+		return newProtocolError("APOP", msg, ErrAuthFailed)
+	}
+
+	return nil
+}
+
+// authSASL runs the AUTH challenge/response exchange (RFC 5034) for the mechanism
+func (c *Client) authSASL(mech Mechanism) error {
+	c.inAuth = true
+	defer func() { c.inAuth = false }()
+
+	initial, err := mech.Start()
+	if err != nil {
+		return err
+	}
+
+	cmd := fmt.Sprintf("AUTH %v", mech.Name())
+	if initial != nil {
+		encoded := "="
+		if len(initial) > 0 {
+			encoded = base64.StdEncoding.EncodeToString(initial)
+		}
+
+		// commands are limited to 255 octets, otherwise wait for the empty challenge
+		if len(cmd)+len(encoded)+3 <= 255 {
+			cmd += " " + encoded
+			initial = nil
+		}
+	}
+
+	err = c.writeMsg(cmd + "\r\n")
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := c.readStatus()
+		if err != nil {
+			return err
+		}
+
+		msg = strings.TrimRight(msg, "\r\n")
+		if msg != "+" && !strings.HasPrefix(msg, "+ ") {
+			if c.isError(msg) {
+				return newProtocolError("AUTH", msg, ErrAuthFailed)
+			}
+
+			// mechanisms with mutual authentication must have verified the server
+			if verifier, ok := mech.(interface{ Verify() error }); ok {
+				return verifier.Verify()
+			}
+
+			return nil
+		}
+
+		var response []byte
+		if initial != nil {
+			response, initial = initial, nil
+		} else {
+			challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(msg[1:]))
+			if err == nil {
+				response, err = mech.Next(challenge)
+			}
+
+			if err != nil {
+				// cancel the exchange, the server replies with -ERR
+				c.writeMsg("*\r\n")
+				c.readStatus()
+				return err
+			}
+		}
+
+		err = c.writeMsg(base64.StdEncoding.EncodeToString(response) + "\r\n")
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// connectionState returns the TLS state of the connection, false if it isn't using TLS
+func (c *Client) connectionState() (tls.ConnectionState, bool) {
+	conn, ok := c.connection.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+
+	return conn.ConnectionState(), true
+}
+
+// ServerPins returns the pins of the certificates presented by the server, as used by
+// config.TLSPins, starting with the server's own certificate which is the only one
+// TLSPins is checked against. It returns nil if the connection isn't using TLS
+func (c *Client) ServerPins() []string {
+	c.ioLock.Lock()
+	state, ok := c.connectionState()
+	c.ioLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	pins := make([]string, 0, len(state.PeerCertificates))
+	for _, cert := range state.PeerCertificates {
+		pins = append(pins, config.SPKIPin(cert))
+	}
+
+	return pins
+}
+
+// timestamp returns the <...> timestamp banner from the greeting, or an empty string if there isn't one
+func (c *Client) timestamp() string {
+	return pop3.GreetingTimestamp(c.greeting)
+}
+
+// Capabilities returns the capabilities advertised by the server, issuing CAPA if they
+// haven't already been fetched. If the server doesn't support CAPA then an error
+// wrapping ErrUnsupported is returned
+func (c *Client) Capabilities() (*Capabilities, error) {
+	return c.CapabilitiesContext(context.Background())
+}
+
+// fetchCapabilities implements Capabilities
+func (c *Client) fetchCapabilities() (*Capabilities, error) {
+	err := c.checkState("CAPA", StateAuthorization, StateTransaction)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.capabilities == nil && !c.capaUnsupported {
+		err := c.refreshCapabilities()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.capaUnsupported {
+		return nil, fmt.Errorf("%w: CAPA", ErrUnsupported)
+	}
+
+	return c.capabilities, nil
+}
+
+// refreshCapabilities issues CAPA and caches the result. A server rejecting CAPA is
+// remembered and not asked again
+func (c *Client) refreshCapabilities() error {
+	if c.capaUnsupported {
+		return nil
+	}
+
+	err := c.writeMsg("CAPA\r\n")
+	if err != nil {
+		return err
+	}
+
+	msg, err := c.readStatus()
 	if err != nil {
 		return err
 	}
+
+	c.logger.Debug("Fetching capabilities")
+
 	if c.isError(msg) {
-		return errors.New(msg)
+		c.capabilities = nil
+		c.capaUnsupported = true
+		return nil
+	}
+
+	lines, err := c.reader.ReadDotLines()
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Authenticated\n")
+	// a malformed optional capability mustn't stop the session, the line is kept in Raw
+	caps := NewCapabilities()
+	for _, line := range lines {
+		err := caps.ParseLine(line)
+		if err != nil {
+			c.logger.Warn("Ignoring invalid capability", "line", line, "error", err)
+		}
+	}
+
+	c.capabilities = caps
 
 	return nil
 }
 
+// supports checks the cached capabilities with check, if the capabilities are
+// unknown then the command is assumed to be supported
+func (c *Client) supports(check func(*Capabilities) bool) bool {
+	if c.capabilities == nil {
+		return true
+	}
+
+	return check(c.capabilities)
+}
+
 // Stat calls the stat pop3 command and returns the number of messages followed
 // by the size of all the messages in bytes
 func (c *Client) Stat() (uint32, uint64, error) {
-	err := c.writeMsg("STAT\r\n")
+	return c.StatContext(context.Background())
+}
+
+// stat implements Stat
+func (c *Client) stat() (uint32, uint64, error) {
+	err := c.checkState("STAT", StateTransaction)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	msg, err := c.readMsg(singleLineMessageTerminator)
+	err = c.writeMsg("STAT\r\n")
 	if err != nil {
 		return 0, 0, err
 	}
 
-	fmt.Print("Fetching number of messages\n")
+	msg, err := c.readStatus()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	c.logger.Debug("Fetching number of messages")
 	if c.isError(msg) {
-		return 0, 0, errors.New(msg)
+		return 0, 0, newProtocolError("STAT", msg, nil)
 	}
 
 	items := strings.Split(strings.Trim(msg, " \r\n\t"), " ")
@@ -144,20 +631,30 @@ func (c *Client) Stat() (uint32, uint64, error) {
 
 // ListMessage calls LIST {ID} and returns the appropriate message information
 func (c *Client) ListMessage(messageID int) (*Email, error) {
-	err := c.writeMsg(fmt.Sprintf("LIST %v\r\n", messageID))
+	return c.ListMessageContext(context.Background(), messageID)
+}
+
+// listMessage implements ListMessage
+func (c *Client) listMessage(messageID int) (*Email, error) {
+	err := c.checkState("LIST", StateTransaction)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.writeMsg(fmt.Sprintf("LIST %v\r\n", messageID))
 	if err != nil {
 		return nil, err
 	}
 
-	msg, err := c.readMsg(singleLineMessageTerminator)
+	msg, err := c.readStatus()
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Printf("Listing message %d\n", messageID)
+	c.logger.Debug("Listing message", "id", messageID)
 
 	if c.isError(msg) {
-		return nil, errors.New(msg)
+		return nil, newProtocolError("LIST", msg, ErrNoSuchMessage)
 	}
 
 	email := NewEmail()
@@ -171,23 +668,38 @@ func (c *Client) ListMessage(messageID int) (*Email, error) {
 
 // List implements the LIST call returning a list of all messages and their size
 func (c *Client) List() ([]*Email, error) {
-	err := c.writeMsg("LIST\r\n")
+	return c.ListContext(context.Background())
+}
+
+// list implements List
+func (c *Client) list() ([]*Email, error) {
+	err := c.checkState("LIST", StateTransaction)
 	if err != nil {
 		return nil, err
 	}
 
-	msg, err := c.readMsg(multiLineMessageTerminator)
+	err = c.writeMsg("LIST\r\n")
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Print("Listing messages\n")
+	msg, err := c.readStatus()
+	if err != nil {
+		return nil, err
+	}
 
-	var emails []*Email
-	lines := strings.Split(msg, "\r\n")
+	c.logger.Debug("Listing messages")
 
-	// remove the first item (expecting +OK)
-	lines = lines[1:]
+	if c.isError(msg) {
+		return nil, newProtocolError("LIST", msg, nil)
+	}
+
+	lines, err := c.reader.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []*Email
 	for _, line := range lines {
 		email := NewEmail()
 		err := email.ParseLine(line)
@@ -201,86 +713,373 @@ func (c *Client) List() ([]*Email, error) {
 	return emails, nil
 }
 
+// UIDL implements the UIDL call returning a list of all messages and their unique-id.
+// Servers are not required to support UIDL, if the server rejects the command then
+// an error wrapping ErrUnsupported is returned
+func (c *Client) UIDL() ([]*Email, error) {
+	return c.UIDLContext(context.Background())
+}
+
+// uidl implements UIDL
+func (c *Client) uidl() ([]*Email, error) {
+	err := c.checkState("UIDL", StateTransaction)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.supports(func(caps *Capabilities) bool { return caps.UIDL }) {
+		return nil, fmt.Errorf("%w: UIDL", ErrUnsupported)
+	}
+
+	err = c.writeMsg("UIDL\r\n")
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := c.readStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.Debug("Listing unique-ids")
+
+	if c.isError(msg) {
+		return nil, newProtocolError("UIDL", msg, ErrUnsupported)
+	}
+
+	lines, err := c.reader.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []*Email
+	for _, line := range lines {
+		email := NewEmail()
+		err := email.ParseUIDLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, email)
+	}
+
+	return emails, nil
+}
+
+// UIDLMessage calls UIDL {ID} and returns the unique-id of the message
+func (c *Client) UIDLMessage(messageID int) (*Email, error) {
+	return c.UIDLMessageContext(context.Background(), messageID)
+}
+
+// uidlMessage implements UIDLMessage
+func (c *Client) uidlMessage(messageID int) (*Email, error) {
+	err := c.checkState("UIDL", StateTransaction)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.supports(func(caps *Capabilities) bool { return caps.UIDL }) {
+		return nil, fmt.Errorf("%w: UIDL", ErrUnsupported)
+	}
+
+	err = c.writeMsg(fmt.Sprintf("UIDL %v\r\n", messageID))
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := c.readStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.Debug("Fetching unique-id of message", "id", messageID)
+
+	if c.isError(msg) {
+		return nil, newProtocolError("UIDL", msg, ErrNoSuchMessage)
+	}
+
+	email := NewEmail()
+	err = email.ParseSingleUIDLine(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return email, nil
+}
+
 // Retrieve retrieves a single message based upon the message ID
 func (c *Client) Retrieve(ID int) (*Email, error) {
-	err := c.writeMsg(fmt.Sprintf("RETR %v\r\n", ID))
+	return c.RetrieveContext(context.Background(), ID)
+}
+
+// retrieve implements Retrieve
+func (c *Client) retrieve(ID int) (*Email, error) {
+	err := c.checkState("RETR", StateTransaction)
 	if err != nil {
 		return nil, err
 	}
 
-	msg, err := c.readMsg(multiLineMessageTerminator)
-	if err != nil && err != io.EOF {
+	err = c.writeMsg(fmt.Sprintf("RETR %v\r\n", ID))
+	if err != nil {
 		return nil, err
 	}
 
-	fmt.Printf("Fetching message %d\n", ID)
+	c.logger.Debug("Fetching message", "id", ID)
 
-	firstLine := msg[0:strings.Index(msg, "\r\n")] // grab the first line which should be +OK {SIZE}\r\n
-	if c.isError(firstLine) {
-		return nil, errors.New(firstLine)
+	return c.readEmail("RETR", ID)
+}
+
+// RetrieveTo streams a single message to w as it's received rather than holding it in
+// memory, returning the number of bytes written
+func (c *Client) RetrieveTo(ID int, w io.Writer) (int64, error) {
+	return c.RetrieveToContext(context.Background(), ID, w)
+}
+
+// retrieveTo implements RetrieveTo
+func (c *Client) retrieveTo(ID int, w io.Writer) (int64, error) {
+	body, err := c.retrieveReader(ID)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(w, body)
+	closeErr := body.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return written, err
+}
+
+// RetrieveReader retrieves a single message returning a reader for its content. Other
+// commands wait until the reader has been read to the end or closed, the command timeout
+// applies until then
+func (c *Client) RetrieveReader(ID int) (io.ReadCloser, error) {
+	return c.RetrieveReaderContext(context.Background(), ID)
+}
+
+// retrieveReader implements RetrieveReader
+func (c *Client) retrieveReader(ID int) (io.ReadCloser, error) {
+	err := c.checkState("RETR", StateTransaction)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.writeMsg(fmt.Sprintf("RETR %v\r\n", ID))
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.Debug("Streaming message", "id", ID)
+
+	return c.openBody("RETR")
+}
+
+// Top issues TOP {ID} {LINES} returning the message headers and only the first
+// lines of the body, avoiding downloading the whole message
+func (c *Client) Top(ID int, lines int) (*Email, error) {
+	return c.TopContext(context.Background(), ID, lines)
+}
+
+// top implements Top
+func (c *Client) top(ID int, lines int) (*Email, error) {
+	err := c.checkState("TOP", StateTransaction)
+	if err != nil {
+		return nil, err
+	}
+
+	if lines < 0 {
+		return nil, fmt.Errorf("Invalid number of lines %v, must not be negative", lines)
+	}
+
+	if !c.supports(func(caps *Capabilities) bool { return caps.Top }) {
+		return nil, fmt.Errorf("%w: TOP", ErrUnsupported)
+	}
+
+	err = c.writeMsg(fmt.Sprintf("TOP %v %v\r\n", ID, lines))
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.Debug("Fetching top lines of message", "id", ID, "lines", lines)
+
+	return c.readEmail("TOP", ID)
+}
+
+// readEmail reads a multi-line message response as returned by RETR and TOP
+func (c *Client) readEmail(command string, ID int) (*Email, error) {
+	body, err := c.openBody(command)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg strings.Builder
+	_, err = io.Copy(&msg, body)
+	if err != nil {
+		return nil, err
 	}
 
 	email := NewEmail()
 	email.ID = ID
-	email.Message = msg[len(firstLine)+2:] // remove the first line
+	email.Message = strings.TrimSuffix(msg.String(), "\r\n") // the final line break belongs to the terminator
 
 	return email, nil
 }
 
+// openBody reads the status line of a multi-line message response to command returning a reader for the body
+func (c *Client) openBody(command string) (io.ReadCloser, error) {
+	msg, err := c.readStatus()
+	if err != nil {
+		return nil, err
+	}
+	if c.isError(msg) {
+		return nil, newProtocolError(command, msg, ErrNoSuchMessage)
+	}
+
+	return c.reader.DotReader(), nil
+}
+
 // Delete deletes the message from the server
 func (c *Client) Delete(ID int) error {
-	err := c.writeMsg(fmt.Sprintf("DELE %v\r\n", ID))
+	return c.DeleteContext(context.Background(), ID)
+}
+
+// deleteMsg implements Delete
+func (c *Client) deleteMsg(ID int) error {
+	err := c.checkState("DELE", StateTransaction)
 	if err != nil {
 		return err
 	}
 
-	msg, err := c.readMsg(singleLineMessageTerminator)
+	err = c.writeMsg(fmt.Sprintf("DELE %v\r\n", ID))
+	if err != nil {
+		return err
+	}
+
+	msg, err := c.readStatus()
 	if err != nil {
 		return err
 	}
 	if c.isError(msg) {
-		return fmt.Errorf("Unknown error returned %v", msg)
+		return newProtocolError("DELE", msg, ErrNoSuchMessage)
 	}
 
-	fmt.Printf("Deleting message %d\n", ID)
+	c.logger.Debug("Deleting message", "id", ID)
 
 	return nil
 }
 
 // Reset issues the RSET command
 func (c *Client) Reset() error {
-	err := c.writeMsg("RSET\r\n")
+	return c.ResetContext(context.Background())
+}
+
+// reset implements Reset
+func (c *Client) reset() error {
+	err := c.checkState("RSET", StateTransaction)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeMsg("RSET\r\n")
 	if err != nil {
 		return err
 	}
 
-	msg, err := c.readMsg(singleLineMessageTerminator)
+	msg, err := c.readStatus()
 	if err != nil {
 		return err
 	}
 	if c.isError(msg) {
-		return fmt.Errorf("Unknown error returned %v", msg)
+		return newProtocolError("RSET", msg, nil)
+	}
+
+	c.logger.Debug("Calling reset")
+
+	return nil
+}
+
+// Noop issues the NOOP command, checking the connection is still usable
+func (c *Client) Noop() error {
+	return c.NoopContext(context.Background())
+}
+
+// noop implements Noop
+func (c *Client) noop() error {
+	err := c.checkState("NOOP", StateTransaction)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeMsg("NOOP\r\n")
+	if err != nil {
+		return err
 	}
 
-	fmt.Print("Calling reset\n")
+	msg, err := c.readStatus()
+	if err != nil {
+		return err
+	}
+	if c.isError(msg) {
+		return newProtocolError("NOOP", msg, nil)
+	}
 
 	return nil
 }
 
 // Close issues the Quit command and closes the connection
 func (c *Client) Close() error {
-	defer c.connection.Close()
-	err := c.writeMsg("QUIT\r\n")
+	return c.CloseContext(context.Background())
+}
+
+// Abort closes the connection without sending QUIT, so the server keeps the messages
+// deleted in the session. A command being run on another goroutine fails
+func (c *Client) Abort() error {
+	c.ioLock.Lock()
+	defer c.ioLock.Unlock()
+
+	if c.connection == nil || c.state == StateClosed {
+		return nil
+	}
+
+	c.logger.Debug("Aborting connection")
+	c.state = StateClosed
+	c.transcript.note("connection aborted")
+	return c.connection.Close()
+}
+
+// quit implements Close
+func (c *Client) quit() error {
+	err := c.checkState("QUIT", StateAuthorization, StateTransaction)
 	if err != nil {
 		return err
 	}
 
-	_, err = c.readMsg(singleLineMessageTerminator)
+	defer func() {
+		c.connection.Close()
+		c.setState(StateClosed)
+		c.transcript.note("connection closed")
+	}()
+
+	err = c.writeMsg("QUIT\r\n")
 	if err != nil {
 		return err
 	}
 
-	fmt.Print("Closing connection\n")
+	// deleted messages are only removed when quitting once logged in
+	if c.state == StateTransaction {
+		c.setState(StateUpdate)
+	}
+
+	msg, err := c.readStatus()
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(msg, "-ERR") {
+		return newProtocolError("QUIT", msg, nil)
+	}
+
+	c.logger.Debug("Closing connection")
 
 	return nil
 }
@@ -297,15 +1096,30 @@ func (c *Client) isError(msg string) bool {
 	return false
 }
 
+// setConnection sets the connection commands are sent on
+func (c *Client) setConnection(conn net.Conn) {
+	c.ioLock.Lock()
+	defer c.ioLock.Unlock()
+
+	c.connection = conn
+	c.reader = newResponseReader(&idleReader{client: c})
+}
+
 // writeMsg writes the data to the connection and checks for errors
 func (c *Client) writeMsg(msg string) error {
-	if !strings.Contains(msg, "PASS") {
-		fmt.Printf("WRITING %s\n", msg)
+	if c.connection == nil {
+		return ErrNotConnected
 	}
 
+	c.logger.Debug("Sent", "command", redact(msg, c.inAuth), "bytes", len(msg))
+
 	written, err := c.connection.Write([]byte(msg))
+	if written > 0 {
+		c.transcript.sent(msg[:written], c.inAuth)
+	}
 
 	if err != nil {
+		c.transcript.note("write error: %v", err)
 		return err
 	}
 
@@ -316,33 +1130,19 @@ func (c *Client) writeMsg(msg string) error {
 	return nil
 }
 
-// readMsg reads data in chunks from the connection until terminator is detected
-func (c *Client) readMsg(terminator string) (string, error) {
-	const BuffSize int = 1024
-
-	msg := ""
-	data := make([]byte, BuffSize)
-
-	var err error
-	var read int
-	for err == nil && !strings.HasSuffix(msg, terminator) {
-		read, err = c.connection.Read(data)
-		msg += string(data[:read])
-	}
-
-	lines := strings.Split(msg, "\r\n")
-	fmt.Printf("READING %s\n", lines[0]) // only print the first line to avoid printing the whole message
-	fmt.Printf("READ %v bytes\n", len(msg))
-
-	if terminator == multiLineMessageTerminator {
-		// for multi line messages - any '.' are "byte-stuffed" so have to undo this
-		msg = strings.Replace(msg, "\r\n..", "\r\n.", -1)
-		msg = msg[:len(msg)-len(terminator)]
-	}
-
+// readStatus reads a single status line from the connection, e.g. +OK 2 320
+func (c *Client) readStatus() (string, error) {
+	msg, err := c.reader.ReadLine()
 	if err != nil {
 		return "", err
 	}
 
+	if c.inAuth && (msg == "+" || strings.HasPrefix(msg, "+ ")) {
+		// challenges can echo the credentials back, e.g. the XOAUTH2 error
+		c.logger.Debug("Received", "response", "+ [redacted]", "bytes", len(msg))
+	} else {
+		c.logger.Debug("Received", "response", msg, "bytes", len(msg))
+	}
+
 	return msg, nil
 }
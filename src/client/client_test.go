@@ -1,6 +1,8 @@
 package client
 
 import (
+    "io"
+    "strings"
     "testing"
     "github.com/benmj87/gogo-pop3gadget/src/config"
 	"crypto/tls"
@@ -15,6 +17,7 @@ func Test_TLSConnectOk(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
 
     toTest := NewClient(*conf)
     toTest.TLSDialer = func(net string, server string, tlsConf *tls.Config) (net.Conn, error) {
@@ -34,6 +37,7 @@ func Test_NonTLSConnectOk(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
 
     toTest := NewClient(*conf)
     toTest.Dialer = func(net string, server string) (net.Conn, error) {
@@ -53,6 +57,7 @@ func Test_TLSConnectReturnsError(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
 
     toTest := NewClient(*conf)
     toTest.TLSDialer = func(net string, server string, tlsConf *tls.Config) (net.Conn, error) {
@@ -72,6 +77,7 @@ func Test_TLSConnectErrorOnRead(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
     testConn.ReadError = errors.New("foo")
 
     toTest := NewClient(*conf)
@@ -123,6 +129,190 @@ func Test_TLSConnectNonSuccessMsgReturned(t *testing.T) {
     }
 }
 
+// Test_ConnectCapabilities checks that the capabilities are cached after connecting
+func Test_ConnectCapabilities(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    caps, err := toTest.Capabilities()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(testConn.Written) != 0 {
+        t.Error("CAPA was issued again rather than cached")
+    }
+    if !caps.Top || !caps.UIDL || !caps.User || caps.STLS {
+        t.Errorf("Invalid capabilities %+v", caps)
+    }
+}
+
+// Test_ConnectCapabilitiesUnsupported checks that a server rejecting CAPA is tolerated
+func Test_ConnectCapabilitiesUnsupported(t *testing.T) {
+    conf := config.NewConfig()
+    conf.UseTLS = false
+
+    testConn := NewTestConnection()
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, "-ERR unknown command\r\n")
+
+    toTest := NewClient(*conf)
+    toTest.Dialer = func(net string, server string) (net.Conn, error) {
+        return testConn, nil
+    }
+
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = toTest.Capabilities()
+    if !errors.Is(err, ErrUnsupported) {
+        t.Errorf("Expected ErrUnsupported, got %v", err)
+    }
+    if len(testConn.Written) != 1 {
+        t.Error("CAPA was issued again")
+    }
+
+    // commands aren't refused when the capabilities are unknown
+    toTest.state = StateTransaction
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\nSubject: hi\r\n.\r\n")
+    _, err = toTest.Top(1, 0)
+    if err != nil {
+        t.Error(err)
+    }
+}
+
+// Test_CommandsRefusedWithoutCapability checks that unadvertised commands aren't sent
+func Test_CommandsRefusedWithoutCapability(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+    toTest.capabilities = NewCapabilities()
+
+    _, err := toTest.Top(1, 0)
+    if !errors.Is(err, ErrUnsupported) {
+        t.Errorf("Expected ErrUnsupported, got %v", err)
+    }
+
+    _, err = toTest.UIDL()
+    if !errors.Is(err, ErrUnsupported) {
+        t.Errorf("Expected ErrUnsupported, got %v", err)
+    }
+
+    toTest.state = StateAuthorization
+    err = toTest.Auth()
+    if !errors.Is(err, ErrUnsupported) {
+        t.Errorf("Expected ErrUnsupported, got %v", err)
+    }
+
+    if len(testConn.Written) != 0 {
+        t.Errorf("Unexpected commands written %v", testConn.Written)
+    }
+}
+
+// Test_STLSRequiredOk checks that the connection is upgraded using STLS
+func Test_STLSRequiredOk(t *testing.T) {
+    conf := config.NewConfig()
+    conf.TLSMode = config.TLSStartRequired
+    conf.Server = "mail.example.com"
+
+    testConn := NewTestConnection()
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\nSTLS\r\n.\r\n")
+    testConn.ToRead = append(testConn.ToRead, "+OK begin TLS\r\n")
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\nUSER\r\n.\r\n")
+
+    upgraded := NewTestConnection()
+    toTest := NewClient(*conf)
+    toTest.Dialer = func(net string, server string) (net.Conn, error) {
+        return testConn, nil
+    }
+    toTest.TLSClient = func(conn net.Conn, tlsConf *tls.Config) net.Conn {
+        if conn != testConn || tlsConf.ServerName != "mail.example.com" {
+            t.Error("Invalid connection or tls config")
+        }
+        upgraded.ToRead = testConn.ToRead
+        return upgraded
+    }
+
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if testConn.Written[1] != "STLS\r\n" || upgraded.Written[0] != "CAPA\r\n" {
+        t.Error("Expected STLS followed by CAPA over the upgraded connection")
+    }
+    if toTest.capabilities.STLS || !toTest.capabilities.User {
+        t.Error("Capabilities weren't refreshed after upgrading")
+    }
+}
+
+// Test_STLSRequiredNotAdvertised checks that an error is returned if STLS isn't advertised
+func Test_STLSRequiredNotAdvertised(t *testing.T) {
+    conf := config.NewConfig()
+    conf.TLSMode = config.TLSStartRequired
+
+    testConn := NewTestConnection()
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
+
+    toTest := NewClient(*conf)
+    toTest.Dialer = func(net string, server string) (net.Conn, error) {
+        return testConn, nil
+    }
+
+    err := toTest.Connect()
+    if !errors.Is(err, ErrUnsupported) {
+        t.Errorf("Expected ErrUnsupported, got %v", err)
+    }
+    if len(testConn.Written) != 1 {
+        t.Error("STLS shouldn't be written")
+    }
+}
+
+// Test_STLSOpportunisticNotAdvertised checks that the connection continues without TLS
+func Test_STLSOpportunisticNotAdvertised(t *testing.T) {
+    conf := config.NewConfig()
+    conf.TLSMode = config.TLSStartOpportunistic
+
+    testConn := NewTestConnection()
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
+
+    toTest := NewClient(*conf)
+    toTest.Dialer = func(net string, server string) (net.Conn, error) {
+        return testConn, nil
+    }
+    toTest.TLSClient = func(conn net.Conn, tlsConf *tls.Config) net.Conn {
+        t.Error("Connection shouldn't be upgraded")
+        return conn
+    }
+
+    err := toTest.Connect()
+    if err != nil {
+        t.Error(err)
+    }
+}
+
+// Test_STLSRejected checks that an error is returned when the server rejects STLS
+func Test_STLSRejected(t *testing.T) {
+    conf := config.NewConfig()
+    conf.TLSMode = config.TLSStartOpportunistic
+
+    testConn := NewTestConnection()
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\nSTLS\r\n.\r\n")
+    testConn.ToRead = append(testConn.ToRead, "-ERR TLS unavailable\r\n")
+
+    toTest := NewClient(*conf)
+    toTest.Dialer = func(net string, server string) (net.Conn, error) {
+        return testConn, nil
+    }
+
+    err := toTest.Connect()
+    if err == nil {
+        t.Error("No error returned")
+    }
+}
+
 // Test_CloseOk checks close is called
 func Test_CloseOk(t *testing.T) {
     conf := config.NewConfig()
@@ -130,6 +320,7 @@ func Test_CloseOk(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
     testConn.ToRead = append(testConn.ToRead, "+GREAT\r\n")
 
     toTest := NewClient(*conf)
@@ -147,7 +338,7 @@ func Test_CloseOk(t *testing.T) {
         t.Error("Close wasn't called")
     }
 
-    if testConn.Written[0] != "QUIT\r\n" {
+    if testConn.Written[len(testConn.Written)-1] != "QUIT\r\n" {
         t.Error("QUIT wasn't written")
     }
 }
@@ -159,8 +350,10 @@ func Test_CloseErrorReturned(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
     testConn.ToRead = append(testConn.ToRead, "+GREAT\r\n")
     testConn.WriteError = errors.New("foo")
+    testConn.ThrowWriteErrorAfter = 1 // first write is CAPA
 
     toTest := NewClient(*conf)
     toTest.TLSDialer = func(net string, server string, tlsConf *tls.Config) (net.Conn, error) {
@@ -182,8 +375,10 @@ func Test_CloseErrorOnWrite(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
     testConn.ToRead = append(testConn.ToRead, "+GREAT\r\n")
     testConn.WriteError = errors.New("foo")
+    testConn.ThrowWriteErrorAfter = 1 // first write is CAPA
 
     toTest := NewClient(*conf)
     toTest.TLSDialer = func(net string, server string, tlsConf *tls.Config) (net.Conn, error) {
@@ -204,6 +399,7 @@ func Test_CloseIncorrectWriteLength(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
     testConn.ToRead = append(testConn.ToRead, "+GREAT\r\n")
     testConn.WriteCount = 2 // not the same length of the QUIT msg
 
@@ -226,6 +422,7 @@ func Test_CloseErrorOnRead(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
     testConn.ToRead = append(testConn.ToRead, "+GREAT\r\n")
 
     toTest := NewClient(*conf)
@@ -236,7 +433,7 @@ func Test_CloseErrorOnRead(t *testing.T) {
     toTest.Connect()
         
     testConn.ReadError = errors.New("foo")
-    testConn.ThrowReadErrorAfter = 1
+    testConn.ThrowReadErrorAfter = 2 // includes connecting and CAPA
     err := toTest.Close()
     if err == nil {
         t.Error("No error returned")
@@ -252,6 +449,7 @@ func Test_AuthOk(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
 
     toTest := NewClient(*conf)
     toTest.Dialer = func(net string, server string) (net.Conn, error) {
@@ -262,17 +460,21 @@ func Test_AuthOk(t *testing.T) {
     
     testConn.ToRead = append(testConn.ToRead, "+OK Username ok\r\n")
     testConn.ToRead = append(testConn.ToRead, "+OK Pass ok\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
     err := toTest.Auth()
 
     if err != nil {
         t.Error("Error returned")
     }
-    if testConn.Written[0] != "USER foo@bar.com\r\n" {
+    if testConn.Written[1] != "USER foo@bar.com\r\n" {
         t.Error("Invalid USER written")
     }
-    if testConn.Written[1] != "PASS p4ssw0rd\r\n" {
+    if testConn.Written[2] != "PASS p4ssw0rd\r\n" {
         t.Error("Invalid password written")
     }
+    if testConn.Written[3] != "CAPA\r\n" {
+        t.Error("Capabilities weren't refreshed")
+    }
 }
 
 // Test_AuthUsernameError tests that an error is returned on read
@@ -284,6 +486,7 @@ func Test_AuthUsernameError(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
 
     toTest := NewClient(*conf)
     toTest.Dialer = func(net string, server string) (net.Conn, error) {
@@ -332,6 +535,7 @@ func Test_AuthPasswordWriteError(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
 
     toTest := NewClient(*conf)
     toTest.Dialer = func(net string, server string) (net.Conn, error) {
@@ -342,7 +546,7 @@ func Test_AuthPasswordWriteError(t *testing.T) {
     
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
     testConn.WriteError = errors.New("foo")
-    testConn.ThrowWriteErrorAfter = 1 // first write is USER
+    testConn.ThrowWriteErrorAfter = 2 // first writes are CAPA and USER
     err := toTest.Auth()
 
     if err == nil {
@@ -359,6 +563,7 @@ func Test_AuthPasswordReadError(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
 
     toTest := NewClient(*conf)
     toTest.Dialer = func(net string, server string) (net.Conn, error) {
@@ -369,7 +574,7 @@ func Test_AuthPasswordReadError(t *testing.T) {
     
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
     testConn.ReadError = errors.New("foo")
-    testConn.ThrowReadErrorAfter = 2 // includes connecting and USER
+    testConn.ThrowReadErrorAfter = 3 // includes connecting, CAPA and USER
     err := toTest.Auth()
 
     if err == nil {
@@ -386,6 +591,7 @@ func Test_AuthPasswordReadErrorMsgReturned(t *testing.T) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
 
     toTest := NewClient(*conf)
     toTest.Dialer = func(net string, server string) (net.Conn, error) {
@@ -403,9 +609,70 @@ func Test_AuthPasswordReadErrorMsgReturned(t *testing.T) {
     }
 }
 
+// Test_AuthAPOPOk tests that APOP uses the digest of the greeting timestamp
+func Test_AuthAPOPOk(t *testing.T) {
+    conf := config.NewConfig()
+    conf.UseTLS = false
+    conf.AuthMethod = config.AuthAPOP
+    conf.Username = "mrose"
+    conf.Password = "tanstaaf"
+
+    testConn := NewTestConnection()
+    testConn.ToRead = append(testConn.ToRead, "+OK POP3 server ready <1896.697170952@dbc.mtview.ca.us>\r\n")
+    testConn.ToRead = append(testConn.ToRead, "-ERR\r\n")
+
+    toTest := NewClient(*conf)
+    toTest.Dialer = func(net string, server string) (net.Conn, error) {
+        return testConn, nil
+    }
+
+    toTest.Connect()
+    if toTest.Greeting() != "+OK POP3 server ready <1896.697170952@dbc.mtview.ca.us>" {
+        t.Errorf("Invalid greeting %v", toTest.Greeting())
+    }
+
+    testConn.ToRead = append(testConn.ToRead, "+OK maildrop has 1 message (369 octets)\r\n")
+    err := toTest.Auth()
+    if err != nil {
+        t.Error(err)
+    }
+    if testConn.Written[1] != "APOP mrose c4c9334bac560ecc979e58001b3e22fb\r\n" {
+        t.Errorf("Invalid APOP written %v", testConn.Written[1])
+    }
+}
+
+// Test_AuthAPOPNoTimestamp tests that an error is returned when the greeting has no timestamp
+func Test_AuthAPOPNoTimestamp(t *testing.T) {
+    testConn, toTest, conf := initialiseConnection()
+    conf.AuthMethod = config.AuthAPOP
+    toTest.config = *conf
+
+    err := toTest.Auth()
+    if !errors.Is(err, ErrUnsupported) {
+        t.Errorf("Expected ErrUnsupported, got %v", err)
+    }
+    if len(testConn.Written) != 0 {
+        t.Error("APOP shouldn't be written")
+    }
+}
+
+// Test_AuthAPOPErrorMsgReturned tests that a rejected APOP returns an error
+func Test_AuthAPOPErrorMsgReturned(t *testing.T) {
+    testConn, toTest, conf := initialiseConnection()
+    conf.AuthMethod = config.AuthAPOP
+    toTest.config = *conf
+    toTest.greeting = "+OK <1.2@host>"
+
+    testConn.ToRead = append(testConn.ToRead, "-ERR permission denied\r\n")
+    err := toTest.Auth()
+    if err == nil {
+        t.Error("Error not returned")
+    }
+}
+
 // Test_StatOk checks that Stat functions correctly
 func Test_StatOk(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
     testConn.ToRead = append(testConn.ToRead, "+OK 10 1024 vunderbar\r\n")
 
     msgs, size, err := toTest.Stat()
@@ -425,7 +692,7 @@ func Test_StatOk(t *testing.T) {
 
 // Test_StatErrorOnReadWrite checks that errors are returned correctly on ReadWrite
 func Test_StatErrorOnReadWrite(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
     
     testConn.ReadError = nil
     testConn.WriteError = errors.New("Foo")
@@ -444,7 +711,7 @@ func Test_StatErrorOnReadWrite(t *testing.T) {
 
 // Test_StatInvalidMsg checks that errors are handled with incorrect responses returned
 func Test_StatInvalidMsg(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "-ERR uh oh\r\n")    
     _, _, err := toTest.Stat()
@@ -461,7 +728,7 @@ func Test_StatInvalidMsg(t *testing.T) {
 
 // Test_StatInvalidInt checks that errors are handled with incorrect ints returned
 func Test_StatInvalidInt(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "+OK -1 a\r\n")    
     _, _, err := toTest.Stat()
@@ -478,7 +745,7 @@ func Test_StatInvalidInt(t *testing.T) {
 
 // Test_ListOk checks that a listing works correctly
 func Test_ListOk(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n1 10\r\n2 4\r\n.\r\n")
     emails, err := toTest.List()
@@ -494,9 +761,59 @@ func Test_ListOk(t *testing.T) {
     }
 }
 
+// Test_ListSplitChunks checks that a listing is parsed however the response is split across reads
+func Test_ListSplitChunks(t *testing.T) {
+    response := "+OK 2 messages\r\n1 10\r\n2 4\r\n.\r\n"
+
+    for split := 1; split < len(response); split++ {
+        testConn, toTest, _ := initialiseSession()
+        testConn.ToRead = append(testConn.ToRead, response[:split], response[split:])
+
+        emails, err := toTest.List()
+        if err != nil {
+            t.Fatalf("Split at %v, error %v", split, err)
+        }
+        if len(emails) != 2 || emails[0].ID != 1 || emails[1].Size != 4 {
+            t.Errorf("Split at %v, invalid emails parsed", split)
+        }
+    }
+}
+
+// Test_ResponsesInOneRead checks that data after a response is kept for the next one
+func Test_ResponsesInOneRead(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n1 10\r\n.\r\n+OK 1 10\r\n+OK deleted\r\n")
+
+    emails, err := toTest.List()
+    if err != nil || len(emails) != 1 {
+        t.Fatalf("Invalid listing, error %v", err)
+    }
+
+    msgs, size, err := toTest.Stat()
+    if err != nil || msgs != 1 || size != 10 {
+        t.Errorf("Invalid stat, error %v", err)
+    }
+
+    err = toTest.Delete(1)
+    if err != nil {
+        t.Error(err)
+    }
+}
+
+// Test_ListErrorMsg checks that a rejected LIST returns an error
+func Test_ListErrorMsg(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "-ERR not now\r\n")
+    _, err := toTest.List()
+    if err == nil {
+        t.Error("Expected an error")
+    }
+}
+
 // Test_ListReadWriteError checks that a read and write error returns correctly
 func Test_ListReadWriteError(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.WriteError = errors.New("foo")
     _, err := toTest.List()
@@ -514,7 +831,7 @@ func Test_ListReadWriteError(t *testing.T) {
 
 // Test_ListInvalidData checks that an invalid response returns correctly
 func Test_ListInvalidData(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "+OK\r\na\r\n.\r\n")
     _, err := toTest.List()
@@ -525,7 +842,7 @@ func Test_ListInvalidData(t *testing.T) {
 
 // Test_ListMessageOk checks that List is called correctly
 func Test_ListMessageOk(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "+OK 10 100\r\n")
     email, err := toTest.ListMessage(10)
@@ -540,7 +857,7 @@ func Test_ListMessageOk(t *testing.T) {
 
 // Test_ListMessageReadWriteError checks that a read and write error returns correctly
 func Test_ListMessageReadWriteError(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.WriteError = errors.New("foo")
     _, err := toTest.ListMessage(10)
@@ -558,7 +875,7 @@ func Test_ListMessageReadWriteError(t *testing.T) {
 
 // Test_ListMessageInvalidData checks that an invalid response returns correctly
 func Test_ListMessageInvalidData(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "+OK 10\r\n")
     _, err := toTest.ListMessage(10)
@@ -573,9 +890,105 @@ func Test_ListMessageInvalidData(t *testing.T) {
     }
 }
 
+// Test_UIDLOk checks that a unique-id listing works correctly
+func Test_UIDLOk(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n1 whqtswO00WBw418f9t5JxYwZ\r\n2 QhdPYR:00WBw1Ph7x7\r\n.\r\n")
+    emails, err := toTest.UIDL()
+    if err != nil {
+        t.Error(err)
+    }
+
+    if testConn.Written[0] != "UIDL\r\n" {
+        t.Error("Invalid command")
+    }
+    if len(emails) != 2 {
+        t.Fatalf("Invalid length %v", len(emails))
+    }
+    if emails[0].ID != 1 || emails[0].UID != "whqtswO00WBw418f9t5JxYwZ" || emails[1].ID != 2 || emails[1].UID != "QhdPYR:00WBw1Ph7x7" {
+        t.Error("Invalid emails parsed")
+    }
+}
+
+// Test_UIDLUnsupported checks that a server rejecting UIDL returns ErrUnsupported
+func Test_UIDLUnsupported(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "-ERR unknown command\r\n")
+    _, err := toTest.UIDL()
+    if !errors.Is(err, ErrUnsupported) {
+        t.Errorf("Expected ErrUnsupported, got %v", err)
+    }
+}
+
+// Test_UIDLReadWriteError checks that a read and write error returns correctly
+func Test_UIDLReadWriteError(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.WriteError = errors.New("foo")
+    _, err := toTest.UIDL()
+    if err == nil {
+        t.Error("Expected an error")
+    }
+
+    testConn.WriteError = nil
+    testConn.ReadError = errors.New("foo")
+    _, err = toTest.UIDL()
+    if err == nil || errors.Is(err, ErrUnsupported) {
+        t.Error("Expected a read error")
+    }
+}
+
+// Test_UIDLInvalidData checks that an invalid response returns correctly
+func Test_UIDLInvalidData(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n1\r\n.\r\n")
+    _, err := toTest.UIDL()
+    if err == nil {
+        t.Error("Expected an error")
+    }
+}
+
+// Test_UIDLMessageOk checks that UIDL {ID} is called correctly
+func Test_UIDLMessageOk(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "+OK 2 QhdPYR:00WBw1Ph7x7\r\n")
+    email, err := toTest.UIDLMessage(2)
+    if err != nil {
+        t.Error("An error happened")
+    }
+
+    if testConn.Written[0] != "UIDL 2\r\n" {
+        t.Error("Invalid command")
+    }
+    if email.ID != 2 || email.UID != "QhdPYR:00WBw1Ph7x7" {
+        t.Error("Invalid ID or UID")
+    }
+}
+
+// Test_UIDLMessageInvalidData checks that an invalid response returns correctly
+func Test_UIDLMessageInvalidData(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "+OK 2\r\n")
+    _, err := toTest.UIDLMessage(2)
+    if err == nil {
+        t.Error("Expected an error")
+    }
+
+    testConn.ToRead = append(testConn.ToRead, "-ERR no such message\r\n")
+    _, err = toTest.UIDLMessage(2)
+    if err == nil {
+        t.Error("Expected an error")
+    }
+}
+
 // Test_RetrieveOk Checks that a message is retrieved correctly
 func Test_RetrieveOk(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "+OK 100\r\nThe message\r\n.\r\n")
     email, err := toTest.Retrieve(10)
@@ -593,7 +1006,7 @@ func Test_RetrieveOk(t *testing.T) {
 
 // Test_RetrieveErrorReturned Checks that a message error is returned
 func Test_RetrieveErrorReturned(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "-ERR 100\r\nThe message\r\n.\r\n")
     _, err := toTest.Retrieve(10)
@@ -604,7 +1017,7 @@ func Test_RetrieveErrorReturned(t *testing.T) {
 
 // Test_RetrieveReadWriteError checks for read and write errors
 func Test_RetrieveReadWriteError(t *testing.T) {
-testConn, toTest, _ := initialiseConnection()
+testConn, toTest, _ := initialiseSession()
     testConn.WriteError = errors.New("foo")
     _, err := toTest.Retrieve(10)
     if err == nil {
@@ -619,9 +1032,157 @@ testConn, toTest, _ := initialiseConnection()
     }
 }
 
+// Test_RetrieveLeadingDotEdgeCases checks byte-stuffed lines, including the first, and split terminators
+func Test_RetrieveLeadingDotEdgeCases(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "+OK 40\r\n..first\r", "\n.", ".\r\nlast line ends in a dot.\r", "\n", ".", "\r", "\n")
+    email, err := toTest.Retrieve(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if email.Message != ".first\r\n.\r\nlast line ends in a dot." {
+        t.Errorf("Invalid message %q", email.Message)
+    }
+
+    // a line of a single stuffed dot mustn't be mistaken for the terminator
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n..\r\n.\r\n")
+    email, err = toTest.Retrieve(1)
+    if err != nil || email.Message != "." {
+        t.Errorf("Invalid message %q, error %v", email.Message, err)
+    }
+}
+
+// Test_RetrieveConnectionClosed checks that a message cut short is an error
+func Test_RetrieveConnectionClosed(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "+OK 40\r\npartial\r\n")
+    testConn.ReadError = io.EOF
+    testConn.ThrowReadErrorAfter = 1
+    _, err := toTest.Retrieve(1)
+    if err != io.ErrUnexpectedEOF {
+        t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+    }
+}
+
+// Test_RetrieveToOk checks that a message is streamed to the writer
+func Test_RetrieveToOk(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "+OK 100\r\n..leading dot\r\nThe mess", "age\r\n.", "\r\n")
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+
+    var body strings.Builder
+    written, err := toTest.RetrieveTo(10, &body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if testConn.Written[0] != "RETR 10\r\n" {
+        t.Error("Invalid command")
+    }
+    if body.String() != ".leading dot\r\nThe message\r\n" || written != int64(body.Len()) {
+        t.Errorf("Invalid message %q written %v", body.String(), written)
+    }
+
+    // the connection is left ready for the next response
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    err = toTest.Delete(10)
+    if err != nil {
+        t.Error(err)
+    }
+}
+
+// Test_RetrieveReaderOk checks that a partially read message can be closed
+func Test_RetrieveReaderOk(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "+OK 100\r\nline one\r\nline two\r\n.\r\n")
+    body, err := toTest.RetrieveReader(10)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    start := make([]byte, 4)
+    io.ReadFull(body, start)
+    if string(start) != "line" {
+        t.Errorf("Invalid start %q", start)
+    }
+
+    err = body.Close()
+    if err != nil {
+        t.Error(err)
+    }
+
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    err = toTest.Reset()
+    if err != nil {
+        t.Error(err)
+    }
+}
+
+// Test_RetrieveToErrors checks that errors are returned when streaming
+func Test_RetrieveToErrors(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "-ERR no such message\r\n")
+    _, err := toTest.RetrieveTo(10, io.Discard)
+    if err == nil {
+        t.Error("No error returned")
+    }
+
+    testConn.WriteError = errors.New("foo")
+    testConn.ThrowWriteErrorAfter = testConn.TimesWriteCalled
+    _, err = toTest.RetrieveReader(10)
+    if err == nil {
+        t.Error("Expected an error")
+    }
+}
+
+// Test_TopOk checks that the headers and first lines of a message are retrieved correctly
+func Test_TopOk(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "+OK top of message follows\r\nSubject: hi\r\n\r\n..first line\r\n.\r\n")
+    email, err := toTest.Top(10, 1)
+
+    if err != nil {
+        t.Error("Error returned")
+    }
+    if testConn.Written[0] != "TOP 10 1\r\n" {
+        t.Error("Invalid command")
+    }
+    if email.ID != 10 || email.Message != "Subject: hi\r\n\r\n.first line" {
+        t.Errorf("Invalid message %q", email.Message)
+    }
+}
+
+// Test_TopErrors checks that errors are returned from TOP
+func Test_TopErrors(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    _, err := toTest.Top(10, -1)
+    if err == nil || len(testConn.Written) != 0 {
+        t.Error("Expected an error without writing")
+    }
+
+    testConn.ToRead = append(testConn.ToRead, "-ERR no such message\r\n")
+    _, err = toTest.Top(10, 0)
+    if err == nil {
+        t.Error("No error returned")
+    }
+
+    testConn.WriteError = errors.New("foo")
+    testConn.ThrowWriteErrorAfter = testConn.TimesWriteCalled
+    _, err = toTest.Top(10, 0)
+    if err == nil {
+        t.Error("Expected an error")
+    }
+}
+
 // Test_DeleteOk checks that DELE is called correctly
 func Test_DeleteOk(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "+OK deleted\r\n")
     err := toTest.Delete(10)
@@ -636,7 +1197,7 @@ func Test_DeleteOk(t *testing.T) {
 
 // Test_DeleteReadWriteError checks that when DELE is called a read write error
 func Test_DeleteReadWriteError(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "+OK deleted\r\n")
     testConn.WriteError = errors.New("foo")
@@ -659,7 +1220,7 @@ func Test_DeleteReadWriteError(t *testing.T) {
 
 // Test_DeleteErrorMsg checks that when DELE is called and an error thats returned is handled
 func Test_DeleteErrorMsg(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "-ERR deleted\r\n")
     err := toTest.Delete(10)
@@ -671,7 +1232,7 @@ func Test_DeleteErrorMsg(t *testing.T) {
 
 // Test_ResetOk checks that RSET is called correctly
 func Test_ResetOk(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "+OK 2 msgs\r\n")
     err := toTest.Reset()
@@ -684,9 +1245,28 @@ func Test_ResetOk(t *testing.T) {
     }
 }
 
+// Test_NoopOk checks that NOOP is sent and an error returned when rejected
+func Test_NoopOk(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n", "-ERR [SYS/TEMP] shutting down\r\n")
+    err := toTest.Noop()
+    if err != nil {
+        t.Error("Error returned")
+    }
+    if testConn.Written[0] != "NOOP\r\n" {
+        t.Error("Invalid command")
+    }
+
+    err = toTest.Noop()
+    if !errors.Is(err, ErrTemporary) {
+        t.Errorf("Expected ErrTemporary, got %v", err)
+    }
+}
+
 // Test_ResetReadWriteError checks that when RSET is called a read write error is handled
 func Test_ResetReadWriteError(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "+OK 2 msgs\r\n")
     testConn.WriteError = errors.New("foo")
@@ -709,7 +1289,7 @@ func Test_ResetReadWriteError(t *testing.T) {
 
 // Test_ResetErrorMsg checks that when RSET is called and an error thats returned is handled
 func Test_ResetErrorMsg(t *testing.T) {
-    testConn, toTest, _ := initialiseConnection()
+    testConn, toTest, _ := initialiseSession()
 
     testConn.ToRead = append(testConn.ToRead, "-ERR unknown\r\n")
     err := toTest.Reset()
@@ -719,6 +1299,9 @@ func Test_ResetErrorMsg(t *testing.T) {
     }
 }
 
+// capaResponse is a typical CAPA response returned after connecting
+const capaResponse = "+OK\r\nTOP\r\nUIDL\r\nUSER\r\n.\r\n"
+
 // initialiseConnection initialises a connection calling connect
 // and resetting any read counters back to 0
 func initialiseConnection() (*TestConnection, *Client, *config.Config) {
@@ -727,6 +1310,7 @@ func initialiseConnection() (*TestConnection, *Client, *config.Config) {
 
     testConn := NewTestConnection()
     testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
 
     toTest := NewClient(*conf)
     toTest.Dialer = func(net string, server string) (net.Conn, error) {
@@ -735,6 +1319,16 @@ func initialiseConnection() (*TestConnection, *Client, *config.Config) {
     
     toTest.Connect()
     testConn.TimesReadCalled = 0
+    testConn.TimesWriteCalled = 0
+    testConn.Written = testConn.Written[:0]
     
     return testConn, toTest, conf
-}
\ No newline at end of file
+}
+
+// initialiseSession returns a connected client in the TRANSACTION state without authenticating
+func initialiseSession() (*TestConnection, *Client, *config.Config) {
+    testConn, toTest, conf := initialiseConnection()
+    toTest.state = StateTransaction
+
+    return testConn, toTest, conf
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "github.com/benmj87/gogo-pop3gadget/src/pop3test"
+)
+
+// newMailboxClient returns a client logged in to a pop3test mailbox of count messages.
+// DELE is acknowledged without deleting so every message can be retrieved throughout
+func newMailboxClient(t *testing.T, count int) (*Client, []string) {
+    var messages []string
+    for i := 1; i <= count; i++ {
+        messages = append(messages, fmt.Sprintf("Subject: %d\r\n\r\n%s\r\n", i, strings.Repeat(strconv.Itoa(i) + " ", 2000)))
+    }
+
+    server := pop3test.NewServer()
+    server.Greeting = "+OK ready"
+    server.AddMailbox("user", "secret", messages...)
+    server.Inject(pop3test.Fault { Command: "DELE", Response: "+OK" })
+    t.Cleanup(func() { server.Close() })
+
+    toTest := NewClient(*server.Config("user"))
+    toTest.Dialer = server.Dial
+    connectMailbox(t, toTest)
+
+    return toTest, messages
+}
+
+// Test_ConcurrentRetrieve checks messages retrieved from many goroutines aren't interleaved
+func Test_ConcurrentRetrieve(t *testing.T) {
+    toTest, messages := newMailboxClient(t, 5)
+
+    var wait sync.WaitGroup
+    for worker := 0; worker < 20; worker++ {
+        wait.Add(1)
+        go func(worker int) {
+            defer wait.Done()
+
+            for i := 0; i < 5; i++ {
+                id := (worker + i) % len(messages) + 1
+                email, err := toTest.Retrieve(id)
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+                if email.Message + "\r\n" != messages[id - 1] {
+                    t.Errorf("Message %d corrupted", id)
+                }
+            }
+        }(worker)
+    }
+    wait.Wait()
+
+    err := toTest.Close()
+    if err != nil {
+        t.Error(err)
+    }
+}
+
+// Test_ConcurrentMixedCommands checks different commands from many goroutines each get their own response
+func Test_ConcurrentMixedCommands(t *testing.T) {
+    toTest, messages := newMailboxClient(t, 4)
+
+    var wait sync.WaitGroup
+    run := func(fn func() error) {
+        wait.Add(1)
+        go func() {
+            defer wait.Done()
+
+            for i := 0; i < 10; i++ {
+                err := fn()
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+            }
+        }()
+    }
+
+    run(func() error {
+        count, _, err := toTest.Stat()
+        if err == nil && int(count) != len(messages) {
+            err = fmt.Errorf("Incorrect STAT count %d", count)
+        }
+        return err
+    })
+    run(func() error {
+        emails, err := toTest.UIDL()
+        if err == nil && (len(emails) != len(messages) || emails[3].UID != "uid-4") {
+            err = fmt.Errorf("Incorrect UIDL %v", emails)
+        }
+        return err
+    })
+    run(func() error {
+        body, err := toTest.RetrieveReader(2)
+        if err != nil {
+            return err
+        }
+
+        // read to the end without closing, which releases the client
+        content, err := io.ReadAll(body)
+        if err == nil && string(content) != messages[1] {
+            err = fmt.Errorf("Message 2 corrupted")
+        }
+        return err
+    })
+    run(func() error {
+        body, err := toTest.RetrieveReader(3)
+        if err != nil {
+            return err
+        }
+
+        // close part way through
+        body.Read(make([]byte, 10))
+        return body.Close()
+    })
+    run(func() error {
+        var content bytes.Buffer
+        _, err := toTest.RetrieveTo(1, &content)
+        if err == nil && content.String() != messages[0] {
+            err = fmt.Errorf("Message 1 corrupted")
+        }
+        return err
+    })
+    run(func() error {
+        return toTest.RetrieveMany([]int { 4, 1 }, func(ID int, body io.Reader) error {
+            content, err := io.ReadAll(body)
+            if err == nil && string(content) != messages[ID - 1] {
+                err = fmt.Errorf("Message %d corrupted", ID)
+            }
+            return err
+        })
+    })
+    run(func() error {
+        return toTest.DeleteMany([]int { 1, 2, 3 })
+    })
+    run(func() error {
+        if toTest.State() != StateTransaction || toTest.Greeting() != "+OK ready" {
+            return fmt.Errorf("Incorrect state %v or greeting %v", toTest.State(), toTest.Greeting())
+        }
+        return nil
+    })
+
+    wait.Wait()
+
+    err := toTest.Close()
+    if err != nil {
+        t.Error(err)
+    }
+    if toTest.State() != StateClosed {
+        t.Errorf("Expected CLOSED, got %v", toTest.State())
+    }
+}
@@ -0,0 +1,341 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ConnectContext is Connect with ctx controlling the deadline and cancellation
+func (c *Client) ConnectContext(ctx context.Context) error {
+	c.cmdLock.Lock()
+	defer c.cmdLock.Unlock()
+
+	return c.connect(ctx)
+}
+
+// AuthContext is Auth with ctx controlling the deadline and cancellation
+func (c *Client) AuthContext(ctx context.Context) error {
+	return c.withContext(ctx, c.config.CommandTimeout, "AUTH", c.auth)
+}
+
+// AuthWithContext is AuthWith with ctx controlling the deadline and cancellation
+func (c *Client) AuthWithContext(ctx context.Context, mech Mechanism) error {
+	return c.withContext(ctx, c.config.CommandTimeout, "AUTH", func() error {
+		return c.authWith(mech)
+	})
+}
+
+// CapabilitiesContext is Capabilities with ctx controlling the deadline and cancellation
+func (c *Client) CapabilitiesContext(ctx context.Context) (*Capabilities, error) {
+	var caps *Capabilities
+	err := c.withContext(ctx, c.config.CommandTimeout, "CAPA", func() error {
+		var err error
+		caps, err = c.fetchCapabilities()
+		return err
+	})
+
+	return caps, err
+}
+
+// StatContext is Stat with ctx controlling the deadline and cancellation
+func (c *Client) StatContext(ctx context.Context) (uint32, uint64, error) {
+	var msgs uint32
+	var size uint64
+	err := c.withContext(ctx, c.config.CommandTimeout, "STAT", func() error {
+		var err error
+		msgs, size, err = c.stat()
+		return err
+	})
+
+	return msgs, size, err
+}
+
+// ListMessageContext is ListMessage with ctx controlling the deadline and cancellation
+func (c *Client) ListMessageContext(ctx context.Context, messageID int) (*Email, error) {
+	var email *Email
+	err := c.withContext(ctx, c.config.CommandTimeout, "LIST", func() error {
+		var err error
+		email, err = c.listMessage(messageID)
+		return err
+	})
+
+	return email, err
+}
+
+// ListContext is List with ctx controlling the deadline and cancellation
+func (c *Client) ListContext(ctx context.Context) ([]*Email, error) {
+	var emails []*Email
+	err := c.withContext(ctx, c.config.CommandTimeout, "LIST", func() error {
+		var err error
+		emails, err = c.list()
+		return err
+	})
+
+	return emails, err
+}
+
+// UIDLContext is UIDL with ctx controlling the deadline and cancellation
+func (c *Client) UIDLContext(ctx context.Context) ([]*Email, error) {
+	var emails []*Email
+	err := c.withContext(ctx, c.config.CommandTimeout, "UIDL", func() error {
+		var err error
+		emails, err = c.uidl()
+		return err
+	})
+
+	return emails, err
+}
+
+// UIDLMessageContext is UIDLMessage with ctx controlling the deadline and cancellation
+func (c *Client) UIDLMessageContext(ctx context.Context, messageID int) (*Email, error) {
+	var email *Email
+	err := c.withContext(ctx, c.config.CommandTimeout, "UIDL", func() error {
+		var err error
+		email, err = c.uidlMessage(messageID)
+		return err
+	})
+
+	return email, err
+}
+
+// RetrieveContext is Retrieve with ctx controlling the deadline and cancellation
+func (c *Client) RetrieveContext(ctx context.Context, ID int) (*Email, error) {
+	var email *Email
+	err := c.withContext(ctx, c.config.CommandTimeout, "RETR", func() error {
+		var err error
+		email, err = c.retrieve(ID)
+		return err
+	})
+
+	return email, err
+}
+
+// RetrieveToContext is RetrieveTo with ctx controlling the deadline and cancellation
+func (c *Client) RetrieveToContext(ctx context.Context, ID int, w io.Writer) (int64, error) {
+	var written int64
+	err := c.withContext(ctx, c.config.CommandTimeout, "RETR", func() error {
+		var err error
+		written, err = c.retrieveTo(ID, w)
+		return err
+	})
+
+	return written, err
+}
+
+// RetrieveReaderContext is RetrieveReader with ctx controlling the deadline and
+// cancellation, which apply until the reader has been read to the end or closed
+func (c *Client) RetrieveReaderContext(ctx context.Context, ID int) (io.ReadCloser, error) {
+	c.cmdLock.Lock()
+
+	finish, err := c.startCommand(ctx, c.config.CommandTimeout, "RETR")
+	if err != nil {
+		c.cmdLock.Unlock()
+		return nil, err
+	}
+
+	body, err := c.retrieveReader(ID)
+	if err != nil {
+		err = finish(err)
+		c.cmdLock.Unlock()
+		return nil, err
+	}
+
+	return &lockedBody{ReadCloser: body, finish: func(err error) error {
+		defer c.cmdLock.Unlock()
+		return finish(err)
+	}}, nil
+}
+
+// TopContext is Top with ctx controlling the deadline and cancellation
+func (c *Client) TopContext(ctx context.Context, ID int, lines int) (*Email, error) {
+	var email *Email
+	err := c.withContext(ctx, c.config.CommandTimeout, "TOP", func() error {
+		var err error
+		email, err = c.top(ID, lines)
+		return err
+	})
+
+	return email, err
+}
+
+// DeleteContext is Delete with ctx controlling the deadline and cancellation
+func (c *Client) DeleteContext(ctx context.Context, ID int) error {
+	return c.withContext(ctx, c.config.CommandTimeout, "DELE", func() error {
+		return c.deleteMsg(ID)
+	})
+}
+
+// ResetContext is Reset with ctx controlling the deadline and cancellation
+func (c *Client) ResetContext(ctx context.Context) error {
+	return c.withContext(ctx, c.config.CommandTimeout, "RSET", c.reset)
+}
+
+// NoopContext is Noop with ctx controlling the deadline and cancellation
+func (c *Client) NoopContext(ctx context.Context) error {
+	return c.withContext(ctx, c.config.CommandTimeout, "NOOP", c.noop)
+}
+
+// CloseContext is Close with ctx controlling the deadline and cancellation, the
+// connection is closed even if QUIT fails
+func (c *Client) CloseContext(ctx context.Context) error {
+	return c.withContext(ctx, c.config.CommandTimeout, "QUIT", c.quit)
+}
+
+// withContext runs fn once any other command has finished, see withDeadline
+func (c *Client) withContext(ctx context.Context, timeout time.Duration, command string, fn func() error) error {
+	c.cmdLock.Lock()
+	defer c.cmdLock.Unlock()
+
+	return c.withDeadline(ctx, timeout, command, fn)
+}
+
+// withDeadline runs fn with the connection deadline set from ctx and timeout, unblocking
+// any I/O if ctx is cancelled. If the command is cancelled or times out the connection
+// is closed as the rest of the response can't be read reliably
+func (c *Client) withDeadline(ctx context.Context, timeout time.Duration, command string, fn func() error) error {
+	finish, err := c.startCommand(ctx, timeout, command)
+	if err != nil {
+		return err
+	}
+
+	return finish(fn())
+}
+
+// startCommand sets the connection deadline from ctx and timeout for command, unblocking
+// any I/O if ctx is cancelled, see withDeadline. finish must be called with the result
+// once the command is done, e.g. once a streamed body has been read, it returns the error
+// to report
+func (c *Client) startCommand(ctx context.Context, timeout time.Duration, command string) (func(error) error, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	logged := func(err error) error {
+		if err != nil {
+			c.logger.Error("Command failed", "command", command, "duration", time.Since(start), "error", err)
+		} else {
+			c.logger.Debug("Command completed", "command", command, "duration", time.Since(start))
+		}
+
+		return err
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if timeout > 0 && (!hasDeadline || time.Now().Add(timeout).Before(deadline)) {
+		deadline = time.Now().Add(timeout)
+		hasDeadline = true
+	}
+
+	if c.connection == nil {
+		return logged, nil
+	}
+
+	c.ioLock.Lock()
+	c.cancelled = false
+	c.deadline = time.Time{}
+	if hasDeadline {
+		c.deadline = deadline
+		err = c.connection.SetDeadline(deadline)
+	}
+	c.ioLock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	stop := func() {}
+	if ctx.Done() != nil {
+		stopping := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+
+			select {
+			case <-ctx.Done():
+				c.ioLock.Lock()
+				c.cancelled = true
+				c.connection.SetDeadline(time.Unix(1, 0))
+				c.ioLock.Unlock()
+			case <-stopping:
+			}
+		}()
+
+		stop = func() {
+			close(stopping)
+			<-stopped
+		}
+	}
+
+	return func(err error) error {
+		stop()
+		err = logged(err)
+
+		var netErr net.Error
+		if c.cancelled || (errors.As(err, &netErr) && netErr.Timeout()) {
+			c.logger.Warn("Command cancelled or timed out, closing connection", "command", command, "server", c.config.Server, "error", err)
+			c.connection.Close()
+			c.setState(StateClosed)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return err
+		}
+
+		if hasDeadline {
+			c.connection.SetDeadline(time.Time{})
+		}
+		c.deadline = time.Time{}
+
+		return err
+	}, nil
+}
+
+// idleReader reads from the connection, moving the read deadline on by the idle
+// timeout before each read
+type idleReader struct {
+	client *Client
+}
+
+// Read reads from the connection
+func (r *idleReader) Read(b []byte) (int, error) {
+	c := r.client
+
+	c.ioLock.Lock()
+	if c.cancelled {
+		c.ioLock.Unlock()
+		return 0, context.Canceled
+	}
+
+	conn := c.connection
+	if c.config.IdleTimeout > 0 {
+		deadline := time.Now().Add(c.config.IdleTimeout)
+		if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+			deadline = c.deadline
+		}
+
+		err := conn.SetReadDeadline(deadline)
+		if err != nil {
+			c.ioLock.Unlock()
+			return 0, err
+		}
+	}
+	c.ioLock.Unlock()
+
+	read, err := conn.Read(b)
+	if read > 0 {
+		c.transcript.received(b[:read], c.inAuth)
+	}
+	if errors.Is(err, io.EOF) {
+		c.transcript.note("connection closed by server")
+	} else if err != nil {
+		c.transcript.note("read error: %v", err)
+	}
+
+	return read, err
+}
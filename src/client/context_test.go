@@ -0,0 +1,216 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "io"
+    "net"
+    "testing"
+    "time"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+    "github.com/benmj87/gogo-pop3gadget/src/pop3test"
+)
+
+// Test_StatContextCancelled checks that cancelling aborts a command waiting on the server
+func Test_StatContextCancelled(t *testing.T) {
+    server, toTest := newTestMailbox(t, 1)
+    connectMailbox(t, toTest)
+    server.Inject(pop3test.Fault { Command: "STAT", Stall: true })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    time.AfterFunc(50 * time.Millisecond, cancel)
+
+    start := time.Now()
+    _, _, err := toTest.StatContext(ctx)
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("Expected context.Canceled, got %v", err)
+    }
+    if time.Since(start) > 5 * time.Second {
+        t.Error("Cancelling didn't unblock the read")
+    }
+
+    // the connection is closed as the response can't be trusted
+    if toTest.State() != StateClosed {
+        t.Errorf("Expected CLOSED, got %v", toTest.State())
+    }
+    _, _, err = toTest.Stat()
+    if err == nil {
+        t.Error("Expected an error on the closed connection")
+    }
+}
+
+// Test_ContextAlreadyDone checks that nothing is written for a context that is already done
+func Test_ContextAlreadyDone(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    err := toTest.DeleteContext(ctx, 1)
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("Expected context.Canceled, got %v", err)
+    }
+    if len(testConn.Written) != 0 {
+        t.Error("Unexpected command written")
+    }
+}
+
+// Test_ContextDeadlineSet checks that the context deadline is set on the connection and cleared after
+func Test_ContextDeadlineSet(t *testing.T) {
+    testConn, toTest, conf := initialiseSession()
+    conf.CommandTimeout = time.Hour
+    toTest.config = *conf
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+    defer cancel()
+
+    var during time.Time
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    toTest.Dialer = nil
+    err := toTest.withContext(ctx, conf.CommandTimeout, "RSET", func() error {
+        during = testConn.WriteDeadline
+        return toTest.reset()
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    expected, _ := ctx.Deadline()
+    if !during.Equal(expected) {
+        t.Errorf("Expected the earlier context deadline %v, got %v", expected, during)
+    }
+    if !testConn.WriteDeadline.IsZero() || !testConn.ReadDeadline.IsZero() {
+        t.Error("Deadline wasn't cleared")
+    }
+}
+
+// Test_CommandTimeout checks that a stalled server times out
+func Test_CommandTimeout(t *testing.T) {
+    server, toTest := newTestMailbox(t, 1)
+    toTest.config.CommandTimeout = 50 * time.Millisecond
+    connectMailbox(t, toTest)
+    server.Inject(pop3test.Fault { Command: "LIST", Stall: true })
+
+    _, err := toTest.List()
+    var netErr net.Error
+    if !errors.As(err, &netErr) || !netErr.Timeout() {
+        t.Errorf("Expected a timeout, got %v", err)
+    }
+}
+
+// Test_IdleTimeout checks that a slow server keeps sending but one going quiet part way through a response times out
+func Test_IdleTimeout(t *testing.T) {
+    server, toTest := newTestMailbox(t, 4)
+    toTest.config.IdleTimeout = 50 * time.Millisecond
+    connectMailbox(t, toTest)
+
+    server.Inject(pop3test.Fault { Command: "LIST", Count: 1, Interval: 20 * time.Millisecond })
+    start := time.Now()
+    emails, err := toTest.ListContext(context.Background())
+    if err != nil || len(emails) != 4 {
+        t.Errorf("Timed out while the server was still sending, got %v, %v", emails, err)
+    }
+    if time.Since(start) < 80 * time.Millisecond {
+        t.Errorf("Response wasn't slowed, took %v", time.Since(start))
+    }
+
+    server.Inject(pop3test.Fault { Command: "LIST", Response: "+OK\r\n1 31", Stall: true })
+    _, err = toTest.ListContext(context.Background())
+    var netErr net.Error
+    if !errors.As(err, &netErr) || !netErr.Timeout() {
+        t.Errorf("Expected a timeout, got %v", err)
+    }
+}
+
+// Test_RetrieveReaderContextCancelled checks cancelling while the body is being read aborts it
+func Test_RetrieveReaderContextCancelled(t *testing.T) {
+    server, toTest := newTestMailbox(t, 1)
+    connectMailbox(t, toTest)
+    server.Inject(pop3test.Fault { Command: "RETR", Interval: 100 * time.Millisecond })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    body, err := toTest.RetrieveReaderContext(ctx, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cancel()
+
+    _, err = io.ReadAll(body)
+    if err == nil {
+        t.Error("Expected reading the body to fail once cancelled")
+    }
+    err = body.Close()
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("Expected context.Canceled, got %v", err)
+    }
+    if toTest.State() != StateClosed {
+        t.Errorf("Expected CLOSED, got %v", toTest.State())
+    }
+}
+
+// Test_RetrieveReaderTimeout checks the command timeout applies until the body has been read
+func Test_RetrieveReaderTimeout(t *testing.T) {
+    server, toTest := newTestMailbox(t, 1)
+    toTest.config.CommandTimeout = 50 * time.Millisecond
+    connectMailbox(t, toTest)
+    server.Inject(pop3test.Fault { Command: "RETR", Response: "+OK\r\nSubject: 1", Stall: true })
+
+    body, err := toTest.RetrieveReader(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = io.ReadAll(body)
+    var netErr net.Error
+    if !errors.As(err, &netErr) || !netErr.Timeout() {
+        t.Errorf("Expected a timeout, got %v", err)
+    }
+    body.Close()
+    if toTest.State() != StateClosed {
+        t.Errorf("Expected CLOSED, got %v", toTest.State())
+    }
+}
+
+// Test_ConnectContextDialCancelled checks that a slow dial is abandoned
+func Test_ConnectContextDialCancelled(t *testing.T) {
+    conf := config.NewConfig()
+    conf.UseTLS = false
+
+    release := make(chan struct{})
+    defer close(release)
+
+    toTest := NewClient(*conf)
+    toTest.Dialer = func(net string, server string) (net.Conn, error) {
+        <-release
+        return NewTestConnection(), nil
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+    defer cancel()
+
+    err := toTest.ConnectContext(ctx)
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+    }
+}
+
+// Test_ConnectTimeout checks that a server that never sends a greeting times out
+func Test_ConnectTimeout(t *testing.T) {
+    conf := config.NewConfig()
+    conf.UseTLS = false
+    conf.ConnectTimeout = 50 * time.Millisecond
+
+    clientConn, serverConn := net.Pipe()
+    defer serverConn.Close()
+
+    toTest := NewClient(*conf)
+    toTest.Dialer = func(net string, server string) (net.Conn, error) {
+        return clientConn, nil
+    }
+
+    err := toTest.Connect()
+    var netErr net.Error
+    if !errors.As(err, &netErr) || !netErr.Timeout() {
+        t.Errorf("Expected a timeout, got %v", err)
+    }
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/benmj87/gogo-pop3gadget/src/config"
+)
+
+// defaultFallbackDelay is how long to wait for the preferred address family before
+// racing the other, matching net.Dialer
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// familyDialer opens TCP connections using the address family and local address from
+// the config
+type familyDialer struct {
+	conf config.Config
+}
+
+// Dial connects to addr, racing IPv4 and IPv6 for dual-stack servers (RFC 8305)
+func (d *familyDialer) Dial(network string, addr string) (net.Conn, error) {
+	dialer, err := d.dialer()
+	if err != nil {
+		return nil, err
+	}
+	if network != "tcp" {
+		return dialer.Dial(network, addr)
+	}
+
+	switch d.conf.AddressFamily {
+	case config.AddressIPv4:
+		return dialer.Dial(network+"4", addr)
+	case config.AddressIPv6:
+		return dialer.Dial(network+"6", addr)
+	case config.AddressPreferIPv4:
+		return d.race(dialer, network+"4", network+"6", addr)
+	case config.AddressPreferIPv6:
+		return d.race(dialer, network+"6", network+"4", addr)
+	}
+
+	// net.Dialer races the address families itself in the order they're resolved
+	return dialer.Dial(network, addr)
+}
+
+// dialer returns the net.Dialer for the config
+func (d *familyDialer) dialer() (*net.Dialer, error) {
+	dialer := &net.Dialer{
+		Timeout:       d.conf.ConnectTimeout,
+		FallbackDelay: d.conf.FallbackDelay,
+	}
+
+	if d.conf.LocalAddress != "" {
+		ip := net.ParseIP(d.conf.LocalAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid local address %v", d.conf.LocalAddress)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	return dialer, nil
+}
+
+// race dials addr over the primary network, starting the fallback network if the primary
+// hasn't connected within the fallback delay or as soon as it fails. The first connection
+// made is returned, or the primary error if both fail
+func (d *familyDialer) race(dialer *net.Dialer, primary string, fallback string, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// an address literal only has one family
+	if net.ParseIP(host) != nil {
+		return dialer.Dial("tcp", addr)
+	}
+
+	delay := d.conf.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+
+	return raceDial(func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, primary, addr)
+	}, func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, fallback, addr)
+	}, delay)
+}
+
+// raceDial runs primary, starting fallback after delay or once primary fails. A negative
+// delay only starts fallback once primary fails. The losing attempt is cancelled and any
+// connection it makes is closed
+func raceDial(primary func(context.Context) (net.Conn, error), fallback func(context.Context) (net.Conn, error), delay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result, 2)
+	start := func(dial func(context.Context) (net.Conn, error), isPrimary bool) {
+		go func() {
+			conn, err := dial(ctx)
+			results <- result{conn, err, isPrimary}
+		}()
+	}
+
+	start(primary, true)
+
+	var timer <-chan time.Time
+	if delay >= 0 {
+		fallbackTimer := time.NewTimer(delay)
+		defer fallbackTimer.Stop()
+		timer = fallbackTimer.C
+	}
+
+	started := 1
+	fallbackStarted := false
+	var primaryErr error
+	var fallbackErr error
+	for received := 0; received < started || !fallbackStarted; {
+		select {
+		case <-timer:
+			timer = nil
+			if !fallbackStarted {
+				fallbackStarted = true
+				started++
+				start(fallback, false)
+			}
+		case res := <-results:
+			received++
+			if res.err == nil {
+				cancel()
+				// close whatever the other attempt connects
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(started - received)
+				return res.conn, nil
+			}
+
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				started++
+				start(fallback, false)
+			}
+		}
+	}
+
+	cancel()
+	if primaryErr != nil {
+		return nil, primaryErr
+	}
+	return nil, fallbackErr
+}
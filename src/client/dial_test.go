@@ -0,0 +1,233 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "net"
+    "os"
+    "testing"
+    "time"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+    "github.com/benmj87/gogo-pop3gadget/src/pop3test"
+)
+
+// newFamilyListener serves a mailbox on the loopback address of a family, tcp4 or tcp6,
+// skipping the test if the family isn't available. Accepted connections are sent to accepted
+func newFamilyListener(t *testing.T, network string, accepted chan<- net.Conn) *net.TCPAddr {
+    host := "127.0.0.1"
+    if network == "tcp6" {
+        host = "::1"
+    }
+
+    listener, err := net.Listen(network, net.JoinHostPort(host, "0"))
+    if err != nil {
+        t.Skipf("%v not available: %v", network, err)
+    }
+    t.Cleanup(func() { listener.Close() })
+
+    server := pop3test.NewServer()
+    t.Cleanup(func() { server.Close() })
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            if accepted != nil {
+                accepted <- conn
+            }
+            go server.Serve(conn)
+        }
+    }()
+
+    return listener.Addr().(*net.TCPAddr)
+}
+
+// newPlainConfig returns the config for a plaintext server at host and port
+func newPlainConfig(host string, port int) *config.Config {
+    conf := config.NewConfig()
+    conf.UseTLS = false
+    conf.Server = host
+    conf.Port = port
+
+    return conf
+}
+
+// Test_ConnectIPv6Literal checks IPv6 addresses are joined with the port correctly, with or without brackets
+func Test_ConnectIPv6Literal(t *testing.T) {
+    addr := newFamilyListener(t, "tcp6", nil)
+
+    for _, server := range []string { "::1", "[::1]" } {
+        toTest := NewClient(*newPlainConfig(server, addr.Port))
+        err := toTest.Connect()
+        if err != nil {
+            t.Fatalf("Unable to connect to %v: %v", server, err)
+        }
+        toTest.Close()
+    }
+}
+
+// Test_ConnectAddressFamily checks only the selected address family is used
+func Test_ConnectAddressFamily(t *testing.T) {
+    addr4 := newFamilyListener(t, "tcp4", nil)
+    addr6 := newFamilyListener(t, "tcp6", nil)
+
+    tests := []struct {
+        server string
+        port int
+        family config.AddressFamily
+        ok bool
+    } {
+        { "127.0.0.1", addr4.Port, config.AddressIPv4, true },
+        { "127.0.0.1", addr4.Port, config.AddressIPv6, false },
+        { "::1", addr6.Port, config.AddressIPv6, true },
+        { "::1", addr6.Port, config.AddressIPv4, false },
+        { "::1", addr6.Port, config.AddressPreferIPv4, true },
+        { "127.0.0.1", addr4.Port, config.AddressAny, true },
+    }
+
+    for _, test := range tests {
+        conf := newPlainConfig(test.server, test.port)
+        conf.AddressFamily = test.family
+
+        toTest := NewClient(*conf)
+        err := toTest.Connect()
+        if (err == nil) != test.ok {
+            t.Errorf("Connecting to %v with family %v, expected success %v got %v", test.server, test.family, test.ok, err)
+        }
+        if err == nil {
+            toTest.Close()
+        }
+    }
+}
+
+// Test_ConnectPreferFallback checks the other family is used when the preferred one has no addresses
+func Test_ConnectPreferFallback(t *testing.T) {
+    addr := newFamilyListener(t, "tcp4", nil)
+    if ips, err := net.LookupIP("localhost"); err != nil || len(ips) == 0 {
+        t.Skip("localhost doesn't resolve")
+    }
+
+    conf := newPlainConfig("localhost", addr.Port)
+    conf.AddressFamily = config.AddressPreferIPv6
+    conf.ConnectTimeout = 5 * time.Second
+
+    toTest := NewClient(*conf)
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    toTest.Close()
+}
+
+// Test_ConnectLocalAddress checks the connection is made from the local address
+func Test_ConnectLocalAddress(t *testing.T) {
+    accepted := make(chan net.Conn, 1)
+    addr := newFamilyListener(t, "tcp4", accepted)
+
+    conf := newPlainConfig("127.0.0.1", addr.Port)
+    conf.LocalAddress = "127.0.0.2"
+
+    toTest := NewClient(*conf)
+    err := toTest.Connect()
+    if err != nil {
+        t.Skipf("Unable to connect from %v: %v", conf.LocalAddress, err)
+    }
+    defer toTest.Close()
+
+    remote := (<-accepted).RemoteAddr().(*net.TCPAddr)
+    if remote.IP.String() != "127.0.0.2" {
+        t.Errorf("Connected from %v", remote)
+    }
+
+    conf.LocalAddress = "not an address"
+    err = NewClient(*conf).Connect()
+    if err == nil {
+        t.Error("Invalid local address accepted")
+    }
+}
+
+// Test_RaceDialFallback checks the fallback is started after the delay and the slow primary is cancelled
+func Test_RaceDialFallback(t *testing.T) {
+    client, server := net.Pipe()
+    defer server.Close()
+
+    cancelled := make(chan bool, 1)
+    conn, err := raceDial(func(ctx context.Context) (net.Conn, error) {
+        <-ctx.Done()
+        cancelled <- true
+        return nil, ctx.Err()
+    }, func(ctx context.Context) (net.Conn, error) {
+        return client, nil
+    }, 10 * time.Millisecond)
+
+    if err != nil || conn != client {
+        t.Fatalf("Expected the fallback connection, got %v, %v", conn, err)
+    }
+    select {
+    case <-cancelled:
+    case <-time.After(time.Second):
+        t.Error("Primary not cancelled")
+    }
+}
+
+// Test_RaceDialPrimaryFails checks the fallback is started straight away when the primary fails
+func Test_RaceDialPrimaryFails(t *testing.T) {
+    client, server := net.Pipe()
+    defer server.Close()
+
+    start := time.Now()
+    conn, err := raceDial(func(ctx context.Context) (net.Conn, error) {
+        return nil, errors.New("no route")
+    }, func(ctx context.Context) (net.Conn, error) {
+        return client, nil
+    }, time.Hour)
+
+    if err != nil || conn != client || time.Since(start) > time.Second {
+        t.Errorf("Expected the fallback connection straight away, got %v, %v", conn, err)
+    }
+}
+
+// Test_RaceDialPrimaryWins checks the primary connection is used and a late fallback is closed
+func Test_RaceDialPrimaryWins(t *testing.T) {
+    primary, primaryServer := net.Pipe()
+    defer primaryServer.Close()
+    fallback, fallbackServer := net.Pipe()
+    defer fallbackServer.Close()
+
+    release := make(chan bool)
+    conn, err := raceDial(func(ctx context.Context) (net.Conn, error) {
+        time.Sleep(20 * time.Millisecond)
+        return primary, nil
+    }, func(ctx context.Context) (net.Conn, error) {
+        <-release
+        return fallback, nil
+    }, time.Millisecond)
+    close(release)
+
+    if err != nil || conn != primary {
+        t.Fatalf("Expected the primary connection, got %v, %v", conn, err)
+    }
+
+    // the late fallback connection is closed so the server end sees EOF
+    fallbackServer.SetReadDeadline(time.Now().Add(time.Second))
+    _, err = fallbackServer.Read(make([]byte, 1))
+    if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Errorf("Fallback connection not closed %v", err)
+    }
+}
+
+// Test_RaceDialBothFail checks the primary error is returned when neither connects
+func Test_RaceDialBothFail(t *testing.T) {
+    primaryErr := errors.New("primary failed")
+    _, err := raceDial(func(ctx context.Context) (net.Conn, error) {
+        return nil, primaryErr
+    }, func(ctx context.Context) (net.Conn, error) {
+        return nil, errors.New("fallback failed")
+    }, -1)
+
+    if err != primaryErr {
+        t.Errorf("Expected the primary error, got %v", err)
+    }
+}
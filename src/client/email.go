@@ -12,6 +12,8 @@ type Email struct {
     ID int
     // Size holds the message size in bytes
     Size uint
+    // UID holds the unique-id listing for the message, this persists across sessions
+    UID string
     // Message holds the message content
     Message string
 }
@@ -65,4 +67,51 @@ func (e *Email) ParseSingleLine(line string) error {
     e.ID = int(id)
 
     return nil
-}
\ No newline at end of file
+}
+
+// ParseUIDLine parses a line of a UIDL response expecting {ID} {UID}
+func (e *Email) ParseUIDLine(line string) error {
+    items := strings.Fields(line)
+    if len(items) < 2 {
+        return fmt.Errorf("Incorrect line, not enough elements splitting on space, '%v'", line)
+    }
+
+    id, err := strconv.ParseInt(items[0], 10, 32)
+    if err != nil {
+        return fmt.Errorf("Incorrect message id returned %v, error was %v", items[0], err)
+    }
+
+    if !isValidUID(items[1]) {
+        return fmt.Errorf("Incorrect unique-id returned '%v'", items[1])
+    }
+
+    e.ID = int(id)
+    e.UID = items[1]
+
+    return nil
+}
+
+// ParseSingleUIDLine parses a single line UIDL response expecting +OK {ID} {UID}
+func (e *Email) ParseSingleUIDLine(line string) error {
+    items := strings.Fields(line)
+    if len(items) < 3 {
+        return fmt.Errorf("Incorrect line, not enough elements splitting on space, '%v'", line)
+    }
+
+    return e.ParseUIDLine(strings.Join(items[1:3], " "))
+}
+
+// isValidUID checks the unique-id is 1-70 characters in the range 0x21 to 0x7E as per RFC 1939
+func isValidUID(uid string) bool {
+    if len(uid) == 0 || len(uid) > 70 {
+        return false
+    }
+
+    for i := 0; i < len(uid); i++ {
+        if uid[i] < 0x21 || uid[i] > 0x7E {
+            return false
+        }
+    }
+
+    return true
+}
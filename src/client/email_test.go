@@ -1,6 +1,7 @@
 package client
 
 import (
+    "strings"
     "testing"
 )
 
@@ -76,4 +77,66 @@ func Test_EmailParseSingleLineErrorsReturned(t *testing.T) {
     if err == nil {
         t.Error("Expected error")
     }
-}
\ No newline at end of file
+}
+
+// Test_EmailParseUIDLineOk checks that a UIDL line has been parsed correctly
+func Test_EmailParseUIDLineOk(t *testing.T) {
+    toTest := NewEmail()
+
+    err := toTest.ParseUIDLine("2 QhdPYR:00WBw1Ph7x7")
+    if err != nil {
+        t.Error(err)
+    }
+
+    if toTest.ID != 2 {
+        t.Error("Incorrect ID")
+    }
+    if toTest.UID != "QhdPYR:00WBw1Ph7x7" {
+        t.Errorf("Incorrect UID %v", toTest.UID)
+    }
+}
+
+// Test_EmailParseUIDLineErrorsReturned checks that an error is returned correctly
+func Test_EmailParseUIDLineErrorsReturned(t *testing.T) {
+    toTest := NewEmail()
+
+    err := toTest.ParseUIDLine("10")
+    if err == nil {
+        t.Error("Expected error")
+    }
+
+    err = toTest.ParseUIDLine("a abc")
+    if err == nil {
+        t.Error("Expected error")
+    }
+
+    err = toTest.ParseUIDLine("10 " + strings.Repeat("a", 71))
+    if err == nil {
+        t.Error("Expected error")
+    }
+
+    err = toTest.ParseUIDLine("10 ab\x7f")
+    if err == nil {
+        t.Error("Expected error")
+    }
+}
+
+// Test_EmailParseSingleUIDLineOk checks that a single UIDL line has been parsed correctly
+func Test_EmailParseSingleUIDLineOk(t *testing.T) {
+    toTest := NewEmail()
+
+    err := toTest.ParseSingleUIDLine("+OK 2 QhdPYR:00WBw1Ph7x7")
+    if err != nil {
+        t.Error(err)
+    }
+
+    if toTest.ID != 2 || toTest.UID != "QhdPYR:00WBw1Ph7x7" {
+        t.Error("Incorrect ID or UID")
+    }
+
+    err = toTest.ParseSingleUIDLine("+OK 2")
+    if err == nil {
+        t.Error("Expected error")
+    }
+}
+
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrAuthFailed is returned when the server rejects the credentials
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrMailboxLocked is returned when the maildrop is in use by another session, [IN-USE]
+	ErrMailboxLocked = errors.New("mailbox locked")
+	// ErrLoginDelay is returned when logging in again too soon, [LOGIN-DELAY]
+	ErrLoginDelay = errors.New("login delay not elapsed")
+	// ErrTemporary is returned for a temporary server failure, [SYS/TEMP]
+	ErrTemporary = errors.New("temporary server failure")
+	// ErrPermanent is returned for a permanent server failure, [SYS/PERM]
+	ErrPermanent = errors.New("permanent server failure")
+	// ErrNoSuchMessage is returned when the message doesn't exist or has been deleted
+	ErrNoSuchMessage = errors.New("no such message")
+	// ErrNotConnected is returned when a command is issued before connecting
+	ErrNotConnected = errors.New("not connected")
+)
+
+// ProtocolError is returned when the server replies -ERR. It wraps one of the sentinel
+// errors, e.g. errors.Is(err, ErrMailboxLocked), chosen from the response code if there
+// is one (RFC 2449, RFC 3206) and otherwise from the command
+type ProtocolError struct {
+	// Command holds the command rejected, e.g. RETR, empty for the greeting
+	Command string
+	// Line holds the status line returned by the server
+	Line string
+	// Code holds the response code without brackets, e.g. SYS/TEMP, empty if there isn't one
+	Code string
+	// Text holds the human readable part of the status line
+	Text string
+	// Err holds the sentinel error the response was classified as, nil if unknown
+	Err error
+}
+
+// Error returns the status line returned by the server
+func (e *ProtocolError) Error() string {
+	return e.Line
+}
+
+// Unwrap returns the sentinel error the response was classified as
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary checks whether the command may succeed if retried later
+func (e *ProtocolError) Temporary() bool {
+	return e.Err == ErrMailboxLocked || e.Err == ErrLoginDelay || e.Err == ErrTemporary
+}
+
+// HasCode checks whether the response code is code or one of its children, e.g. SYS
+// matches SYS/TEMP
+func (e *ProtocolError) HasCode(code string) bool {
+	return strings.EqualFold(e.Code, code) || (len(e.Code) > len(code) && e.Code[len(code)] == '/' && strings.EqualFold(e.Code[:len(code)], code))
+}
+
+// newProtocolError parses the -ERR status line returned for command. Responses without
+// a known response code are classified as fallback, which may be nil
+func newProtocolError(command string, line string, fallback error) *ProtocolError {
+	line = strings.TrimRight(line, "\r\n")
+	text := strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))
+
+	code := ""
+	if strings.HasPrefix(text, "[") {
+		end := strings.Index(text, "]")
+		if end > 0 {
+			code = strings.ToUpper(text[1:end])
+			text = strings.TrimSpace(text[end+1:])
+		}
+	}
+
+	protoErr := &ProtocolError{Command: command, Line: line, Code: code, Text: text, Err: fallback}
+	switch {
+	case protoErr.HasCode("IN-USE"):
+		protoErr.Err = ErrMailboxLocked
+	case protoErr.HasCode("LOGIN-DELAY"):
+		protoErr.Err = ErrLoginDelay
+	case protoErr.HasCode("SYS/TEMP"):
+		protoErr.Err = ErrTemporary
+	case protoErr.HasCode("SYS/PERM"):
+		protoErr.Err = ErrPermanent
+	case protoErr.HasCode("AUTH"):
+		protoErr.Err = ErrAuthFailed
+	}
+
+	return protoErr
+}
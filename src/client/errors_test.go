@@ -0,0 +1,116 @@
+package client
+
+import (
+    "errors"
+    "testing"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+)
+
+// Test_ProtocolErrorCodes checks response codes are parsed and classified
+func Test_ProtocolErrorCodes(t *testing.T) {
+    tests := []struct {
+        line      string
+        fallback  error
+        code      string
+        text      string
+        expected  error
+        temporary bool
+    }{
+        { "-ERR [IN-USE] Do you have another POP session running?", ErrAuthFailed, "IN-USE", "Do you have another POP session running?", ErrMailboxLocked, true },
+        { "-ERR [LOGIN-DELAY] wait a while", ErrAuthFailed, "LOGIN-DELAY", "wait a while", ErrLoginDelay, true },
+        { "-ERR [SYS/TEMP] disk full", nil, "SYS/TEMP", "disk full", ErrTemporary, true },
+        { "-ERR [sys/perm] account disabled\r\n", ErrAuthFailed, "SYS/PERM", "account disabled", ErrPermanent, false },
+        { "-ERR [AUTH] invalid password", nil, "AUTH", "invalid password", ErrAuthFailed, false },
+        { "-ERR [AUTH/EXTRA] invalid password", nil, "AUTH/EXTRA", "invalid password", ErrAuthFailed, false },
+        { "-ERR [UNKNOWN] something", ErrNoSuchMessage, "UNKNOWN", "something", ErrNoSuchMessage, false },
+        { "-ERR no such message", ErrNoSuchMessage, "", "no such message", ErrNoSuchMessage, false },
+        { "-ERR [unterminated", nil, "", "[unterminated", nil, false },
+        { "-ERR", nil, "", "", nil, false },
+    }
+
+    for _, test := range tests {
+        protoErr := newProtocolError("PASS", test.line, test.fallback)
+        if protoErr.Code != test.code || protoErr.Text != test.text {
+            t.Errorf("Incorrect code %q or text %q parsed from %q", protoErr.Code, protoErr.Text, test.line)
+        }
+        if protoErr.Err != test.expected || (test.expected != nil && !errors.Is(protoErr, test.expected)) {
+            t.Errorf("Expected %v for %q, got %v", test.expected, test.line, protoErr.Err)
+        }
+        if protoErr.Temporary() != test.temporary {
+            t.Errorf("Incorrect temporary %v for %q", protoErr.Temporary(), test.line)
+        }
+        if protoErr.Command != "PASS" {
+            t.Errorf("Incorrect command %v", protoErr.Command)
+        }
+    }
+}
+
+// Test_ProtocolErrorMessage checks the error message is the status line
+func Test_ProtocolErrorMessage(t *testing.T) {
+    protoErr := newProtocolError("DELE", "-ERR message 4 already deleted\r\n", ErrNoSuchMessage)
+    if protoErr.Error() != "-ERR message 4 already deleted" {
+        t.Errorf("Incorrect message %v", protoErr.Error())
+    }
+
+    protoErr = newProtocolError("DELE", "-ERR [SYS/TEMP] later", nil)
+    if !protoErr.HasCode("SYS") || protoErr.HasCode("SY") || protoErr.HasCode("SYS/PERM") {
+        t.Error("Incorrect hierarchical code matching")
+    }
+}
+
+// Test_AuthErrorsClassified checks failed logins can be told apart
+func Test_AuthErrorsClassified(t *testing.T) {
+    testConn, toTest, _ := initialiseConnection()
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n", "-ERR invalid password\r\n")
+    err := toTest.Auth()
+
+    var protoErr *ProtocolError
+    if !errors.As(err, &protoErr) || protoErr.Command != "PASS" || !errors.Is(err, ErrAuthFailed) {
+        t.Errorf("Expected a failed PASS, got %#v", err)
+    }
+
+    testConn, toTest, _ = initialiseConnection()
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n", "-ERR [IN-USE] maildrop locked\r\n")
+    err = toTest.Auth()
+    if !errors.Is(err, ErrMailboxLocked) || errors.Is(err, ErrAuthFailed) {
+        t.Errorf("Expected ErrMailboxLocked, got %v", err)
+    }
+}
+
+// Test_MessageErrorsClassified checks commands on a missing message return ErrNoSuchMessage
+func Test_MessageErrorsClassified(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+    testConn.ToRead = append(testConn.ToRead, "-ERR no such message\r\n", "-ERR no such message\r\n", "-ERR message 1 already deleted\r\n", "-ERR no such message\r\n")
+
+    _, err := toTest.Retrieve(1)
+    if !errors.Is(err, ErrNoSuchMessage) {
+        t.Errorf("Expected ErrNoSuchMessage for RETR, got %v", err)
+    }
+    _, err = toTest.ListMessage(1)
+    if !errors.Is(err, ErrNoSuchMessage) {
+        t.Errorf("Expected ErrNoSuchMessage for LIST, got %v", err)
+    }
+    err = toTest.Delete(1)
+    if !errors.Is(err, ErrNoSuchMessage) {
+        t.Errorf("Expected ErrNoSuchMessage for DELE, got %v", err)
+    }
+    _, err = toTest.Top(1, 0)
+    var protoErr *ProtocolError
+    if !errors.As(err, &protoErr) || protoErr.Command != "TOP" || !errors.Is(err, ErrNoSuchMessage) {
+        t.Errorf("Expected ErrNoSuchMessage for TOP, got %v", err)
+    }
+}
+
+// Test_NotConnected checks commands issued before connecting return ErrNotConnected
+func Test_NotConnected(t *testing.T) {
+    toTest := NewClient(*config.NewConfig())
+
+    _, _, err := toTest.Stat()
+    if !errors.Is(err, ErrNotConnected) {
+        t.Errorf("Expected ErrNotConnected, got %v", err)
+    }
+    _, err = toTest.RetrieveReader(1)
+    if !errors.Is(err, ErrNotConnected) {
+        t.Errorf("Expected ErrNotConnected, got %v", err)
+    }
+}
@@ -0,0 +1,407 @@
+package client
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// connFault is a failure injected into the response to a command
+type connFault struct {
+    // Response replaces the scripted response when set, e.g. "-ERR [SYS/TEMP] busy\r\n"
+    Response string
+    // Disconnect hangs up once After bytes of the response have been sent
+    Disconnect bool
+    // After holds the number of bytes of the response sent before disconnecting
+    After int
+    // Stall never sends a response, leaving the client waiting for its deadline
+    Stall bool
+    // Delay holds back the response, along with anything before it not yet read
+    Delay time.Duration
+    // WriteError is returned writing the command, no response is sent
+    WriteError error
+}
+
+// faultConn stands in for a server on an adverse network. Responses are scripted for
+// each command and only become readable once the command has been written, they're read
+// in chunks of the sizes given so line and response boundaries can fall anywhere. Reads
+// block until there's data, the connection is closed or the deadline passes, so nothing
+// depends on timing other than the latencies set
+type faultConn struct {
+    // Responses holds the response to each command, looked up by the whole command line
+    // e.g. "RETR 1" and then by the command name e.g. "RETR"
+    Responses map[string]string
+    // Faults holds the failures to inject for each command name, used in order
+    Faults map[string][]connFault
+    // Chunks holds the most returned by each read in turn, the last size is repeated.
+    // Nil fills the buffer, []int{1} returns a byte at a time
+    Chunks []int
+    // Latency is the least time each read takes to return data
+    Latency time.Duration
+    // WriteLimit limits the bytes accepted by each write when above zero
+    WriteLimit int
+
+    lock sync.Mutex
+    // wake is closed and replaced when there's something new for a blocked read to check
+    wake chan struct{}
+    // pending holds the data sent by the server not yet read
+    pending []byte
+    // readyAt holds when the pending data can be read
+    readyAt time.Time
+    // hungUp is set once the server has disconnected, reads return io.EOF after the pending data
+    hungUp bool
+    closed bool
+    reads int
+    // partial holds the start of a command written without its line ending
+    partial []byte
+    sent bytes.Buffer
+    commands []string
+    readDeadline time.Time
+    writeDeadline time.Time
+}
+
+// newFaultConn returns a connection which sends greeting before any command
+func newFaultConn(greeting string) *faultConn {
+    return &faultConn {
+        Responses: make(map[string]string),
+        Faults: make(map[string][]connFault),
+        wake: make(chan struct{}),
+        pending: []byte(greeting),
+    }
+}
+
+// Inject adds faults for the next uses of command
+func (c *faultConn) Inject(command string, faults ...connFault) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    c.Faults[command] = append(c.Faults[command], faults...)
+}
+
+// HangUp disconnects the server side, the client can read what's already been sent
+func (c *faultConn) HangUp() {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    c.hungUp = true
+    c.wakeLocked()
+}
+
+// Sent returns everything written by the client
+func (c *faultConn) Sent() string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    return c.sent.String()
+}
+
+// Commands returns the command lines received in order
+func (c *faultConn) Commands() []string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    return append([]string(nil), c.commands...)
+}
+
+// IsClosed returns whether the client has closed the connection
+func (c *faultConn) IsClosed() bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    return c.closed
+}
+
+// Read returns the next chunk of the responses, waiting for them to be ready
+func (c *faultConn) Read(b []byte) (int, error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    var latency time.Time
+    if c.Latency > 0 {
+        latency = time.Now().Add(c.Latency)
+    }
+
+    for {
+        if c.closed {
+            return 0, net.ErrClosed
+        }
+
+        now := time.Now()
+        if !c.readDeadline.IsZero() && !now.Before(c.readDeadline) {
+            return 0, os.ErrDeadlineExceeded
+        }
+
+        ready := c.readyAt
+        if latency.After(ready) {
+            ready = latency
+        }
+        if len(c.pending) > 0 && !now.Before(ready) {
+            break
+        }
+        if len(c.pending) == 0 && c.hungUp {
+            return 0, io.EOF
+        }
+
+        // wait for more data, the data to be ready or the deadline
+        wait := time.Duration(-1)
+        if len(c.pending) > 0 {
+            wait = ready.Sub(now)
+        }
+        if !c.readDeadline.IsZero() && (wait < 0 || c.readDeadline.Sub(now) < wait) {
+            wait = c.readDeadline.Sub(now)
+        }
+        c.waitLocked(wait)
+    }
+
+    size := len(b)
+    if len(c.Chunks) > 0 {
+        chunk := c.Chunks[len(c.Chunks) - 1]
+        if c.reads < len(c.Chunks) {
+            chunk = c.Chunks[c.reads]
+        }
+        if chunk > 0 && chunk < size {
+            size = chunk
+        }
+    }
+    c.reads++
+
+    read := copy(b[:size], c.pending)
+    c.pending = c.pending[read:]
+    return read, nil
+}
+
+// Write records the data and queues the response to each complete command line
+func (c *faultConn) Write(b []byte) (int, error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    if c.closed {
+        return 0, net.ErrClosed
+    }
+    if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+        return 0, os.ErrDeadlineExceeded
+    }
+    if c.hungUp {
+        return 0, io.ErrClosedPipe
+    }
+
+    written := len(b)
+    if c.WriteLimit > 0 && c.WriteLimit < written {
+        written = c.WriteLimit
+    }
+    c.sent.Write(b[:written])
+    c.partial = append(c.partial, b[:written]...)
+
+    for !c.hungUp {
+        end := bytes.IndexByte(c.partial, '\n')
+        if end < 0 {
+            break
+        }
+
+        line := strings.TrimSuffix(string(c.partial[:end]), "\r")
+        c.partial = c.partial[end + 1:]
+
+        err := c.respondLocked(line)
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    return written, nil
+}
+
+// respondLocked queues the response to a command line, applying the next fault for it
+func (c *faultConn) respondLocked(line string) error {
+    c.commands = append(c.commands, line)
+
+    name, _, _ := strings.Cut(line, " ")
+    name = strings.ToUpper(name)
+
+    response, ok := c.Responses[line]
+    if !ok {
+        response, ok = c.Responses[name]
+    }
+    if !ok {
+        response = "-ERR unknown command\r\n"
+    }
+
+    if faults := c.Faults[name]; len(faults) > 0 {
+        fault := faults[0]
+        c.Faults[name] = faults[1:]
+
+        if fault.WriteError != nil {
+            return fault.WriteError
+        }
+        if fault.Stall {
+            return nil
+        }
+        if fault.Response != "" {
+            response = fault.Response
+        }
+        if fault.Delay > 0 {
+            c.readyAt = time.Now().Add(fault.Delay)
+        }
+        if fault.Disconnect {
+            if fault.After < len(response) {
+                response = response[:fault.After]
+            }
+            c.hungUp = true
+        }
+    }
+
+    c.pending = append(c.pending, response...)
+    c.wakeLocked()
+    return nil
+}
+
+// waitLocked releases the lock until woken or wait has passed, a negative wait has no limit
+func (c *faultConn) waitLocked(wait time.Duration) {
+    wake := c.wake
+    c.lock.Unlock()
+    defer c.lock.Lock()
+
+    if wait < 0 {
+        <-wake
+        return
+    }
+
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+
+    select {
+    case <-wake:
+    case <-timer.C:
+    }
+}
+
+// wakeLocked wakes any blocked read
+func (c *faultConn) wakeLocked() {
+    close(c.wake)
+    c.wake = make(chan struct{})
+}
+
+// Close closes the connection, blocked reads return net.ErrClosed
+func (c *faultConn) Close() error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    c.closed = true
+    c.wakeLocked()
+    return nil
+}
+
+// LocalAddr returns the local network address
+func (c *faultConn) LocalAddr() net.Addr {
+    return &net.TCPAddr { IP: net.IPv4(127, 0, 0, 1), Port: 50000 }
+}
+
+// RemoteAddr returns the remote network address
+func (c *faultConn) RemoteAddr() net.Addr {
+    return &net.TCPAddr { IP: net.IPv4(127, 0, 0, 1), Port: 110 }
+}
+
+// SetDeadline sets both the read and write deadlines
+func (c *faultConn) SetDeadline(t time.Time) error {
+    c.SetWriteDeadline(t)
+    return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline, waking a blocked read to check it
+func (c *faultConn) SetReadDeadline(t time.Time) error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    c.readDeadline = t
+    c.wakeLocked()
+    return nil
+}
+
+// SetWriteDeadline sets the write deadline
+func (c *faultConn) SetWriteDeadline(t time.Time) error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    c.writeDeadline = t
+    return nil
+}
+
+// Test_FaultConnChunks checks responses are only sent once asked for and are read in the chunk sizes given
+func Test_FaultConnChunks(t *testing.T) {
+    toTest := newFaultConn("+OK hi\r\n")
+    toTest.Responses["NOOP"] = "+OK\r\n"
+    toTest.Chunks = []int { 2, 1 }
+
+    buff := make([]byte, 16)
+    var reads []string
+    for i := 0; i < 5; i++ {
+        read, err := toTest.Read(buff)
+        if err != nil {
+            t.Fatal(err)
+        }
+        reads = append(reads, string(buff[:read]))
+    }
+    if strings.Join(reads, "|") != "+O|K| |h|i" {
+        t.Errorf("Unexpected chunks %q", reads)
+    }
+
+    toTest.Read(buff)
+    toTest.Read(buff)
+    toTest.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+    _, err := toTest.Read(buff)
+    if !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Errorf("Expected the deadline to be exceeded, got %v", err)
+    }
+
+    toTest.SetReadDeadline(time.Time{})
+    toTest.Write([]byte("NO"))
+    toTest.Write([]byte("OP\r\n"))
+    read, err := toTest.Read(buff)
+    if err != nil || string(buff[:read]) != "+" {
+        t.Errorf("Unexpected read %q, %v", buff[:read], err)
+    }
+    if commands := toTest.Commands(); len(commands) != 1 || commands[0] != "NOOP" {
+        t.Errorf("Unexpected commands %q", commands)
+    }
+}
+
+// Test_FaultConnFaults checks faults are applied to the command they're injected for in order
+func Test_FaultConnFaults(t *testing.T) {
+    toTest := newFaultConn("")
+    toTest.Responses["NOOP"] = "+OK noop\r\n"
+    toTest.WriteLimit = 4
+    toTest.Inject("NOOP", connFault { WriteError: errors.New("reset") })
+    toTest.Inject("NOOP", connFault { Response: "-ERR busy\r\n", Disconnect: true, After: 4 })
+
+    written, err := toTest.Write([]byte("NOOP\r\n"))
+    if written != 4 || err != nil || toTest.Sent() != "NOOP" {
+        t.Errorf("Unexpected partial write %v, %v, %q", written, err, toTest.Sent())
+    }
+    _, err = toTest.Write([]byte("\r\n"))
+    if err == nil || err.Error() != "reset" {
+        t.Errorf("Expected the write error, got %v", err)
+    }
+
+    toTest.Write([]byte("NOOP"))
+    toTest.Write([]byte("\r\n"))
+    data, err := io.ReadAll(toTest)
+    if err != nil || string(data) != "-ERR" {
+        t.Errorf("Expected the response to be cut short, got %q, %v", data, err)
+    }
+
+    _, err = toTest.Write([]byte("NOOP\r\n"))
+    if !errors.Is(err, io.ErrClosedPipe) {
+        t.Errorf("Expected writes to fail after hanging up, got %v", err)
+    }
+
+    toTest.Close()
+    _, err = toTest.Read(make([]byte, 1))
+    if !errors.Is(err, net.ErrClosed) || !toTest.IsClosed() {
+        t.Errorf("Expected the connection to be closed, got %v", err)
+    }
+}
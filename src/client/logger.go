@@ -0,0 +1,122 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/benmj87/gogo-pop3gadget/src/internal/pop3"
+)
+
+// Logger receives log messages from the client. Args are alternating keys and values,
+// e.g. "command", "STAT", matching log/slog so a *slog.Logger can be used directly. It's
+// the same interface as server.Logger so one logger can be shared
+type Logger = pop3.Logger
+
+// Level is the minimum level logged by the logger returned from NewTextLogger
+type Level int
+
+const (
+	// LevelDebug logs every command and response
+	LevelDebug Level = iota
+	// LevelInfo logs connecting and authenticating
+	LevelInfo
+	// LevelWarn logs recoverable problems, e.g. a cancelled command
+	LevelWarn
+	// LevelError logs failures only
+	LevelError
+)
+
+// String returns the level name, e.g. DEBUG
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// textLogger writes one line per message, e.g. DEBUG Sent command="STAT" bytes=6
+type textLogger struct {
+	lock  sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+// NewTextLogger returns a Logger writing messages at level or above to w
+func NewTextLogger(w io.Writer, level Level) Logger {
+	return &textLogger{w: w, level: level}
+}
+
+func (l *textLogger) Debug(msg string, args ...interface{}) { l.log(LevelDebug, msg, args) }
+func (l *textLogger) Info(msg string, args ...interface{})  { l.log(LevelInfo, msg, args) }
+func (l *textLogger) Warn(msg string, args ...interface{})  { l.log(LevelWarn, msg, args) }
+func (l *textLogger) Error(msg string, args ...interface{}) { l.log(LevelError, msg, args) }
+
+// log writes msg followed by the key=value pairs in args
+func (l *textLogger) log(level Level, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var line strings.Builder
+	line.WriteString(level.String() + " " + msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&line, " !BADKEY=%v", args[i])
+			break
+		}
+
+		value := args[i+1]
+		if s, ok := value.(string); ok {
+			value = fmt.Sprintf("%q", s)
+		}
+		fmt.Fprintf(&line, " %v=%v", args[i], value)
+	}
+	line.WriteString("\n")
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	io.WriteString(l.w, line.String())
+}
+
+// Option configures a Client created by NewClient
+type Option func(*Client)
+
+// WithLogger sets the logger, by default nothing is logged
+func WithLogger(logger Logger) Option {
+	return func(c *Client) {
+		if logger == nil {
+			logger = pop3.NopLogger{}
+		}
+		c.logger = logger
+	}
+}
+
+// redact returns the command with any credentials replaced so it can be logged
+func redact(cmd string, inAuth bool) string {
+	cmd = strings.TrimRight(cmd, "\r\n")
+	fields := strings.Fields(cmd)
+
+	switch {
+	case len(fields) > 2 && strings.EqualFold(fields[0], "AUTH"):
+		return fields[0] + " " + fields[1] + " [redacted]"
+	case len(fields) == 2 && strings.EqualFold(fields[0], "AUTH"):
+		return cmd
+	case inAuth:
+		// continuation lines of a SASL exchange
+		return "[redacted]"
+	case len(fields) > 1 && (strings.EqualFold(fields[0], "USER") || strings.EqualFold(fields[0], "PASS") || strings.EqualFold(fields[0], "APOP")):
+		return fields[0] + " [redacted]"
+	}
+
+	return cmd
+}
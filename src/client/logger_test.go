@@ -0,0 +1,173 @@
+package client
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+    "github.com/benmj87/gogo-pop3gadget/src/internal/pop3"
+)
+
+// initialiseLoggedConnection returns a connected client logging everything to the buffer
+func initialiseLoggedConnection() (*TestConnection, *Client, *config.Config, *bytes.Buffer) {
+    testConn, toTest, conf := initialiseConnection()
+
+    logged := &bytes.Buffer{}
+    WithLogger(NewTextLogger(logged, LevelDebug))(toTest)
+
+    return testConn, toTest, conf, logged
+}
+
+// Test_LoggerSilentByDefault checks nothing is logged unless a logger is given
+func Test_LoggerSilentByDefault(t *testing.T) {
+    toTest := NewClient(*config.NewConfig())
+    if _, ok := toTest.logger.(pop3.NopLogger); !ok {
+        t.Errorf("Expected the default logger to discard messages, got %T", toTest.logger)
+    }
+
+    toTest = NewClient(*config.NewConfig(), WithLogger(nil))
+    if _, ok := toTest.logger.(pop3.NopLogger); !ok {
+        t.Errorf("Expected a nil logger to discard messages, got %T", toTest.logger)
+    }
+}
+
+// Test_LoggerRedactsUserPass checks the username and password aren't logged
+func Test_LoggerRedactsUserPass(t *testing.T) {
+    testConn, toTest, conf, logged := initialiseLoggedConnection()
+    conf.Username = "tim"
+    conf.Password = "tanstaaftanstaaf"
+    toTest.config = *conf
+
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n", "+OK\r\n", capaResponse)
+    err := toTest.Auth()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    output := logged.String()
+    if strings.Contains(output, "tim") || strings.Contains(output, "tanstaaf") {
+        t.Errorf("Credentials logged %v", output)
+    }
+    if !strings.Contains(output, `command="USER [redacted]" bytes=10`) || !strings.Contains(output, `command="PASS [redacted]"`) {
+        t.Errorf("Redacted commands not logged %v", output)
+    }
+}
+
+// Test_LoggerRedactsAPOP checks the APOP digest isn't logged
+func Test_LoggerRedactsAPOP(t *testing.T) {
+    testConn, toTest, conf, logged := initialiseLoggedConnection()
+    conf.AuthMethod = config.AuthAPOP
+    conf.Username = "mrose"
+    conf.Password = "tanstaaf"
+    toTest.config = *conf
+    toTest.greeting = "+OK POP3 server ready <1896.697170952@dbc.mtview.ca.us>"
+
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n", capaResponse)
+    err := toTest.Auth()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    output := logged.String()
+    if strings.Contains(output, "mrose") || strings.Contains(output, "c4c9334bac560ecc979e58001b3e22fb") {
+        t.Errorf("Credentials logged %v", output)
+    }
+}
+
+// Test_LoggerRedactsSASL checks the initial response, challenges and responses of AUTH aren't logged
+func Test_LoggerRedactsSASL(t *testing.T) {
+    testConn, toTest, conf, logged := initialiseLoggedConnection()
+    conf.AuthMethod = config.AuthSASL
+    conf.Username = "tim"
+    conf.Password = "tanstaaftanstaaf"
+    toTest.config = *conf
+    toTest.capabilities.SASL = []string { "CRAM-MD5" }
+
+    testConn.ToRead = append(testConn.ToRead, "+ PDE4OTYuNjk3MTcwOTUyQHBvc3RvZmZpY2UucmVzdG9uLm1jaS5uZXQ+\r\n")
+    testConn.ToRead = append(testConn.ToRead, "+OK CRAM authentication successful\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
+    err := toTest.Auth()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    output := logged.String()
+    if strings.Contains(output, "PDE4OTYu") || strings.Contains(output, "dGltIGI5") {
+        t.Errorf("SASL exchange logged %v", output)
+    }
+    if !strings.Contains(output, `command="AUTH CRAM-MD5"`) {
+        t.Errorf("AUTH command not logged %v", output)
+    }
+
+    toTest.state = StateAuthorization
+    toTest.capabilities.SASL = []string { "PLAIN" }
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n", capaResponse)
+    err = toTest.Auth()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if strings.Contains(logged.String(), "AHRpbQB0") || !strings.Contains(logged.String(), `command="AUTH PLAIN [redacted]"`) {
+        t.Errorf("Initial response logged %v", logged.String())
+    }
+}
+
+// Test_LoggerCommandFields checks commands are logged with their duration and errors
+func Test_LoggerCommandFields(t *testing.T) {
+    testConn, toTest, _, logged := initialiseLoggedConnection()
+    toTest.state = StateTransaction
+
+    testConn.ToRead = append(testConn.ToRead, "+OK 2 320\r\n", "-ERR no such message\r\n")
+    _, _, err := toTest.Stat()
+    if err != nil {
+        t.Fatal(err)
+    }
+    toTest.Delete(3)
+
+    output := logged.String()
+    if !strings.Contains(output, `DEBUG Command completed command="STAT" duration=`) {
+        t.Errorf("STAT not logged %v", output)
+    }
+    if !strings.Contains(output, `ERROR Command failed command="DELE" duration=`) || !strings.Contains(output, "no such message") {
+        t.Errorf("DELE failure not logged %v", output)
+    }
+}
+
+// Test_LoggerRetrieveReader checks a streamed RETR is logged once its body has been closed
+func Test_LoggerRetrieveReader(t *testing.T) {
+    testConn, toTest, _, logged := initialiseLoggedConnection()
+    toTest.state = StateTransaction
+
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n", "one\r\n.\r\n")
+    body, err := toTest.RetrieveReader(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(logged.String(), `command="RETR"`) {
+        t.Errorf("RETR logged before the body was read %v", logged.String())
+    }
+
+    err = body.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(logged.String(), `DEBUG Command completed command="RETR" duration=`) {
+        t.Errorf("RETR not logged %v", logged.String())
+    }
+}
+
+// Test_TextLoggerLevel checks messages below the level are dropped
+func Test_TextLoggerLevel(t *testing.T) {
+    logged := &bytes.Buffer{}
+    logger := NewTextLogger(logged, LevelWarn)
+
+    logger.Debug("debug")
+    logger.Info("info")
+    logger.Warn("warn", "server", "pop.example.com:995", "bytes", 12)
+    logger.Error("error", "odd")
+
+    expected := "WARN warn server=\"pop.example.com:995\" bytes=12\nERROR error !BADKEY=odd\n"
+    if logged.String() != expected {
+        t.Errorf("Expected %q, got %q", expected, logged.String())
+    }
+}
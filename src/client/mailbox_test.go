@@ -0,0 +1,406 @@
+package client
+
+import (
+    "crypto/tls"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+    "testing"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+    "github.com/benmj87/gogo-pop3gadget/src/pop3test"
+)
+
+// newTestMailbox returns a pop3test server with a mailbox for user holding count messages
+// and a client for it connected over a pipe
+func newTestMailbox(t *testing.T, count int) (*pop3test.Server, *Client) {
+    var bodies []string
+    for i := 1; i <= count; i++ {
+        bodies = append(bodies, fmt.Sprintf("Subject: %d\r\n\r\nline 1\r\n.line 2\r\n", i))
+    }
+
+    server := pop3test.NewServer()
+    server.AddMailbox("user", "secret", bodies...)
+    t.Cleanup(func() { server.Close() })
+
+    toTest := NewClient(*server.Config("user"))
+    toTest.Dialer = server.Dial
+
+    return server, toTest
+}
+
+// connectMailbox connects and logs in to the mailbox
+func connectMailbox(t *testing.T, toTest *Client) {
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = toTest.Auth()
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Test_MailboxSession checks a session downloading and deleting a message against a stateful server
+func Test_MailboxSession(t *testing.T) {
+    server, toTest := newTestMailbox(t, 3)
+    connectMailbox(t, toTest)
+
+    count, size, err := toTest.Stat()
+    if err != nil || count != 3 || size != 3 * 31 {
+        t.Errorf("Unexpected STAT %v %v, %v", count, size, err)
+    }
+
+    emails, err := toTest.UIDL()
+    if err != nil || len(emails) != 3 || emails[2].UID != "uid-3" {
+        t.Fatalf("Unexpected UIDL %v, %v", emails, err)
+    }
+
+    email, err := toTest.Retrieve(2)
+    if err != nil || !strings.Contains(email.Message, "\r\n.line 2") {
+        t.Errorf("Unexpected message %v, %v", email, err)
+    }
+
+    top, err := toTest.Top(1, 1)
+    if err != nil || strings.Contains(top.Message, "line 2") {
+        t.Errorf("Unexpected TOP %v, %v", top, err)
+    }
+
+    err = toTest.Delete(2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = toTest.Retrieve(2)
+    if !errors.Is(err, ErrNoSuchMessage) {
+        t.Errorf("Expected no such message, got %v", err)
+    }
+
+    err = toTest.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    messages := server.Mailbox("user").Messages()
+    if len(messages) != 2 || messages[0].UID != "uid-1" || messages[1].UID != "uid-3" {
+        t.Errorf("Delete not committed %v", messages)
+    }
+}
+
+// Test_MailboxReset checks deletes are undone by RSET
+func Test_MailboxReset(t *testing.T) {
+    server, toTest := newTestMailbox(t, 3)
+    connectMailbox(t, toTest)
+
+    err := toTest.DeleteMany([]int { 1, 2, 3 })
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = toTest.Reset()
+    if err != nil {
+        t.Fatal(err)
+    }
+    toTest.Close()
+
+    if messages := server.Mailbox("user").Messages(); len(messages) != 3 {
+        t.Errorf("Messages removed after RSET %v", messages)
+    }
+}
+
+// Test_MailboxPipelined checks pipelined commands are answered in order by a real session
+func Test_MailboxPipelined(t *testing.T) {
+    server, toTest := newTestMailbox(t, 5)
+    connectMailbox(t, toTest)
+
+    var retrieved []int
+    err := toTest.RetrieveMany([]int { 5, 3, 1 }, func(ID int, body io.Reader) error {
+        content, err := io.ReadAll(body)
+        if err == nil && !strings.HasPrefix(string(content), fmt.Sprintf("Subject: %d\r\n", ID)) {
+            err = fmt.Errorf("Message %d corrupted", ID)
+        }
+        retrieved = append(retrieved, ID)
+        return err
+    })
+    if err != nil || len(retrieved) != 3 {
+        t.Fatalf("Retrieved %v, %v", retrieved, err)
+    }
+
+    err = toTest.DeleteMany([]int { 1, 9, 2 })
+    if !errors.Is(err, ErrNoSuchMessage) {
+        t.Errorf("Expected no such message, got %v", err)
+    }
+
+    // the server advertises PIPELINING so the batch is sent before the failure is seen
+    commands := server.Commands()
+    if last := strings.Join(commands[len(commands) - 3:], ","); last != "DELE 1,DELE 9,DELE 2" {
+        t.Errorf("Unexpected commands %v", last)
+    }
+
+    // the DELE in flight after the failure still counts once the session ends
+    err = toTest.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    messages := server.Mailbox("user").Messages()
+    if len(messages) != 3 || messages[0].UID != "uid-3" {
+        t.Errorf("Expected messages 1 and 2 to be removed, got %v", messages)
+    }
+}
+
+// Test_MailboxPipelineRefill checks batches larger than the pipeline window are sent over an unbuffered pipe
+// without deadlocking, the window being refilled while responses are unread
+func Test_MailboxPipelineRefill(t *testing.T) {
+    _, toTest := newTestMailbox(t, 40)
+    connectMailbox(t, toTest)
+
+    var retrieved []int
+    err := toTest.RetrieveMany(manyIDs(40), func(ID int, body io.Reader) error {
+        retrieved = append(retrieved, ID)
+        _, err := io.Copy(io.Discard, body)
+        return err
+    })
+    if err != nil || len(retrieved) != 40 || retrieved[39] != 40 {
+        t.Errorf("Retrieved %v, %v", retrieved, err)
+    }
+}
+
+// manyIDs returns the message numbers 1 to count
+func manyIDs(count int) []int {
+    ids := make([]int, count)
+    for i := range ids {
+        ids[i] = i + 1
+    }
+
+    return ids
+}
+
+// Test_MailboxRetrieveManyWindow checks RetrieveMany refills a small window many times
+func Test_MailboxRetrieveManyWindow(t *testing.T) {
+    server, toTest := newTestMailbox(t, 10)
+    toTest.config.PipelineWindow = 4
+    connectMailbox(t, toTest)
+
+    var retrieved []int
+    err := toTest.RetrieveMany(manyIDs(10), func(ID int, body io.Reader) error {
+        content, err := io.ReadAll(body)
+        if !strings.HasPrefix(string(content), fmt.Sprintf("Subject: %d\r\n", ID)) {
+            t.Errorf("Incorrect body %q for %v", content, ID)
+        }
+        retrieved = append(retrieved, ID)
+        return err
+    })
+    if err != nil || len(retrieved) != 10 || retrieved[9] != 10 {
+        t.Errorf("Retrieved %v, %v", retrieved, err)
+    }
+
+    retrs := 0
+    for _, command := range server.Commands() {
+        if strings.HasPrefix(command, "RETR ") {
+            retrs++
+        }
+    }
+    if retrs != 10 {
+        t.Errorf("Expected 10 RETR commands, got %v", server.Commands())
+    }
+}
+
+// Test_MailboxDeleteManyWindow checks DeleteMany deletes more messages than the window
+func Test_MailboxDeleteManyWindow(t *testing.T) {
+    server, toTest := newTestMailbox(t, 12)
+    toTest.config.PipelineWindow = 4
+    connectMailbox(t, toTest)
+
+    err := toTest.DeleteMany(manyIDs(10))
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = toTest.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    messages := server.Mailbox("user").Messages()
+    if len(messages) != 2 || messages[0].UID != "uid-11" || messages[1].UID != "uid-12" {
+        t.Errorf("Incorrect messages left %v", messages)
+    }
+}
+
+// Test_MailboxUIDLManyWindow checks UIDLMany fetches more unique-ids than the window
+func Test_MailboxUIDLManyWindow(t *testing.T) {
+    _, toTest := newTestMailbox(t, 10)
+    toTest.config.PipelineWindow = 4
+    connectMailbox(t, toTest)
+
+    emails, err := toTest.UIDLMany(manyIDs(10))
+    if err != nil || len(emails) != 10 {
+        t.Fatalf("Unexpected unique-ids %v, %v", emails, err)
+    }
+    for i, email := range emails {
+        if email.ID != i + 1 || email.UID != fmt.Sprintf("uid-%d", i + 1) {
+            t.Errorf("Incorrect unique-id %v", email)
+        }
+    }
+}
+
+// Test_MailboxAbort checks aborting the session closes it without removing the deleted messages
+func Test_MailboxAbort(t *testing.T) {
+    server, toTest := newTestMailbox(t, 2)
+    connectMailbox(t, toTest)
+
+    err := toTest.Delete(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = toTest.Abort()
+    if err != nil || toTest.State() != StateClosed {
+        t.Errorf("Expected the session to be closed, got %v in %v", err, toTest.State())
+    }
+
+    server.Drop()
+    if len(server.Mailbox("user").Messages()) != 2 {
+        t.Errorf("Expected the deleted message to be kept, got %v", server.Mailbox("user").Messages())
+    }
+    for _, command := range server.Commands() {
+        if command == "QUIT" {
+            t.Error("Expected the session to end without QUIT")
+        }
+    }
+}
+
+// Test_MailboxLoginMethods checks APOP and SASL PLAIN log in to the mailbox
+func Test_MailboxLoginMethods(t *testing.T) {
+    for _, method := range []config.AuthMethod { config.AuthAPOP, config.AuthSASL } {
+        server, toTest := newTestMailbox(t, 1)
+        toTest.config.AuthMethod = method
+        connectMailbox(t, toTest)
+
+        err := toTest.Close()
+        if err != nil {
+            t.Error(err)
+        }
+        if server.Mailbox("user").Locked() {
+            t.Errorf("Mailbox still locked after QUIT with method %v", method)
+        }
+    }
+}
+
+// Test_MailboxLocked checks a mailbox in use elsewhere is reported as locked
+func Test_MailboxLocked(t *testing.T) {
+    server, toTest := newTestMailbox(t, 1)
+    server.Mailbox("user").SetLocked(true)
+
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = toTest.Auth()
+    var protoErr *ProtocolError
+    if !errors.Is(err, ErrMailboxLocked) || !errors.As(err, &protoErr) || !protoErr.Temporary() {
+        t.Errorf("Expected a temporary locked error, got %v", err)
+    }
+}
+
+// Test_MailboxFaults checks injected server failures are reported
+func Test_MailboxFaults(t *testing.T) {
+    server, toTest := newTestMailbox(t, 2)
+    server.Inject(pop3test.Fault { Command: "RETR", Count: 1, Response: "-ERR [SYS/TEMP] busy" })
+    server.Inject(pop3test.Fault { Command: "STAT", Close: true })
+    connectMailbox(t, toTest)
+
+    _, err := toTest.Retrieve(1)
+    if !errors.Is(err, ErrTemporary) {
+        t.Errorf("Expected a temporary error, got %v", err)
+    }
+    _, err = toTest.Retrieve(1)
+    if err != nil {
+        t.Errorf("Fault applied more than once %v", err)
+    }
+
+    _, _, err = toTest.Stat()
+    if err == nil {
+        t.Error("Expected an error when the connection closes")
+    }
+}
+
+// Test_MailboxInvalidCapabilities checks malformed optional capabilities are skipped rather than failing the session
+func Test_MailboxInvalidCapabilities(t *testing.T) {
+    server, toTest := newTestMailbox(t, 1)
+    server.Capabilities = append(server.Capabilities, "EXPIRE soon", "LOGIN-DELAY")
+    connectMailbox(t, toTest)
+
+    caps, err := toTest.Capabilities()
+    if err != nil || !caps.Top || !caps.Pipelining || caps.HasExpire || caps.HasLoginDelay {
+        t.Errorf("Unexpected capabilities %+v, %v", caps, err)
+    }
+    if len(caps.Raw) != len(server.Capabilities) {
+        t.Errorf("Expected every line in Raw, got %v", caps.Raw)
+    }
+}
+
+// Test_MailboxCapabilitiesFailAfterLogin checks a truncated CAPA response once logged in closes the connection
+func Test_MailboxCapabilitiesFailAfterLogin(t *testing.T) {
+    server, toTest := newTestMailbox(t, 1)
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    server.Inject(pop3test.Fault { Command: "CAPA", Count: 1, Response: "+OK\r\nTOP\r\nLOGIN-DELAY", Close: true })
+    err = toTest.Auth()
+    if err == nil || toTest.State() != StateClosed {
+        t.Errorf("Expected the connection to be closed, got %v in %v", err, toTest.State())
+    }
+    if errors.Is(err, ErrAuthFailed) {
+        t.Errorf("Expected the error not to be reported as a failed login, got %v", err)
+    }
+
+    _, _, err = toTest.Stat()
+    if err == nil {
+        t.Error("Expected the closed connection to be reported by the next command")
+    }
+}
+
+// Test_MailboxCapabilitiesRejectedAfterLogin checks CAPA rejected once logged in leaves the session usable
+func Test_MailboxCapabilitiesRejectedAfterLogin(t *testing.T) {
+    server, toTest := newTestMailbox(t, 1)
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    server.Inject(pop3test.Fault { Command: "CAPA", Count: 1, Response: "-ERR not now" })
+    err = toTest.Auth()
+    if err != nil || toTest.State() != StateTransaction {
+        t.Fatalf("Expected the login to succeed, got %v in %v", err, toTest.State())
+    }
+
+    count, _, err := toTest.Stat()
+    if err != nil || count != 1 {
+        t.Errorf("Unexpected STAT %v, %v", count, err)
+    }
+}
+
+// Test_MailboxSTLS checks the connection is upgraded by a server supporting STLS
+func Test_MailboxSTLS(t *testing.T) {
+    server, toTest := newTestMailbox(t, 1)
+    cert, _ := newTestCertificate(t)
+    server.TLSConfig = &tls.Config { Certificates: []tls.Certificate { cert } }
+
+    toTest.config.TLSMode = config.TLSStartRequired
+    toTest.config.TLSServerName = "localhost"
+    toTest.config.TLSCAPEM = pem.EncodeToMemory(&pem.Block { Type: "CERTIFICATE", Bytes: cert.Certificate[0] })
+    connectMailbox(t, toTest)
+
+    if _, ok := toTest.connectionState(); !ok {
+        t.Error("Connection not upgraded")
+    }
+    if commands := server.Commands(); commands[1] != "STLS" {
+        t.Errorf("Unexpected commands %v", commands)
+    }
+
+    err := toTest.Close()
+    if err != nil {
+        t.Error(err)
+    }
+}
@@ -0,0 +1,385 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "time"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+)
+
+// faultBody1 and faultBody2 are the messages in the mailbox scripted by newFaultMailbox
+const (
+    faultBody1 = "Subject: one\r\n\r\n.dot stuffed\r\n\r\nline four"
+    faultBody2 = "Subject: two\r\n\r\nsecond"
+)
+
+// newFaultMailbox returns a connection scripted as a mailbox holding two messages
+func newFaultMailbox() *faultConn {
+    conn := newFaultConn("+OK ready <1.2@localhost>\r\n")
+    conn.Responses["CAPA"] = "+OK\r\nTOP\r\nUIDL\r\nUSER\r\nPIPELINING\r\n.\r\n"
+    conn.Responses["USER"] = "+OK\r\n"
+    conn.Responses["PASS"] = "+OK logged in\r\n"
+    conn.Responses["STAT"] = "+OK 2 66\r\n"
+    conn.Responses["LIST"] = "+OK 2 messages\r\n1 44\r\n2 22\r\n.\r\n"
+    conn.Responses["UIDL"] = "+OK\r\n1 uid-1\r\n2 uid-2\r\n.\r\n"
+    conn.Responses["RETR 1"] = "+OK 44 octets\r\nSubject: one\r\n\r\n..dot stuffed\r\n\r\nline four\r\n.\r\n"
+    conn.Responses["RETR 2"] = "+OK 22 octets\r\nSubject: two\r\n\r\nsecond\r\n.\r\n"
+    conn.Responses["TOP 1 0"] = "+OK\r\nSubject: one\r\n\r\n.\r\n"
+    conn.Responses["DELE"] = "+OK deleted\r\n"
+    conn.Responses["NOOP"] = "+OK\r\n"
+    conn.Responses["RSET"] = "+OK\r\n"
+    conn.Responses["QUIT"] = "+OK bye\r\n"
+
+    return conn
+}
+
+// newFaultClient returns a client dialling each of conns in turn
+func newFaultClient(t *testing.T, conf config.Config, conns ...*faultConn) *Client {
+    conf.UseTLS = false
+    conf.Username = "user"
+    conf.Password = "secret"
+
+    dialled := 0
+    toTest := NewClient(conf)
+    toTest.Dialer = func(network string, addr string) (net.Conn, error) {
+        if dialled == len(conns) {
+            t.Fatal("Dialled too many times")
+        }
+        dialled++
+        return conns[dialled - 1], nil
+    }
+
+    return toTest
+}
+
+// connectFault connects and logs in, failing the test on an error
+func connectFault(t *testing.T, toTest *Client) {
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = toTest.Auth()
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Test_FaultChunkBoundaries checks a session works however the responses are split up, including a byte at a time
+func Test_FaultChunkBoundaries(t *testing.T) {
+    for _, chunks := range [][]int { nil, { 1 }, { 2 }, { 3 }, { 5, 1 }, { 7 }, { 13 }, { 1, 64, 1, 2 } } {
+        t.Run(fmt.Sprint(chunks), func(t *testing.T) {
+            conn := newFaultMailbox()
+            conn.Chunks = chunks
+            toTest := newFaultClient(t, *config.NewConfig(), conn)
+            connectFault(t, toTest)
+
+            if toTest.Greeting() != "+OK ready <1.2@localhost>" {
+                t.Errorf("Unexpected greeting %q", toTest.Greeting())
+            }
+
+            count, size, err := toTest.Stat()
+            if err != nil || count != 2 || size != 66 {
+                t.Errorf("Unexpected STAT %v %v, %v", count, size, err)
+            }
+
+            emails, err := toTest.List()
+            if err != nil || len(emails) != 2 || emails[1].Size != 22 {
+                t.Errorf("Unexpected LIST %v, %v", emails, err)
+            }
+
+            emails, err = toTest.UIDL()
+            if err != nil || len(emails) != 2 || emails[0].UID != "uid-1" {
+                t.Errorf("Unexpected UIDL %v, %v", emails, err)
+            }
+
+            email, err := toTest.Retrieve(1)
+            if err != nil || email.Message != faultBody1 {
+                t.Errorf("Unexpected message %q, %v", email, err)
+            }
+
+            top, err := toTest.Top(1, 0)
+            if err != nil || top.Message != "Subject: one\r\n" {
+                t.Errorf("Unexpected TOP %q, %v", top, err)
+            }
+
+            err = toTest.Close()
+            if err != nil {
+                t.Error(err)
+            }
+
+            commands := strings.Join(conn.Commands(), ",")
+            if commands != "CAPA,USER user,PASS secret,CAPA,STAT,LIST,UIDL,RETR 1,TOP 1 0,QUIT" {
+                t.Errorf("Unexpected commands %v", commands)
+            }
+        })
+    }
+}
+
+// Test_FaultReaderSplitPoints checks a multi-line response split at every position is read
+// correctly, leaving the next response in sync
+func Test_FaultReaderSplitPoints(t *testing.T) {
+    response := newFaultMailbox().Responses["RETR 1"]
+    for split := 1; split <= len(response); split++ {
+        conn := newFaultMailbox()
+        conn.pending = nil
+        conn.Chunks = []int { split, 1024 }
+        conn.Write([]byte("RETR 1\r\nNOOP\r\n"))
+
+        reader := newResponseReader(conn)
+        status, err := reader.ReadLine()
+        if err != nil || status != "+OK 44 octets" {
+            t.Errorf("Split at %v: unexpected status %q, %v", split, status, err)
+            continue
+        }
+
+        body, err := io.ReadAll(reader.DotReader())
+        if err != nil || string(body) != faultBody1 + "\r\n" {
+            t.Errorf("Split at %v: unexpected body %q, %v", split, body, err)
+        }
+
+        status, err = reader.ReadLine()
+        if err != nil || status != "+OK" {
+            t.Errorf("Split at %v: the next response was %q, %v", split, status, err)
+        }
+    }
+}
+
+// Test_FaultDisconnectMidResponse checks the connection dropping anywhere in a response is
+// an error rather than a truncated message
+func Test_FaultDisconnectMidResponse(t *testing.T) {
+    response := newFaultMailbox().Responses["RETR 1"]
+    for _, after := range []int { 0, 5, 15, 30, len(response) - 5, len(response) - 1 } {
+        for _, chunks := range [][]int { nil, { 1 } } {
+            conn := newFaultMailbox()
+            conn.Chunks = chunks
+            toTest := newFaultClient(t, *config.NewConfig(), conn)
+            connectFault(t, toTest)
+
+            conn.Inject("RETR", connFault { Disconnect: true, After: after })
+            email, err := toTest.Retrieve(1)
+            if email != nil || !(errors.Is(err, io.ErrUnexpectedEOF) || (after == 0 && errors.Is(err, io.EOF))) {
+                t.Errorf("Cut after %v in chunks %v: expected an unexpected EOF, got %q, %v", after, chunks, email, err)
+            }
+
+            err = toTest.Noop()
+            if !errors.Is(err, io.ErrClosedPipe) {
+                t.Errorf("Cut after %v in chunks %v: expected the connection to be unusable, got %v", after, chunks, err)
+            }
+        }
+    }
+}
+
+// Test_FaultDisconnectMidPipeline checks a disconnect part way through a pipelined batch
+// stops after the messages handed over in full
+func Test_FaultDisconnectMidPipeline(t *testing.T) {
+    conn := newFaultMailbox()
+    conn.Chunks = []int { 1 }
+    toTest := newFaultClient(t, *config.NewConfig(), conn)
+    connectFault(t, toTest)
+
+    conn.Inject("RETR", connFault {}, connFault { Disconnect: true, After: 20 })
+
+    var handled []int
+    err := toTest.RetrieveMany([]int { 1, 2, 1 }, func(ID int, body io.Reader) error {
+        data, err := io.ReadAll(body)
+        if err == nil {
+            handled = append(handled, ID)
+            if ID == 1 && string(data) != faultBody1 + "\r\n" {
+                t.Errorf("Unexpected body %q", data)
+            }
+        }
+        return err
+    })
+    if !errors.Is(err, io.ErrUnexpectedEOF) {
+        t.Errorf("Expected an unexpected EOF, got %v", err)
+    }
+    if len(handled) != 1 || handled[0] != 1 {
+        t.Errorf("Unexpected messages handled %v", handled)
+    }
+    if !strings.HasSuffix(conn.Sent(), "RETR 1\r\nRETR 2\r\nRETR 1\r\n") {
+        t.Errorf("Expected the commands to be pipelined, sent %q", conn.Sent())
+    }
+}
+
+// Test_FaultLatency checks a slow network within the timeouts still works
+func Test_FaultLatency(t *testing.T) {
+    conn := newFaultMailbox()
+    conn.Latency = 5 * time.Millisecond
+    conn.Chunks = []int { 16 }
+    conf := config.NewConfig()
+    conf.CommandTimeout = 5 * time.Second
+    conf.IdleTimeout = time.Second
+    toTest := newFaultClient(t, *conf, conn)
+    connectFault(t, toTest)
+
+    conn.Inject("RETR", connFault { Delay: 50 * time.Millisecond })
+    email, err := toTest.Retrieve(2)
+    if err != nil || email.Message != faultBody2 {
+        t.Errorf("Unexpected message %q, %v", email, err)
+    }
+}
+
+// Test_FaultTimeouts checks a stalled or slow server times out the command and closes the connection
+func Test_FaultTimeouts(t *testing.T) {
+    tests := []struct {
+        name string
+        timeouts func(*config.Config)
+        fault connFault
+    } {
+        { "command stalled", func(c *config.Config) { c.CommandTimeout = 50 * time.Millisecond }, connFault { Stall: true } },
+        { "command delayed", func(c *config.Config) { c.CommandTimeout = 50 * time.Millisecond }, connFault { Delay: time.Minute } },
+        { "idle stalled", func(c *config.Config) { c.IdleTimeout = 50 * time.Millisecond }, connFault { Stall: true } },
+        { "stalled mid-response", func(c *config.Config) { c.IdleTimeout = 50 * time.Millisecond }, connFault { Response: "+OK\r\nSubject: one\r\n" } },
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            conn := newFaultMailbox()
+            conn.Chunks = []int { 1 }
+            conf := config.NewConfig()
+            test.timeouts(conf)
+            toTest := newFaultClient(t, *conf, conn)
+            connectFault(t, toTest)
+
+            conn.Inject("RETR", test.fault)
+            start := time.Now()
+            _, err := toTest.Retrieve(1)
+            var netErr net.Error
+            if !errors.As(err, &netErr) || !netErr.Timeout() {
+                t.Errorf("Expected a timeout, got %v", err)
+            }
+            if time.Since(start) > 5 * time.Second {
+                t.Errorf("Timing out took %v", time.Since(start))
+            }
+            if toTest.State() != StateClosed || !conn.IsClosed() {
+                t.Errorf("Expected the connection to be closed, state %v", toTest.State())
+            }
+        })
+    }
+}
+
+// Test_FaultCancelled checks cancelling a command blocked on a stalled server unblocks it
+func Test_FaultCancelled(t *testing.T) {
+    conn := newFaultMailbox()
+    toTest := newFaultClient(t, *config.NewConfig(), conn)
+    connectFault(t, toTest)
+
+    conn.Inject("STAT", connFault { Stall: true })
+    ctx, cancel := context.WithCancel(context.Background())
+    time.AfterFunc(20 * time.Millisecond, cancel)
+
+    _, _, err := toTest.StatContext(ctx)
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("Expected the command to be cancelled, got %v", err)
+    }
+    if toTest.State() != StateClosed || !conn.IsClosed() {
+        t.Errorf("Expected the connection to be closed, state %v", toTest.State())
+    }
+}
+
+// Test_FaultReconnect checks the client can connect again after a command timed out
+func Test_FaultReconnect(t *testing.T) {
+    first := newFaultMailbox()
+    second := newFaultMailbox()
+    second.Chunks = []int { 1 }
+    conf := config.NewConfig()
+    conf.CommandTimeout = 50 * time.Millisecond
+    toTest := newFaultClient(t, *conf, first, second)
+    connectFault(t, toTest)
+
+    first.Inject("RETR", connFault { Response: "+OK\r\nSubject" })
+    _, err := toTest.Retrieve(1)
+    if err == nil {
+        t.Fatal("Expected the first attempt to fail")
+    }
+
+    connectFault(t, toTest)
+    email, err := toTest.Retrieve(1)
+    if err != nil || email.Message != faultBody1 {
+        t.Errorf("Unexpected message after reconnecting %q, %v", email, err)
+    }
+}
+
+// Test_FaultErrorResponses checks the stream stays in sync after error responses, including
+// one in the middle of a pipelined batch read a byte at a time
+func Test_FaultErrorResponses(t *testing.T) {
+    conn := newFaultMailbox()
+    conn.Chunks = []int { 1 }
+    toTest := newFaultClient(t, *config.NewConfig(), conn)
+    connectFault(t, toTest)
+
+    conn.Inject("RETR", connFault { Response: "-ERR [SYS/TEMP] try again\r\n" })
+    _, err := toTest.Retrieve(1)
+    var protoErr *ProtocolError
+    if !errors.As(err, &protoErr) || !protoErr.Temporary() {
+        t.Errorf("Expected a temporary error, got %v", err)
+    }
+
+    email, err := toTest.Retrieve(1)
+    if err != nil || email.Message != faultBody1 {
+        t.Errorf("Unexpected message on retrying %q, %v", email, err)
+    }
+
+    conn.Inject("RETR", connFault {}, connFault { Response: "-ERR no such message\r\n" })
+    var handled []int
+    err = toTest.RetrieveMany([]int { 1, 2, 1 }, func(ID int, body io.Reader) error {
+        handled = append(handled, ID)
+        return nil
+    })
+    if !errors.Is(err, ErrNoSuchMessage) || len(handled) != 1 || handled[0] != 1 {
+        t.Errorf("Unexpected result %v handling %v", err, handled)
+    }
+
+    err = toTest.Noop()
+    if err != nil {
+        t.Errorf("Expected the connection to be in sync, got %v", err)
+    }
+}
+
+// Test_FaultBodyClosedEarly checks closing a streamed body part way through leaves the next response readable
+func Test_FaultBodyClosedEarly(t *testing.T) {
+    conn := newFaultMailbox()
+    conn.Chunks = []int { 1 }
+    toTest := newFaultClient(t, *config.NewConfig(), conn)
+    connectFault(t, toTest)
+
+    body, err := toTest.RetrieveReader(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    start := make([]byte, 7)
+    _, err = io.ReadFull(body, start)
+    if err != nil || string(start) != "Subject" {
+        t.Errorf("Unexpected start of body %q, %v", start, err)
+    }
+    err = body.Close()
+    if err != nil {
+        t.Error(err)
+    }
+
+    email, err := toTest.Retrieve(2)
+    if err != nil || email.Message != faultBody2 {
+        t.Errorf("Unexpected message %q, %v", email, err)
+    }
+}
+
+// Test_FaultPartialWrite checks a short write is an error and what was written is recorded
+func Test_FaultPartialWrite(t *testing.T) {
+    conn := newFaultMailbox()
+    toTest := newFaultClient(t, *config.NewConfig(), conn)
+    connectFault(t, toTest)
+
+    conn.WriteLimit = 3
+    err := toTest.Delete(1)
+    if err == nil || !strings.Contains(err.Error(), "only managed 3") {
+        t.Errorf("Expected a short write error, got %v", err)
+    }
+    if !strings.HasSuffix(conn.Sent(), "CAPA\r\nDEL") {
+        t.Errorf("Unexpected data written %q", conn.Sent())
+    }
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// RetrieveMany retrieves each message in ids calling handler with its content in order.
+// When the server advertises PIPELINING the RETR commands are sent in batches of up to
+// the configured PipelineWindow rather than waiting for each response. The first error
+// returned by the server or handler stops any more commands being sent and is returned
+// once the outstanding responses have been read
+func (c *Client) RetrieveMany(ids []int, handler func(ID int, body io.Reader) error) error {
+	return c.RetrieveManyContext(context.Background(), ids, handler)
+}
+
+// RetrieveManyContext is RetrieveMany with ctx controlling the deadline and cancellation,
+// the command timeout applies to the whole batch
+func (c *Client) RetrieveManyContext(ctx context.Context, ids []int, handler func(ID int, body io.Reader) error) error {
+	return c.withContext(ctx, c.config.CommandTimeout, "RETR", func() error {
+		return c.retrieveMany(ids, handler)
+	})
+}
+
+// retrieveMany implements RetrieveMany
+func (c *Client) retrieveMany(ids []int, handler func(ID int, body io.Reader) error) error {
+	err := c.checkState("RETR", StateTransaction)
+	if err != nil {
+		return err
+	}
+
+	c.logger.Debug("Fetching messages", "count", len(ids))
+
+	return c.pipeline(len(ids), func(i int) string {
+		return fmt.Sprintf("RETR %v\r\n", ids[i])
+	}, func(i int, skip bool) (bool, error) {
+		msg, err := c.readStatus()
+		if err != nil {
+			return false, err
+		}
+		if c.isError(msg) {
+			return true, newProtocolError("RETR", msg, ErrNoSuchMessage)
+		}
+
+		var failed error
+		body := c.reader.DotReader()
+		if !skip {
+			failed = handler(ids[i], body)
+		}
+
+		err = body.Close()
+		if err != nil {
+			return false, err
+		}
+
+		return true, failed
+	})
+}
+
+// DeleteMany marks each message in ids as deleted, pipelining the DELE commands when
+// the server supports it. The first message the server fails to delete stops any more
+// commands being sent and its error is returned. DELE commands already sent after it are
+// still run by the server, so those messages are removed when the session ends with QUIT
+// unless Reset is called first
+func (c *Client) DeleteMany(ids []int) error {
+	return c.DeleteManyContext(context.Background(), ids)
+}
+
+// DeleteManyContext is DeleteMany with ctx controlling the deadline and cancellation,
+// the command timeout applies to the whole batch
+func (c *Client) DeleteManyContext(ctx context.Context, ids []int) error {
+	return c.withContext(ctx, c.config.CommandTimeout, "DELE", func() error {
+		return c.deleteMany(ids)
+	})
+}
+
+// deleteMany implements DeleteMany
+func (c *Client) deleteMany(ids []int) error {
+	err := c.checkState("DELE", StateTransaction)
+	if err != nil {
+		return err
+	}
+
+	c.logger.Debug("Deleting messages", "count", len(ids))
+
+	return c.pipeline(len(ids), func(i int) string {
+		return fmt.Sprintf("DELE %v\r\n", ids[i])
+	}, func(i int, skip bool) (bool, error) {
+		msg, err := c.readStatus()
+		if err != nil {
+			return false, err
+		}
+		if c.isError(msg) {
+			return true, newProtocolError("DELE", msg, ErrNoSuchMessage)
+		}
+
+		return true, nil
+	})
+}
+
+// UIDLMany returns the unique-id of each message in ids, pipelining the UIDL commands
+// when the server supports it. If the server rejects one the unique-ids fetched before
+// it are returned along with the error
+func (c *Client) UIDLMany(ids []int) ([]*Email, error) {
+	return c.UIDLManyContext(context.Background(), ids)
+}
+
+// UIDLManyContext is UIDLMany with ctx controlling the deadline and cancellation,
+// the command timeout applies to the whole batch
+func (c *Client) UIDLManyContext(ctx context.Context, ids []int) ([]*Email, error) {
+	var emails []*Email
+	err := c.withContext(ctx, c.config.CommandTimeout, "UIDL", func() error {
+		var err error
+		emails, err = c.uidlMany(ids)
+		return err
+	})
+
+	return emails, err
+}
+
+// uidlMany implements UIDLMany
+func (c *Client) uidlMany(ids []int) ([]*Email, error) {
+	err := c.checkState("UIDL", StateTransaction)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.supports(func(caps *Capabilities) bool { return caps.UIDL }) {
+		return nil, fmt.Errorf("%w: UIDL", ErrUnsupported)
+	}
+
+	c.logger.Debug("Fetching unique-ids of messages", "count", len(ids))
+
+	var emails []*Email
+	err = c.pipeline(len(ids), func(i int) string {
+		return fmt.Sprintf("UIDL %v\r\n", ids[i])
+	}, func(i int, skip bool) (bool, error) {
+		msg, err := c.readStatus()
+		if err != nil {
+			return false, err
+		}
+		if c.isError(msg) {
+			return true, newProtocolError("UIDL", msg, ErrNoSuchMessage)
+		}
+		if skip {
+			return true, nil
+		}
+
+		email := NewEmail()
+		err = email.ParseSingleUIDLine(msg)
+		if err == nil {
+			emails = append(emails, email)
+		}
+
+		return true, err
+	})
+
+	return emails, err
+}
+
+// pipeline sends count commands, keeping up to the pipeline window outstanding when the
+// server advertises PIPELINING and otherwise sending one at a time. read is called for
+// each response in order, returning any error along with whether the connection can
+// still be used. An error affecting only that command stops any more commands being sent
+// and the outstanding responses are read with skip set, it's returned once they have
+// been. An error leaving the connection unusable is returned immediately.
+//
+// The window is only refilled once at most half of it is outstanding, so a refill is
+// written while no more than window/2 responses are unread. The write still blocks until
+// the server reads it, so the server must read commands while its responses are unread,
+// as RFC 2449 requires of servers advertising PIPELINING
+func (c *Client) pipeline(count int, command func(i int) string, read func(i int, skip bool) (bool, error)) error {
+	window := 1
+	if c.capabilities != nil && c.capabilities.Pipelining && c.config.PipelineWindow > 1 {
+		window = c.config.PipelineWindow
+	}
+
+	var firstFailed error
+	sent := 0
+	for received := 0; received < count; received++ {
+		if received == sent && firstFailed != nil {
+			break
+		}
+
+		// refill the window once it's drained to half, sending the batch in a single write
+		var batch strings.Builder
+		refill := sent-received <= window/2
+		for refill && firstFailed == nil && sent < count && sent-received < window {
+			batch.WriteString(command(sent))
+			sent++
+		}
+		if batch.Len() > 0 {
+			err := c.writeMsg(batch.String())
+			if err != nil {
+				return err
+			}
+		}
+
+		usable, err := read(received, firstFailed != nil)
+		if err != nil && !usable {
+			return err
+		}
+		if err != nil && firstFailed == nil {
+			firstFailed = err
+		}
+	}
+
+	return firstFailed
+}
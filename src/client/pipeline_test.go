@@ -0,0 +1,156 @@
+package client
+
+import (
+    "errors"
+    "io"
+    "testing"
+)
+
+// Test_RetrieveManyPipelined checks RETR commands are sent in batches up to the window
+func Test_RetrieveManyPipelined(t *testing.T) {
+    testConn, toTest, conf := initialiseSession()
+    conf.PipelineWindow = 2
+    toTest.config = *conf
+    toTest.capabilities.Pipelining = true
+
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\none\r\n.\r\n+OK\r\ntwo\r\n.\r\n", "+OK\r\nthree\r\n.\r\n")
+
+    var bodies []string
+    err := toTest.RetrieveMany([]int { 1, 2, 3 }, func(ID int, body io.Reader) error {
+        content, err := io.ReadAll(body)
+        bodies = append(bodies, string(content))
+        return err
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(testConn.Written) != 2 || testConn.Written[0] != "RETR 1\r\nRETR 2\r\n" || testConn.Written[1] != "RETR 3\r\n" {
+        t.Errorf("Incorrect commands written %q", testConn.Written)
+    }
+    if len(bodies) != 3 || bodies[0] != "one\r\n" || bodies[2] != "three\r\n" {
+        t.Errorf("Incorrect bodies %q", bodies)
+    }
+}
+
+// Test_RetrieveManyRefillsAtHalf checks the window is only refilled once half of it is outstanding
+func Test_RetrieveManyRefillsAtHalf(t *testing.T) {
+    testConn, toTest, conf := initialiseSession()
+    conf.PipelineWindow = 4
+    toTest.config = *conf
+    toTest.capabilities.Pipelining = true
+
+    for _, body := range []string { "one", "two", "three", "four", "five", "six" } {
+        testConn.ToRead = append(testConn.ToRead, "+OK\r\n" + body + "\r\n.\r\n")
+    }
+
+    err := toTest.RetrieveMany([]int { 1, 2, 3, 4, 5, 6 }, func(ID int, body io.Reader) error {
+        _, err := io.Copy(io.Discard, body)
+        return err
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(testConn.Written) != 2 || testConn.Written[0] != "RETR 1\r\nRETR 2\r\nRETR 3\r\nRETR 4\r\n" || testConn.Written[1] != "RETR 5\r\nRETR 6\r\n" {
+        t.Errorf("Incorrect commands written %q", testConn.Written)
+    }
+}
+
+// Test_RetrieveManySerial checks commands are sent one at a time without PIPELINING
+func Test_RetrieveManySerial(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\none\r\n.\r\n", "+OK\r\ntwo\r\n.\r\n")
+    err := toTest.RetrieveMany([]int { 1, 2 }, func(ID int, body io.Reader) error {
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(testConn.Written) != 2 || testConn.Written[0] != "RETR 1\r\n" || testConn.Written[1] != "RETR 2\r\n" {
+        t.Errorf("Incorrect commands written %q", testConn.Written)
+    }
+}
+
+// Test_RetrieveManyHandlerError checks a handler error stops the batch leaving the connection usable
+func Test_RetrieveManyHandlerError(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+    toTest.capabilities.Pipelining = true
+
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\none\r\n.\r\n+OK\r\ntwo\r\n.\r\n-ERR no such message\r\n", "+OK 2 320\r\n")
+
+    handlerErr := errors.New("disk full")
+    called := 0
+    err := toTest.RetrieveMany([]int { 1, 2, 3 }, func(ID int, body io.Reader) error {
+        called++
+        return handlerErr
+    })
+    if err != handlerErr {
+        t.Errorf("Expected the handler error, got %v", err)
+    }
+    if called != 1 {
+        t.Errorf("Handler called %v times after failing", called)
+    }
+
+    msgs, _, err := toTest.Stat()
+    if err != nil || msgs != 2 {
+        t.Errorf("Connection out of sync after the batch %v %v", msgs, err)
+    }
+}
+
+// Test_DeleteManyError checks no more DELE commands are sent once one fails
+func Test_DeleteManyError(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n", "-ERR message 2 already deleted\r\n")
+    err := toTest.DeleteMany([]int { 1, 2, 3 })
+    if !errors.Is(err, ErrNoSuchMessage) {
+        t.Errorf("Expected ErrNoSuchMessage, got %v", err)
+    }
+    if len(testConn.Written) != 2 {
+        t.Errorf("Incorrect commands written %q", testConn.Written)
+    }
+}
+
+// Test_DeleteManyPipelined checks DELE commands are sent in a single batch
+func Test_DeleteManyPipelined(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+    toTest.capabilities.Pipelining = true
+
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n+OK\r\n+OK\r\n")
+    err := toTest.DeleteMany([]int { 1, 2, 3 })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(testConn.Written) != 1 || testConn.Written[0] != "DELE 1\r\nDELE 2\r\nDELE 3\r\n" {
+        t.Errorf("Incorrect commands written %q", testConn.Written)
+    }
+}
+
+// Test_UIDLMany checks the unique-ids of several messages are fetched
+func Test_UIDLMany(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+    toTest.capabilities.Pipelining = true
+
+    testConn.ToRead = append(testConn.ToRead, "+OK 1 whqtswO00WBw418f9t5JxYwZ\r\n+OK 3 QhdPYR:00WBw1Ph7x7\r\n-ERR no such message\r\n")
+    emails, err := toTest.UIDLMany([]int { 1, 3, 4 })
+    if !errors.Is(err, ErrNoSuchMessage) {
+        t.Errorf("Expected ErrNoSuchMessage, got %v", err)
+    }
+    if len(emails) != 2 || emails[1].ID != 3 || emails[1].UID != "QhdPYR:00WBw1Ph7x7" {
+        t.Errorf("Incorrect unique-ids %v", emails)
+    }
+}
+
+// Test_UIDLManyRefusedWithoutCapability checks UIDL isn't sent when not advertised
+func Test_UIDLManyRefusedWithoutCapability(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+    toTest.capabilities = NewCapabilities()
+
+    _, err := toTest.UIDLMany([]int { 1 })
+    if !errors.Is(err, ErrUnsupported) || len(testConn.Written) != 0 {
+        t.Errorf("Expected ErrUnsupported without writing, got %v", err)
+    }
+}
@@ -0,0 +1,289 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// socksReplies holds the descriptions of the SOCKS5 reply codes (RFC 1928)
+var socksReplies = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// proxyDialer opens connections through the proxy set in the config, or directly if
+// there isn't one
+type proxyDialer struct {
+	conf    func() (*url.URL, error)
+	forward *familyDialer
+	timeout time.Duration
+}
+
+// Dial connects to addr, tunnelling through the proxy if there is one
+func (d *proxyDialer) Dial(network string, addr string) (net.Conn, error) {
+	proxy, err := d.conf()
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return d.forward.Dial(network, addr)
+	}
+
+	return d.dialProxy(proxy, network, addr, nil)
+}
+
+// DialTLS connects to addr using TLS, the handshake runs over the tunnel when there is a proxy
+func (d *proxyDialer) DialTLS(network string, addr string, config *tls.Config) (net.Conn, error) {
+	proxy, err := d.conf()
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		return d.dialProxy(proxy, network, addr, config)
+	}
+
+	conn, err := d.forward.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.timeout))
+	}
+
+	return handshake(conn, config)
+}
+
+// dialProxy connects to the proxy and asks it to connect to addr, negotiating TLS over the
+// tunnel if tlsConf is set. The connect timeout covers the whole exchange
+func (d *proxyDialer) dialProxy(proxy *url.URL, network string, addr string, tlsConf *tls.Config) (net.Conn, error) {
+	port := proxy.Port()
+	if port == "" {
+		port = "1080"
+		if proxy.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	conn, err := d.forward.Dial(network, net.JoinHostPort(proxy.Hostname(), port))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to proxy %v: %w", proxy.Redacted(), err)
+	}
+
+	if d.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.timeout))
+	}
+
+	tunnel := conn
+	if proxy.Scheme == "http" {
+		tunnel, err = httpConnect(conn, proxy, addr)
+	} else {
+		err = socksConnect(conn, proxy, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %v unable to connect to %v: %w", proxy.Redacted(), addr, err)
+	}
+
+	if tlsConf != nil {
+		return handshake(tunnel, tlsConf)
+	}
+
+	tunnel.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// handshake negotiates TLS over conn, clearing any deadline once done. conn is closed if
+// the handshake fails
+func handshake(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// socksConnect asks a SOCKS5 proxy to connect to addr (RFC 1928), authenticating using
+// username and password (RFC 1929) if they're in the proxy URL
+func socksConnect(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("Invalid port %v", portStr)
+	}
+
+	method := byte(0x00)
+	if proxy.User != nil {
+		method = 0x02
+	}
+
+	_, err = conn.Write([]byte{0x05, 0x01, method})
+	if err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("Unexpected SOCKS version %v", reply[0])
+	}
+	if reply[1] != method {
+		return errors.New("No acceptable SOCKS authentication method")
+	}
+
+	if method == 0x02 {
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("SOCKS username or password too long")
+		}
+
+		auth := []byte{0x01, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		_, err = conn.Write(auth)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS authentication failed")
+		}
+	}
+
+	// the proxy resolves host names so the server's name doesn't need to resolve locally
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(request, 0x01)
+		request = append(request, ip.To4()...)
+	} else if ip != nil {
+		request = append(request, 0x04)
+		request = append(request, ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("Host name too long %v", host)
+		}
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		reason, ok := socksReplies[header[1]]
+		if !ok {
+			reason = fmt.Sprintf("reply %v", header[1])
+		}
+		return fmt.Errorf("SOCKS connect failed: %v", reason)
+	}
+
+	// skip the bound address and port
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		_, err = io.ReadFull(conn, header[:1])
+		if err != nil {
+			return err
+		}
+		skip = int(header[0]) + 2
+	default:
+		return fmt.Errorf("Unexpected SOCKS address type %v", header[3])
+	}
+
+	_, err = io.CopyN(io.Discard, conn, int64(skip))
+	return err
+}
+
+// httpConnect asks an HTTP proxy to open a tunnel to addr using CONNECT, authenticating
+// with basic auth if there is a username in the proxy URL
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	err := request.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP CONNECT failed: %v", response.Status)
+	}
+
+	// the server greeting may already have been read along with the response
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a connection with data already read into reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads from the buffered data before the connection
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
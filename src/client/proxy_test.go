@@ -0,0 +1,317 @@
+package client
+
+import (
+    "bufio"
+    "crypto/tls"
+    "encoding/binary"
+    "encoding/pem"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "testing"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+    "github.com/benmj87/gogo-pop3gadget/src/pop3test"
+)
+
+// testProxy is a SOCKS5 or HTTP CONNECT proxy tunnelling every request to backend
+type testProxy struct {
+    listener net.Listener
+    backend string
+    // reply holds the SOCKS reply code to send, 0 to connect
+    reply byte
+    // requested receives the address asked for by each connection
+    requested chan string
+    // auth receives the credentials given by each connection
+    auth chan string
+}
+
+// newTestListener listens on the loopback interface closing the listener when the test ends
+func newTestListener(t *testing.T) net.Listener {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+
+    return listener
+}
+
+// newTestBackend serves a mailbox for user, using TLS if cert is set, returning its address
+func newTestBackend(t *testing.T, cert *tls.Certificate) string {
+    server := pop3test.NewServer()
+    server.Greeting = "+OK ready"
+    server.AddMailbox("user", "secret", "Subject: one\r\n\r\nbody")
+    t.Cleanup(func() { server.Close() })
+
+    listener := newTestListener(t)
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            if cert != nil {
+                conn = tls.Server(conn, &tls.Config { Certificates: []tls.Certificate { *cert } })
+            }
+            go server.Serve(conn)
+        }
+    }()
+
+    return listener.Addr().String()
+}
+
+// newTestProxy starts a proxy speaking scheme, socks5 or http, that tunnels to backend
+func newTestProxy(t *testing.T, scheme string, backend string) *testProxy {
+    proxy := &testProxy {
+        listener: newTestListener(t),
+        backend: backend,
+        requested: make(chan string, 10),
+        auth: make(chan string, 10),
+    }
+
+    go func() {
+        for {
+            conn, err := proxy.listener.Accept()
+            if err != nil {
+                return
+            }
+
+            go func() {
+                defer conn.Close()
+
+                reader := bufio.NewReader(conn)
+                var ok bool
+                if scheme == "http" {
+                    ok = proxy.http(reader, conn)
+                } else {
+                    ok = proxy.socks(reader, conn)
+                }
+                if !ok {
+                    return
+                }
+
+                target, err := net.Dial("tcp", proxy.backend)
+                if err != nil {
+                    return
+                }
+                defer target.Close()
+
+                go io.Copy(target, reader)
+                io.Copy(conn, target)
+            }()
+        }
+    }()
+
+    return proxy
+}
+
+// URL returns the URL of the proxy with the credentials in userinfo
+func (p *testProxy) URL(scheme string, userinfo string) string {
+    if userinfo != "" {
+        userinfo += "@"
+    }
+    return scheme + "://" + userinfo + p.listener.Addr().String()
+}
+
+// socks answers the SOCKS5 negotiation, returning whether to connect
+func (p *testProxy) socks(reader *bufio.Reader, conn net.Conn) bool {
+    header := make([]byte, 2)
+    if _, err := io.ReadFull(reader, header); err != nil {
+        return false
+    }
+    methods := make([]byte, header[1])
+    io.ReadFull(reader, methods)
+
+    conn.Write([]byte { 0x05, methods[0] })
+    if methods[0] == 0x02 {
+        io.ReadFull(reader, header)
+        username := make([]byte, header[1])
+        io.ReadFull(reader, username)
+        length, _ := reader.ReadByte()
+        password := make([]byte, length)
+        io.ReadFull(reader, password)
+
+        p.auth <- string(username) + ":" + string(password)
+        conn.Write([]byte { 0x01, 0x00 })
+    }
+
+    request := make([]byte, 4)
+    if _, err := io.ReadFull(reader, request); err != nil {
+        return false
+    }
+
+    var host string
+    switch request[3] {
+    case 0x01:
+        ip := make([]byte, net.IPv4len)
+        io.ReadFull(reader, ip)
+        host = net.IP(ip).String()
+    case 0x03:
+        length, _ := reader.ReadByte()
+        name := make([]byte, length)
+        io.ReadFull(reader, name)
+        host = string(name)
+    }
+    port := make([]byte, 2)
+    io.ReadFull(reader, port)
+    p.requested <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+    conn.Write([]byte { 0x05, p.reply, 0x00, 0x01, 0, 0, 0, 0, 0, 0 })
+    return p.reply == 0x00
+}
+
+// http answers the CONNECT request, returning whether to connect
+func (p *testProxy) http(reader *bufio.Reader, conn net.Conn) bool {
+    request, err := http.ReadRequest(reader)
+    if err != nil {
+        return false
+    }
+
+    p.requested <- request.Host
+    if username, password, ok := parseProxyAuth(request.Header.Get("Proxy-Authorization")); ok {
+        p.auth <- username + ":" + password
+    }
+
+    if p.reply != 0x00 {
+        io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\n\r\n")
+        return false
+    }
+
+    io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+    return true
+}
+
+// parseProxyAuth decodes the basic auth credentials in a Proxy-Authorization header
+func parseProxyAuth(header string) (string, string, bool) {
+    request := &http.Request { Header: http.Header { "Authorization": []string { header } } }
+    return request.BasicAuth()
+}
+
+// newProxyConfig returns the config for a plaintext server reached through proxy
+func newProxyConfig(proxy string) *config.Config {
+    conf := config.NewConfig()
+    conf.UseTLS = false
+    conf.Server = "pop.example.com"
+    conf.Port = 110
+    conf.Username = "user"
+    conf.Password = "secret"
+    conf.Proxy = proxy
+
+    return conf
+}
+
+// Test_ConnectSOCKS5Proxy checks the connection is tunnelled through a SOCKS5 proxy with the host name resolved by the proxy
+func Test_ConnectSOCKS5Proxy(t *testing.T) {
+    proxy := newTestProxy(t, "socks5", newTestBackend(t, nil))
+
+    toTest := NewClient(*newProxyConfig(proxy.URL("socks5", "user:secret")))
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer toTest.Close()
+
+    if toTest.Greeting() != "+OK ready" {
+        t.Errorf("Incorrect greeting %v", toTest.Greeting())
+    }
+    if requested := <-proxy.requested; requested != "pop.example.com:110" {
+        t.Errorf("Incorrect address requested %v", requested)
+    }
+    if auth := <-proxy.auth; auth != "user:secret" {
+        t.Errorf("Incorrect credentials %v", auth)
+    }
+
+    err = toTest.Auth()
+    if err != nil {
+        t.Fatal(err)
+    }
+    count, _, err := toTest.Stat()
+    if err != nil || count != 1 {
+        t.Errorf("Unexpected STAT %v, %v", count, err)
+    }
+}
+
+// Test_ConnectHTTPProxy checks the connection is tunnelled using HTTP CONNECT with basic auth
+func Test_ConnectHTTPProxy(t *testing.T) {
+    proxy := newTestProxy(t, "http", newTestBackend(t, nil))
+
+    toTest := NewClient(*newProxyConfig(proxy.URL("http", "user:secret")))
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer toTest.Close()
+
+    if toTest.Greeting() != "+OK ready" {
+        t.Errorf("Incorrect greeting %v", toTest.Greeting())
+    }
+    if requested := <-proxy.requested; requested != "pop.example.com:110" {
+        t.Errorf("Incorrect address requested %v", requested)
+    }
+    if auth := <-proxy.auth; auth != "user:secret" {
+        t.Errorf("Incorrect credentials %v", auth)
+    }
+}
+
+// Test_ConnectProxyTLS checks implicit TLS is negotiated with the server over the tunnel
+func Test_ConnectProxyTLS(t *testing.T) {
+    cert, _ := newTestCertificate(t)
+    proxy := newTestProxy(t, "socks5", newTestBackend(t, &cert))
+
+    conf := newProxyConfig(proxy.URL("socks5", ""))
+    conf.UseTLS = true
+    conf.Server = "localhost"
+    conf.Port = 995
+    conf.TLSCAPEM = pem.EncodeToMemory(&pem.Block { Type: "CERTIFICATE", Bytes: cert.Certificate[0] })
+
+    toTest := NewClient(*conf)
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer toTest.Close()
+
+    if _, ok := toTest.connectionState(); !ok {
+        t.Error("Connection not using TLS")
+    }
+    if requested := <-proxy.requested; requested != "localhost:995" {
+        t.Errorf("Incorrect address requested %v", requested)
+    }
+}
+
+// Test_ConnectProxyRefused checks a proxy refusing the connection is reported
+func Test_ConnectProxyRefused(t *testing.T) {
+    for _, scheme := range []string { "socks5", "http" } {
+        proxy := newTestProxy(t, scheme, newTestBackend(t, nil))
+        proxy.reply = 0x02
+
+        toTest := NewClient(*newProxyConfig(proxy.URL(scheme, "")))
+        err := toTest.Connect()
+        if err == nil || !strings.Contains(err.Error(), "unable to connect to pop.example.com:110") {
+            t.Errorf("Expected a proxy error for %v, got %v", scheme, err)
+        }
+    }
+}
+
+// Test_ConnectProxyFromEnvironment checks ALL_PROXY is used when enabled
+func Test_ConnectProxyFromEnvironment(t *testing.T) {
+    proxy := newTestProxy(t, "socks5", newTestBackend(t, nil))
+    t.Setenv("ALL_PROXY", proxy.URL("socks5", ""))
+    t.Setenv("NO_PROXY", "")
+
+    conf := newProxyConfig("")
+    conf.ProxyFromEnvironment = true
+
+    toTest := NewClient(*conf)
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer toTest.Close()
+
+    if requested := <-proxy.requested; requested != "pop.example.com:110" {
+        t.Errorf("Incorrect address requested %v", requested)
+    }
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// maxLineLength is the longest status or listing line accepted from the server, RFC 1939
+// limits responses to 512 octets but some servers are generous
+const maxLineLength = 64 * 1024
+
+// responseReader reads responses from the server a line at a time (RFC 1939), leaving
+// anything after the current response buffered for the next one
+type responseReader struct {
+	*bufio.Reader
+}
+
+// newResponseReader returns a responseReader reading from r
+func newResponseReader(r io.Reader) *responseReader {
+	return &responseReader{Reader: bufio.NewReader(r)}
+}
+
+// ReadLine reads a single line without the trailing CRLF, a bare LF is also accepted
+func (r *responseReader) ReadLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineLength {
+			return "", errors.New("Response line too long")
+		}
+		line = append(line, chunk...)
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+
+		return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+	}
+}
+
+// ReadDotLines reads the lines of a multi-line response up to the terminating line,
+// undoing the byte-stuffing of lines starting with '.'
+func (r *responseReader) ReadDotLines() ([]string, error) {
+	var lines []string
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		if line == "." {
+			return lines, nil
+		}
+
+		lines = append(lines, strings.TrimPrefix(line, "."))
+	}
+}
+
+// DotReader returns a reader for the body of a multi-line response
+func (r *responseReader) DotReader() io.ReadCloser {
+	return newDotReader(r.Reader)
+}
+
+// dotReader reads the body of a multi-line response, undoing the byte-stuffing of lines
+// starting with '.' and returning io.EOF once the terminating line is read. Data after
+// the terminator is left in the underlying reader for the next response
+type dotReader struct {
+	// r is the reader for the connection
+	r *bufio.Reader
+	// pending holds data read from r that hasn't been returned yet
+	pending []byte
+	// atLineStart is set when the next byte read from r starts a new line
+	atLineStart bool
+	// done is set once the terminating line has been read
+	done bool
+}
+
+// newDotReader returns a reader for the body following the status line of a multi-line response
+func newDotReader(r *bufio.Reader) *dotReader {
+	return &dotReader{r: r, atLineStart: true}
+}
+
+// Read reads the dot-unstuffed body, a connection closed before the terminator
+// returns io.ErrUnexpectedEOF
+func (d *dotReader) Read(b []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		line, err := d.r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		if d.atLineStart && len(line) > 0 && line[0] == '.' {
+			if err == nil && (string(line) == ".\r\n" || string(line) == ".\n") {
+				d.done = true
+				return 0, io.EOF
+			}
+
+			line = line[1:]
+		}
+
+		// a line longer than the buffer is returned in pieces
+		d.atLineStart = err == nil
+		d.pending = append(d.pending[:0], line...)
+	}
+
+	read := copy(b, d.pending)
+	d.pending = d.pending[read:]
+
+	return read, nil
+}
+
+// Close reads and discards the rest of the body so the next response can be read
+func (d *dotReader) Close() error {
+	d.pending = nil
+	_, err := io.Copy(io.Discard, d)
+	return err
+}
+
+// lockedBody holds the command lock while a body returned by RetrieveReader is read,
+// finishing the command and releasing the lock once the body has been read to the end
+// or closed
+type lockedBody struct {
+	io.ReadCloser
+	finish func(error) error
+	once   sync.Once
+	err    error
+}
+
+// Read reads the body, finishing the command once the end is reached
+func (b *lockedBody) Read(p []byte) (int, error) {
+	read, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.done(nil)
+		if b.err != nil {
+			return read, b.err
+		}
+	}
+
+	return read, err
+}
+
+// Close discards the rest of the body and finishes the command, returning the error
+// reading it or from the command being cancelled or timing out
+func (b *lockedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done(err)
+
+	return b.err
+}
+
+// done finishes the command the first time it's called, keeping the error to report
+func (b *lockedBody) done(err error) {
+	b.once.Do(func() {
+		b.err = b.finish(err)
+	})
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+    "bufio"
+    "io"
+    "strings"
+    "testing"
+    "testing/iotest"
+)
+
+// Test_ResponseReaderReadLineOk checks that lines are returned without line endings
+func Test_ResponseReaderReadLineOk(t *testing.T) {
+    toTest := newResponseReader(strings.NewReader("+OK ready\r\n+OK bare\n"))
+
+    line, err := toTest.ReadLine()
+    if err != nil || line != "+OK ready" {
+        t.Errorf("Invalid line %q, error %v", line, err)
+    }
+
+    line, err = toTest.ReadLine()
+    if err != nil || line != "+OK bare" {
+        t.Errorf("Invalid line %q, error %v", line, err)
+    }
+
+    _, err = toTest.ReadLine()
+    if err != io.EOF {
+        t.Errorf("Expected io.EOF, got %v", err)
+    }
+}
+
+// Test_ResponseReaderReadLineErrors checks that partial and overlong lines are errors
+func Test_ResponseReaderReadLineErrors(t *testing.T) {
+    toTest := newResponseReader(strings.NewReader("+OK no line ending"))
+    _, err := toTest.ReadLine()
+    if err != io.ErrUnexpectedEOF {
+        t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+    }
+
+    toTest = newResponseReader(strings.NewReader(strings.Repeat("a", maxLineLength + 1) + "\r\n"))
+    _, err = toTest.ReadLine()
+    if err == nil {
+        t.Error("Expected an error")
+    }
+}
+
+// Test_ResponseReaderReadDotLinesOk checks that lines are unstuffed up to the terminator
+func Test_ResponseReaderReadDotLinesOk(t *testing.T) {
+    toTest := newResponseReader(iotest.OneByteReader(strings.NewReader("..\r\n.. two\r\nthree.\r\n.\r\n+OK\r\n")))
+
+    lines, err := toTest.ReadDotLines()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(lines) != 3 || lines[0] != "." || lines[1] != ". two" || lines[2] != "three." {
+        t.Errorf("Invalid lines %q", lines)
+    }
+
+    line, _ := toTest.ReadLine()
+    if line != "+OK" {
+        t.Errorf("Data after the terminator wasn't left, %q", line)
+    }
+
+    toTest = newResponseReader(strings.NewReader("one\r\n"))
+    _, err = toTest.ReadDotLines()
+    if err != io.ErrUnexpectedEOF {
+        t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+    }
+}
+
+// Test_DotReaderOk checks that the body is unstuffed and stops at the terminator
+func Test_DotReaderOk(t *testing.T) {
+    r := bufio.NewReader(strings.NewReader("..first\r\nsecond\r\n...\r\n.\r\n+OK next\r\n"))
+    toTest := newDotReader(r)
+
+    body, err := io.ReadAll(toTest)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(body) != ".first\r\nsecond\r\n..\r\n" {
+        t.Errorf("Invalid body %q", body)
+    }
+
+    rest, _ := r.ReadString('\n')
+    if rest != "+OK next\r\n" {
+        t.Errorf("Data after the terminator wasn't left, %q", rest)
+    }
+}
+
+// Test_DotReaderLongLines checks that lines longer than the buffer aren't treated as line starts
+func Test_DotReaderLongLines(t *testing.T) {
+    line := strings.Repeat("a", 40) + ".\r\n"
+    r := bufio.NewReaderSize(iotest.OneByteReader(strings.NewReader(line + line + ".\r\n")), 16)
+
+    body, err := io.ReadAll(newDotReader(r))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(body) != line + line {
+        t.Errorf("Invalid body %q", body)
+    }
+}
+
+// Test_DotReaderUnexpectedEOF checks that a connection closed before the terminator is an error
+func Test_DotReaderUnexpectedEOF(t *testing.T) {
+    r := bufio.NewReader(strings.NewReader("body\r\n"))
+
+    _, err := io.ReadAll(newDotReader(r))
+    if err != io.ErrUnexpectedEOF {
+        t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+    }
+}
+
+// Test_DotReaderClose checks that close discards the rest of the body
+func Test_DotReaderClose(t *testing.T) {
+    r := bufio.NewReader(strings.NewReader("line one\r\nline two\r\n.\r\n+OK\r\n"))
+    toTest := newDotReader(r)
+
+    toTest.Read(make([]byte, 2))
+    err := toTest.Close()
+    if err != nil {
+        t.Error(err)
+    }
+
+    rest, _ := r.ReadString('\n')
+    if rest != "+OK\r\n" {
+        t.Errorf("Body wasn't discarded, %q", rest)
+    }
+}
@@ -0,0 +1,258 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Mechanism implements a SASL mechanism (RFC 4422) used by the AUTH command
+type Mechanism interface {
+	// Name returns the mechanism name as advertised by the server, e.g. PLAIN
+	Name() string
+	// Start begins the exchange returning the initial response, nil if the mechanism doesn't have one
+	Start() ([]byte, error)
+	// Next returns the response to a challenge sent by the server
+	Next(challenge []byte) ([]byte, error)
+}
+
+// plainMechanism implements PLAIN (RFC 4616)
+type plainMechanism struct {
+	identity string
+	username string
+	password string
+}
+
+// NewPlainMechanism returns a PLAIN mechanism, identity is usually empty
+func NewPlainMechanism(identity string, username string, password string) Mechanism {
+	return &plainMechanism{identity: identity, username: username, password: password}
+}
+
+// Name returns PLAIN
+func (m *plainMechanism) Name() string {
+	return "PLAIN"
+}
+
+// Start returns the identity, username and password separated by NUL
+func (m *plainMechanism) Start() ([]byte, error) {
+	return []byte(m.identity + "\x00" + m.username + "\x00" + m.password), nil
+}
+
+// Next fails as PLAIN completes with the initial response
+func (m *plainMechanism) Next(challenge []byte) ([]byte, error) {
+	return nil, errors.New("Unexpected challenge for PLAIN")
+}
+
+// loginMechanism implements the obsolete but widely deployed LOGIN mechanism
+type loginMechanism struct {
+	username string
+	password string
+	step     int
+}
+
+// NewLoginMechanism returns a LOGIN mechanism
+func NewLoginMechanism(username string, password string) Mechanism {
+	return &loginMechanism{username: username, password: password}
+}
+
+// Name returns LOGIN
+func (m *loginMechanism) Name() string {
+	return "LOGIN"
+}
+
+// Start returns no initial response, the server prompts for the username
+func (m *loginMechanism) Start() ([]byte, error) {
+	return nil, nil
+}
+
+// Next returns the username followed by the password
+func (m *loginMechanism) Next(challenge []byte) ([]byte, error) {
+	m.step++
+	switch m.step {
+	case 1:
+		return []byte(m.username), nil
+	case 2:
+		return []byte(m.password), nil
+	}
+
+	return nil, errors.New("Unexpected challenge for LOGIN")
+}
+
+// cramMD5Mechanism implements CRAM-MD5 (RFC 2195)
+type cramMD5Mechanism struct {
+	username string
+	secret   string
+}
+
+// NewCRAMMD5Mechanism returns a CRAM-MD5 mechanism
+func NewCRAMMD5Mechanism(username string, secret string) Mechanism {
+	return &cramMD5Mechanism{username: username, secret: secret}
+}
+
+// Name returns CRAM-MD5
+func (m *cramMD5Mechanism) Name() string {
+	return "CRAM-MD5"
+}
+
+// Start returns no initial response, the server sends the challenge
+func (m *cramMD5Mechanism) Start() ([]byte, error) {
+	return nil, nil
+}
+
+// Next returns the username followed by the keyed MD5 digest of the challenge
+func (m *cramMD5Mechanism) Next(challenge []byte) ([]byte, error) {
+	digest := hmac.New(md5.New, []byte(m.secret))
+	digest.Write(challenge)
+
+	return []byte(m.username + " " + hex.EncodeToString(digest.Sum(nil))), nil
+}
+
+// xoauth2Mechanism implements XOAUTH2 as used by Gmail and Microsoft 365
+type xoauth2Mechanism struct {
+	username string
+	token    string
+}
+
+// NewXOAuth2Mechanism returns an XOAUTH2 mechanism using an OAuth 2.0 access token
+func NewXOAuth2Mechanism(username string, token string) Mechanism {
+	return &xoauth2Mechanism{username: username, token: token}
+}
+
+// Name returns XOAUTH2
+func (m *xoauth2Mechanism) Name() string {
+	return "XOAUTH2"
+}
+
+// Start returns the username and bearer token
+func (m *xoauth2Mechanism) Start() ([]byte, error) {
+	return []byte("user=" + m.username + "\x01auth=Bearer " + m.token + "\x01\x01"), nil
+}
+
+// Next acknowledges the JSON error challenge so the server completes with -ERR
+func (m *xoauth2Mechanism) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// oauthBearerMechanism implements OAUTHBEARER (RFC 7628)
+type oauthBearerMechanism struct {
+	username string
+	token    string
+	host     string
+	port     int
+}
+
+// NewOAuthBearerMechanism returns an OAUTHBEARER mechanism using an OAuth 2.0 access token
+func NewOAuthBearerMechanism(username string, token string, host string, port int) Mechanism {
+	return &oauthBearerMechanism{username: username, token: token, host: host, port: port}
+}
+
+// Name returns OAUTHBEARER
+func (m *oauthBearerMechanism) Name() string {
+	return "OAUTHBEARER"
+}
+
+// Start returns the GS2 header followed by the host, port and bearer token
+func (m *oauthBearerMechanism) Start() ([]byte, error) {
+	username := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(m.username)
+	response := "n,a=" + username + ",\x01"
+	if m.host != "" {
+		response += "host=" + m.host + "\x01"
+	}
+	if m.port != 0 {
+		response += "port=" + strconv.Itoa(m.port) + "\x01"
+	}
+
+	return []byte(response + "auth=Bearer " + m.token + "\x01\x01"), nil
+}
+
+// Next acknowledges the JSON error challenge so the server completes with -ERR
+func (m *oauthBearerMechanism) Next(challenge []byte) ([]byte, error) {
+	return []byte("\x01"), nil
+}
+
+// saslPreference holds the built in mechanisms in the order they're picked when
+// the server advertises more than one
+var saslPreference = []string{
+	"XOAUTH2",
+	"OAUTHBEARER",
+	"SCRAM-SHA-256-PLUS",
+	"SCRAM-SHA-1-PLUS",
+	"SCRAM-SHA-256",
+	"SCRAM-SHA-1",
+	"CRAM-MD5",
+	"PLAIN",
+	"LOGIN",
+}
+
+// newMechanism creates the named built in mechanism from the config
+func (c *Client) newMechanism(name string) (Mechanism, error) {
+	conf := c.config
+
+	switch strings.ToUpper(name) {
+	case "PLAIN":
+		return NewPlainMechanism("", conf.Username, conf.Password), nil
+	case "LOGIN":
+		return NewLoginMechanism(conf.Username, conf.Password), nil
+	case "CRAM-MD5":
+		return NewCRAMMD5Mechanism(conf.Username, conf.Password), nil
+	case "XOAUTH2":
+		return NewXOAuth2Mechanism(conf.Username, conf.Token), nil
+	case "OAUTHBEARER":
+		return NewOAuthBearerMechanism(conf.Username, conf.Token, conf.Server, conf.Port), nil
+	case "SCRAM-SHA-1", "SCRAM-SHA-256":
+		mech := NewSCRAMSHA1Mechanism(conf.Username, conf.Password).(*scramMechanism)
+		if strings.EqualFold(name, "SCRAM-SHA-256") {
+			mech = NewSCRAMSHA256Mechanism(conf.Username, conf.Password).(*scramMechanism)
+		}
+
+		// tell the server binding was possible so a stripped -PLUS advertisement is detected
+		_, isTLS := c.connectionState()
+		mech.bindingSupported = isTLS && c.capabilities != nil && !c.capabilities.SupportsSASL(mech.name+"-PLUS")
+		return mech, nil
+	case "SCRAM-SHA-1-PLUS", "SCRAM-SHA-256-PLUS":
+		state, isTLS := c.connectionState()
+		if !isTLS {
+			return nil, fmt.Errorf("SASL mechanism '%v' requires a TLS connection", name)
+		}
+
+		if strings.EqualFold(name, "SCRAM-SHA-256-PLUS") {
+			return NewSCRAMSHA256PlusMechanism(conf.Username, conf.Password, state)
+		}
+		return NewSCRAMSHA1PlusMechanism(conf.Username, conf.Password, state)
+	}
+
+	return nil, fmt.Errorf("Unknown SASL mechanism '%v'", name)
+}
+
+// selectMechanism returns the mechanism forced in the config, otherwise the most
+// preferred built in mechanism advertised by the server that the config has credentials for
+func (c *Client) selectMechanism() (Mechanism, error) {
+	if c.config.SASLMechanism != "" {
+		return c.newMechanism(c.config.SASLMechanism)
+	}
+
+	if c.capabilities == nil {
+		return nil, fmt.Errorf("%w: AUTH, no SASL mechanisms advertised", ErrUnsupported)
+	}
+
+	for _, name := range saslPreference {
+		usesToken := name == "XOAUTH2" || name == "OAUTHBEARER"
+		if usesToken != (c.config.Token != "") {
+			continue
+		}
+
+		if _, isTLS := c.connectionState(); strings.HasSuffix(name, "-PLUS") && !isTLS {
+			continue
+		}
+
+		if c.capabilities.SupportsSASL(name) {
+			return c.newMechanism(name)
+		}
+	}
+
+	return nil, fmt.Errorf("%w: AUTH, no usable SASL mechanism in %v", ErrUnsupported, c.capabilities.SASL)
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+    "errors"
+    "strings"
+    "testing"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+)
+
+// Test_PlainMechanism checks the PLAIN initial response
+func Test_PlainMechanism(t *testing.T) {
+    toTest := NewPlainMechanism("", "tim", "tanstaaftanstaaf")
+
+    ir, err := toTest.Start()
+    if err != nil || string(ir) != "\x00tim\x00tanstaaftanstaaf" {
+        t.Errorf("Invalid initial response %q, error %v", ir, err)
+    }
+
+    _, err = toTest.Next([]byte{})
+    if err == nil {
+        t.Error("Expected an error")
+    }
+}
+
+// Test_LoginMechanism checks LOGIN responds with the username then password
+func Test_LoginMechanism(t *testing.T) {
+    toTest := NewLoginMechanism("tim", "secret")
+
+    ir, _ := toTest.Start()
+    if ir != nil {
+        t.Error("Unexpected initial response")
+    }
+
+    user, _ := toTest.Next([]byte("Username:"))
+    pass, _ := toTest.Next([]byte("Password:"))
+    if string(user) != "tim" || string(pass) != "secret" {
+        t.Errorf("Invalid responses %q %q", user, pass)
+    }
+
+    _, err := toTest.Next([]byte("Again:"))
+    if err == nil {
+        t.Error("Expected an error")
+    }
+}
+
+// Test_CRAMMD5Mechanism checks the example from RFC 2195
+func Test_CRAMMD5Mechanism(t *testing.T) {
+    toTest := NewCRAMMD5Mechanism("tim", "tanstaaftanstaaf")
+
+    response, err := toTest.Next([]byte("<1896.697170952@postoffice.reston.mci.net>"))
+    if err != nil || string(response) != "tim b913a602c7eda7a495b4e6e7334d3890" {
+        t.Errorf("Invalid response %q, error %v", response, err)
+    }
+}
+
+// Test_OAuthMechanisms checks the XOAUTH2 and OAUTHBEARER initial responses
+func Test_OAuthMechanisms(t *testing.T) {
+    ir, _ := NewXOAuth2Mechanism("someuser@example.com", "ya29.vF9dft4").Start()
+    if string(ir) != "user=someuser@example.com\x01auth=Bearer ya29.vF9dft4\x01\x01" {
+        t.Errorf("Invalid XOAUTH2 response %q", ir)
+    }
+
+    ir, _ = NewOAuthBearerMechanism("user,1@example.com", "vF9dft4", "server.example.com", 995).Start()
+    if string(ir) != "n,a=user=2C1@example.com,\x01host=server.example.com\x01port=995\x01auth=Bearer vF9dft4\x01\x01" {
+        t.Errorf("Invalid OAUTHBEARER response %q", ir)
+    }
+}
+
+// Test_AuthSASLPlainOk checks the AUTH exchange with an initial response
+func Test_AuthSASLPlainOk(t *testing.T) {
+    testConn, toTest, conf := initialiseConnection()
+    conf.AuthMethod = config.AuthSASL
+    conf.Username = "tim"
+    conf.Password = "tanstaaftanstaaf"
+    toTest.config = *conf
+    toTest.capabilities.SASL = []string { "LOGIN", "PLAIN" }
+
+    testConn.ToRead = append(testConn.ToRead, "+OK maildrop locked and ready\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
+    err := toTest.Auth()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if testConn.Written[0] != "AUTH PLAIN AHRpbQB0YW5zdGFhZnRhbnN0YWFm\r\n" {
+        t.Errorf("Invalid AUTH written %v", testConn.Written[0])
+    }
+    if testConn.Written[1] != "CAPA\r\n" {
+        t.Error("Capabilities weren't refreshed")
+    }
+}
+
+// Test_AuthSASLChallengeOk checks the AUTH exchange with server challenges
+func Test_AuthSASLChallengeOk(t *testing.T) {
+    testConn, toTest, conf := initialiseConnection()
+    conf.AuthMethod = config.AuthSASL
+    conf.Username = "tim"
+    conf.Password = "tanstaaftanstaaf"
+    toTest.config = *conf
+    toTest.capabilities.SASL = []string { "PLAIN", "CRAM-MD5" }
+
+    testConn.ToRead = append(testConn.ToRead, "+ PDE4OTYuNjk3MTcwOTUyQHBvc3RvZmZpY2UucmVzdG9uLm1jaS5uZXQ+\r\n")
+    testConn.ToRead = append(testConn.ToRead, "+OK CRAM authentication successful\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
+    err := toTest.Auth()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if testConn.Written[0] != "AUTH CRAM-MD5\r\n" || testConn.Written[1] != "dGltIGI5MTNhNjAyYzdlZGE3YTQ5NWI0ZTZlNzMzNGQzODkw\r\n" {
+        t.Errorf("Invalid exchange written %v", testConn.Written)
+    }
+}
+
+// Test_AuthSASLLongInitialResponse checks the initial response is sent after an empty challenge when too long
+func Test_AuthSASLLongInitialResponse(t *testing.T) {
+    testConn, toTest, _ := initialiseConnection()
+
+    testConn.ToRead = append(testConn.ToRead, "+ \r\n")
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
+    err := toTest.AuthWith(NewXOAuth2Mechanism("tim", strings.Repeat("t", 300)))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if testConn.Written[0] != "AUTH XOAUTH2\r\n" || !strings.HasPrefix(testConn.Written[1], "dXNlcj10aW0B") {
+        t.Errorf("Invalid exchange written %v", testConn.Written)
+    }
+}
+
+// Test_AuthSASLErrors checks rejected and cancelled exchanges return errors
+func Test_AuthSASLErrors(t *testing.T) {
+    testConn, toTest, _ := initialiseConnection()
+
+    testConn.ToRead = append(testConn.ToRead, "-ERR [AUTH] invalid credentials\r\n")
+    err := toTest.AuthWith(NewPlainMechanism("", "tim", "wrong"))
+    if err == nil {
+        t.Error("Error not returned")
+    }
+
+    testConn.Written = testConn.Written[:0]
+    testConn.ToRead = append(testConn.ToRead, "+ not base64!\r\n")
+    testConn.ToRead = append(testConn.ToRead, "-ERR cancelled\r\n")
+    err = toTest.AuthWith(NewCRAMMD5Mechanism("tim", "secret"))
+    if err == nil || testConn.Written[1] != "*\r\n" {
+        t.Errorf("Expected the exchange to be cancelled, error %v written %v", err, testConn.Written)
+    }
+}
+
+// Test_SelectMechanism checks the mechanism is picked from those advertised
+func Test_SelectMechanism(t *testing.T) {
+    _, toTest, conf := initialiseConnection()
+    toTest.capabilities.SASL = []string { "PLAIN", "XOAUTH2" }
+
+    mech, err := toTest.selectMechanism()
+    if err != nil || mech.Name() != "PLAIN" {
+        t.Errorf("Expected PLAIN, got %v", err)
+    }
+
+    conf.Token = "token"
+    toTest.config = *conf
+    mech, err = toTest.selectMechanism()
+    if err != nil || mech.Name() != "XOAUTH2" {
+        t.Errorf("Expected XOAUTH2, got %v", err)
+    }
+
+    conf.SASLMechanism = "login"
+    toTest.config = *conf
+    mech, err = toTest.selectMechanism()
+    if err != nil || mech.Name() != "LOGIN" {
+        t.Errorf("Expected the forced LOGIN, got %v", err)
+    }
+
+    conf.SASLMechanism = ""
+    conf.Token = ""
+    toTest.config = *conf
+    toTest.capabilities.SASL = []string { "GSSAPI" }
+    _, err = toTest.selectMechanism()
+    if !errors.Is(err, ErrUnsupported) {
+        t.Errorf("Expected ErrUnsupported, got %v", err)
+    }
+}
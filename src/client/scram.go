@@ -0,0 +1,254 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// maxSCRAMIterations limits the iteration count a server can ask for. Servers use 4096
+// up to around a million, a higher count would keep the client busy computing the
+// salted password where cancelling the context can't stop it
+const maxSCRAMIterations = 4 * 1024 * 1024
+
+// channelBinding holds the channel binding type and data for the -PLUS mechanisms (RFC 5929, RFC 9266)
+type channelBinding struct {
+	name string
+	data []byte
+}
+
+// scramMechanism implements SCRAM-SHA-1 and SCRAM-SHA-256 (RFC 5802, RFC 7677) along
+// with the -PLUS variants. The password is used as is without SASLprep
+type scramMechanism struct {
+	name     string
+	hash     func() hash.Hash
+	username string
+	password string
+	// binding holds the channel binding for -PLUS mechanisms
+	binding *channelBinding
+	// bindingSupported is set when the client could bind but the server doesn't advertise -PLUS
+	bindingSupported bool
+	// nonce holds the client nonce, generated by Start if empty
+	nonce           string
+	gs2Header       string
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool
+	step            int
+}
+
+// NewSCRAMSHA1Mechanism returns a SCRAM-SHA-1 mechanism
+func NewSCRAMSHA1Mechanism(username string, password string) Mechanism {
+	return &scramMechanism{name: "SCRAM-SHA-1", hash: sha1.New, username: username, password: password}
+}
+
+// NewSCRAMSHA256Mechanism returns a SCRAM-SHA-256 mechanism
+func NewSCRAMSHA256Mechanism(username string, password string) Mechanism {
+	return &scramMechanism{name: "SCRAM-SHA-256", hash: sha256.New, username: username, password: password}
+}
+
+// NewSCRAMSHA1PlusMechanism returns a SCRAM-SHA-1-PLUS mechanism bound to the TLS connection
+func NewSCRAMSHA1PlusMechanism(username string, password string, state tls.ConnectionState) (Mechanism, error) {
+	binding, err := newChannelBinding(state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &scramMechanism{name: "SCRAM-SHA-1-PLUS", hash: sha1.New, username: username, password: password, binding: binding}, nil
+}
+
+// NewSCRAMSHA256PlusMechanism returns a SCRAM-SHA-256-PLUS mechanism bound to the TLS connection
+func NewSCRAMSHA256PlusMechanism(username string, password string, state tls.ConnectionState) (Mechanism, error) {
+	binding, err := newChannelBinding(state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &scramMechanism{name: "SCRAM-SHA-256-PLUS", hash: sha256.New, username: username, password: password, binding: binding}, nil
+}
+
+// newChannelBinding returns tls-exporter for TLS 1.3 and tls-unique for earlier versions
+func newChannelBinding(state tls.ConnectionState) (*channelBinding, error) {
+	if !state.HandshakeComplete {
+		return nil, errors.New("Channel binding requires a completed TLS handshake")
+	}
+
+	if state.Version >= tls.VersionTLS13 {
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		return &channelBinding{name: "tls-exporter", data: data}, nil
+	}
+
+	if len(state.TLSUnique) == 0 {
+		return nil, errors.New("Channel binding data unavailable for the TLS connection")
+	}
+
+	return &channelBinding{name: "tls-unique", data: state.TLSUnique}, nil
+}
+
+// Name returns the mechanism name, e.g. SCRAM-SHA-256
+func (m *scramMechanism) Name() string {
+	return m.name
+}
+
+// Start returns the client-first-message
+func (m *scramMechanism) Start() ([]byte, error) {
+	if m.nonce == "" {
+		random := make([]byte, 18)
+		_, err := rand.Read(random)
+		if err != nil {
+			return nil, err
+		}
+		m.nonce = base64.RawStdEncoding.EncodeToString(random)
+	}
+
+	switch {
+	case m.binding != nil:
+		m.gs2Header = "p=" + m.binding.name + ",,"
+	case m.bindingSupported:
+		m.gs2Header = "y,,"
+	default:
+		m.gs2Header = "n,,"
+	}
+
+	username := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(m.username)
+	m.clientFirstBare = "n=" + username + ",r=" + m.nonce
+	m.step = 0
+	m.verified = false
+
+	return []byte(m.gs2Header + m.clientFirstBare), nil
+}
+
+// Next returns the client-final-message for the server-first-message, then verifies the server-final-message
+func (m *scramMechanism) Next(challenge []byte) ([]byte, error) {
+	m.step++
+	switch m.step {
+	case 1:
+		return m.clientFinal(string(challenge))
+	case 2:
+		return []byte{}, m.verifyServerFinal(string(challenge))
+	}
+
+	return nil, fmt.Errorf("Unexpected challenge for %v", m.name)
+}
+
+// Verify checks the server signature was received and verified, a server that
+// accepts the exchange without proving it knows the password is rejected
+func (m *scramMechanism) Verify() error {
+	if !m.verified {
+		return fmt.Errorf("%v server signature was not verified", m.name)
+	}
+
+	return nil
+}
+
+// clientFinal builds the client-final-message with the client proof
+func (m *scramMechanism) clientFinal(serverFirst string) ([]byte, error) {
+	attrs := parseSCRAMAttributes(serverFirst)
+	if _, ok := attrs["m"]; ok {
+		return nil, fmt.Errorf("Unsupported %v extension in '%v'", m.name, serverFirst)
+	}
+
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, m.nonce) || len(nonce) == len(m.nonce) {
+		return nil, fmt.Errorf("Invalid %v server nonce '%v'", m.name, nonce)
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("Invalid %v salt '%v'", m.name, attrs["s"])
+	}
+
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("Invalid %v iteration count '%v'", m.name, attrs["i"])
+	}
+	if iterations > maxSCRAMIterations {
+		return nil, fmt.Errorf("%v iteration count %v is above the limit of %v", m.name, iterations, maxSCRAMIterations)
+	}
+
+	binding := []byte(m.gs2Header)
+	if m.binding != nil {
+		binding = append(binding, m.binding.data...)
+	}
+
+	clientFinalWithoutProof := "c=" + base64.StdEncoding.EncodeToString(binding) + ",r=" + nonce
+	authMessage := []byte(m.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+
+	saltedPassword := m.hi([]byte(m.password), salt, iterations)
+	clientKey := m.hmac(saltedPassword, []byte("Client Key"))
+	storedKey := m.hash()
+	storedKey.Write(clientKey)
+	clientSignature := m.hmac(storedKey.Sum(nil), authMessage)
+
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	serverKey := m.hmac(saltedPassword, []byte("Server Key"))
+	m.serverSignature = m.hmac(serverKey, authMessage)
+
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verifyServerFinal checks the server signature in the server-final-message
+func (m *scramMechanism) verifyServerFinal(serverFinal string) error {
+	attrs := parseSCRAMAttributes(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("%v failed with server error '%v'", m.name, e)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || subtle.ConstantTimeCompare(signature, m.serverSignature) != 1 {
+		return fmt.Errorf("%v server signature mismatch, the server may be spoofed", m.name)
+	}
+
+	m.verified = true
+	return nil
+}
+
+// hmac returns the HMAC of data using key
+func (m *scramMechanism) hmac(key []byte, data []byte) []byte {
+	mac := hmac.New(m.hash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// hi implements Hi() from RFC 5802, PBKDF2 with the output length of the hash
+func (m *scramMechanism) hi(password []byte, salt []byte, iterations int) []byte {
+	u := m.hmac(password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = m.hmac(password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
+
+// parseSCRAMAttributes splits a SCRAM message into its attributes, e.g. r=...,s=...
+func parseSCRAMAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, item := range strings.Split(msg, ",") {
+		if len(item) > 1 && item[1] == '=' {
+			attrs[item[:1]] = item[2:]
+		}
+	}
+
+	return attrs
+}
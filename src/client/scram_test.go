@@ -0,0 +1,193 @@
+package client
+
+import (
+    "bytes"
+    "crypto/tls"
+    "encoding/base64"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+// Test_SCRAMSHA1Mechanism checks the example exchange from RFC 5802
+func Test_SCRAMSHA1Mechanism(t *testing.T) {
+    toTest := NewSCRAMSHA1Mechanism("user", "pencil").(*scramMechanism)
+    toTest.nonce = "fyko+d2lbbFgONRv9qkxdawL"
+
+    first, err := toTest.Start()
+    if err != nil || string(first) != "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL" {
+        t.Errorf("Invalid client-first-message %q, error %v", first, err)
+    }
+
+    final, err := toTest.Next([]byte("r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096"))
+    if err != nil || string(final) != "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=" {
+        t.Errorf("Invalid client-final-message %q, error %v", final, err)
+    }
+
+    _, err = toTest.Next([]byte("v=rmF9pqV8S7suAoZWja4dJRkFsKQ="))
+    if err != nil {
+        t.Error(err)
+    }
+    if toTest.Verify() != nil {
+        t.Error("Expected the server to be verified")
+    }
+}
+
+// Test_SCRAMSHA256Mechanism checks the example exchange from RFC 7677
+func Test_SCRAMSHA256Mechanism(t *testing.T) {
+    toTest := NewSCRAMSHA256Mechanism("user", "pencil").(*scramMechanism)
+    toTest.nonce = "rOprNGfwEbeRWgbNEkqO"
+
+    toTest.Start()
+    final, err := toTest.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+    if err != nil || string(final) != "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+        t.Errorf("Invalid client-final-message %q, error %v", final, err)
+    }
+
+    _, err = toTest.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+    if err != nil {
+        t.Error(err)
+    }
+}
+
+// Test_SCRAMSpoofedServer checks that an incorrect or missing server signature is detected
+func Test_SCRAMSpoofedServer(t *testing.T) {
+    toTest := NewSCRAMSHA256Mechanism("user", "pencil").(*scramMechanism)
+    toTest.nonce = "rOprNGfwEbeRWgbNEkqO"
+
+    toTest.Start()
+    toTest.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+    if toTest.Verify() == nil {
+        t.Error("Expected the server to be unverified before the server-final-message")
+    }
+
+    _, err := toTest.Next([]byte("v=" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte { 1 }, 32))))
+    if err == nil || toTest.Verify() == nil {
+        t.Error("Expected a signature mismatch")
+    }
+}
+
+// Test_SCRAMInvalidServerFirst checks that invalid server-first-messages are rejected
+func Test_SCRAMInvalidServerFirst(t *testing.T) {
+    for _, serverFirst := range []string {
+        "r=other,s=QSXCR+Q6sek8bf92,i=4096",
+        "r=abc,s=QSXCR+Q6sek8bf92,i=4096",
+        "r=abcdef,s=!!,i=4096",
+        "r=abcdef,s=QSXCR+Q6sek8bf92,i=0",
+        "r=abcdef,s=QSXCR+Q6sek8bf92,i=2147483647",
+        "m=ext,r=abcdef,s=QSXCR+Q6sek8bf92,i=4096",
+    } {
+        toTest := NewSCRAMSHA1Mechanism("user", "pencil").(*scramMechanism)
+        toTest.nonce = "abc"
+        toTest.Start()
+
+        _, err := toTest.Next([]byte(serverFirst))
+        if err == nil {
+            t.Errorf("Expected an error for '%v'", serverFirst)
+        }
+    }
+}
+
+// Test_SCRAMIterationLimit checks an iteration count too high to compute in reasonable time is rejected before starting
+func Test_SCRAMIterationLimit(t *testing.T) {
+    toTest := NewSCRAMSHA256Mechanism("user", "pencil").(*scramMechanism)
+    toTest.nonce = "abc"
+    toTest.Start()
+
+    _, err := toTest.Next([]byte(fmt.Sprintf("r=abcdef,s=QSXCR+Q6sek8bf92,i=%d", maxSCRAMIterations + 1)))
+    if err == nil || !strings.Contains(err.Error(), "above the limit") {
+        t.Errorf("Expected the iteration count to be rejected, got %v", err)
+    }
+}
+
+// Test_SCRAMPlusTLSUnique checks tls-unique channel binding is sent for TLS 1.2
+func Test_SCRAMPlusTLSUnique(t *testing.T) {
+    state := tls.ConnectionState { HandshakeComplete: true, Version: tls.VersionTLS12, TLSUnique: []byte("unique") }
+    mech, err := NewSCRAMSHA1PlusMechanism("user", "pencil", state)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    toTest := mech.(*scramMechanism)
+    toTest.nonce = "abc"
+    first, _ := toTest.Start()
+    if !strings.HasPrefix(string(first), "p=tls-unique,,n=user") {
+        t.Errorf("Invalid client-first-message %q", first)
+    }
+
+    final, err := toTest.Next([]byte("r=abcdef,s=QSXCR+Q6sek8bf92,i=1"))
+    expected := "c=" + base64.StdEncoding.EncodeToString([]byte("p=tls-unique,,unique")) + ","
+    if err != nil || !strings.HasPrefix(string(final), expected) {
+        t.Errorf("Invalid client-final-message %q, error %v", final, err)
+    }
+
+    _, err = NewSCRAMSHA256PlusMechanism("user", "pencil", tls.ConnectionState {})
+    if err == nil {
+        t.Error("Expected an error without a completed handshake")
+    }
+}
+
+// Test_SCRAMPlusTLSExporter checks tls-exporter channel binding matches the server for TLS 1.3
+func Test_SCRAMPlusTLSExporter(t *testing.T) {
+    client, server := newTestTLSPipe(t, tls.VersionTLS13)
+
+    mech, err := NewSCRAMSHA256PlusMechanism("user", "pencil", client.ConnectionState())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    toTest := mech.(*scramMechanism)
+    toTest.nonce = "abc"
+    toTest.Start()
+    final, err := toTest.Next([]byte("r=abcdef,s=QSXCR+Q6sek8bf92,i=1"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    serverState := server.ConnectionState()
+    cb, err := serverState.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    expected := "c=" + base64.StdEncoding.EncodeToString(append([]byte("p=tls-exporter,,"), cb...)) + ","
+    if !strings.HasPrefix(string(final), expected) {
+        t.Errorf("Channel binding doesn't match the server, %q", final)
+    }
+}
+
+// Test_AuthSASLSCRAMNotVerified checks that a server accepting SCRAM without a server signature is rejected
+func Test_AuthSASLSCRAMNotVerified(t *testing.T) {
+    testConn, toTest, _ := initialiseConnection()
+
+    mech := NewSCRAMSHA1Mechanism("user", "pencil").(*scramMechanism)
+    mech.nonce = "fyko+d2lbbFgONRv9qkxdawL"
+
+    testConn.ToRead = append(testConn.ToRead, "+ " + base64.StdEncoding.EncodeToString([]byte("r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096")) + "\r\n")
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    err := toTest.AuthWith(mech)
+    if err == nil {
+        t.Error("Expected an error as the server wasn't verified")
+    }
+}
+
+// Test_AuthSASLSCRAMOk checks the full SCRAM exchange over AUTH
+func Test_AuthSASLSCRAMOk(t *testing.T) {
+    testConn, toTest, _ := initialiseConnection()
+
+    mech := NewSCRAMSHA1Mechanism("user", "pencil").(*scramMechanism)
+    mech.nonce = "fyko+d2lbbFgONRv9qkxdawL"
+
+    testConn.ToRead = append(testConn.ToRead, "+ " + base64.StdEncoding.EncodeToString([]byte("r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096")) + "\r\n")
+    testConn.ToRead = append(testConn.ToRead, "+ " + base64.StdEncoding.EncodeToString([]byte("v=rmF9pqV8S7suAoZWja4dJRkFsKQ=")) + "\r\n")
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+    testConn.ToRead = append(testConn.ToRead, capaResponse)
+    err := toTest.AuthWith(mech)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if testConn.Written[0] != "AUTH SCRAM-SHA-1 " + base64.StdEncoding.EncodeToString([]byte("n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL")) + "\r\n" || testConn.Written[2] != "\r\n" {
+        t.Errorf("Invalid exchange written %v", testConn.Written)
+    }
+}
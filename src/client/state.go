@@ -0,0 +1,77 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+// State is the state of the POP3 session (RFC 1939)
+type State int
+
+const (
+	// StateDisconnected is the state before Connect is called
+	StateDisconnected State = iota
+	// StateAuthorization is the state after the greeting until logged in
+	StateAuthorization
+	// StateTransaction is the state once logged in, messages can be listed and retrieved
+	StateTransaction
+	// StateUpdate is the state after QUIT is sent in the TRANSACTION state, the server
+	// removes the deleted messages
+	StateUpdate
+	// StateClosed is the state once the connection has been closed
+	StateClosed
+)
+
+// ErrInvalidState is returned when a command isn't valid in the current state, e.g.
+// RETR before logging in
+var ErrInvalidState = errors.New("command not valid in the current state")
+
+// String returns the state name, e.g. TRANSACTION
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "DISCONNECTED"
+	case StateAuthorization:
+		return "AUTHORIZATION"
+	case StateTransaction:
+		return "TRANSACTION"
+	case StateUpdate:
+		return "UPDATE"
+	case StateClosed:
+		return "CLOSED"
+	}
+
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// State returns the current state of the session
+func (c *Client) State() State {
+	c.ioLock.Lock()
+	defer c.ioLock.Unlock()
+
+	return c.state
+}
+
+// setState moves the session to state
+func (c *Client) setState(state State) {
+	c.ioLock.Lock()
+	defer c.ioLock.Unlock()
+
+	c.state = state
+}
+
+// checkState returns an error unless the session is in one of the valid states for command.
+// Commands on a session that isn't connected wrap ErrNotConnected, otherwise ErrInvalidState
+func (c *Client) checkState(command string, valid ...State) error {
+	for _, state := range valid {
+		if c.state == state {
+			return nil
+		}
+	}
+
+	if c.state == StateDisconnected || c.state == StateClosed {
+		return fmt.Errorf("%w: %v in the %v state", ErrNotConnected, command, c.state)
+	}
+
+	return fmt.Errorf("%w: %v in the %v state", ErrInvalidState, command, c.state)
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+    "errors"
+    "net"
+    "testing"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+)
+
+// Test_StateTransitions checks the session moves through the RFC 1939 states
+func Test_StateTransitions(t *testing.T) {
+    conf := config.NewConfig()
+    conf.UseTLS = false
+
+    testConn := NewTestConnection()
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n", capaResponse, "+OK\r\n", "+OK\r\n", capaResponse, "+OK\r\n")
+
+    toTest := NewClient(*conf)
+    toTest.Dialer = func(net string, server string) (net.Conn, error) {
+        return testConn, nil
+    }
+
+    if toTest.State() != StateDisconnected {
+        t.Errorf("Expected DISCONNECTED, got %v", toTest.State())
+    }
+
+    err := toTest.Connect()
+    if err != nil || toTest.State() != StateAuthorization {
+        t.Fatalf("Expected AUTHORIZATION, got %v %v", toTest.State(), err)
+    }
+
+    err = toTest.Auth()
+    if err != nil || toTest.State() != StateTransaction {
+        t.Fatalf("Expected TRANSACTION, got %v %v", toTest.State(), err)
+    }
+
+    err = toTest.Close()
+    if err != nil || toTest.State() != StateClosed {
+        t.Fatalf("Expected CLOSED, got %v %v", toTest.State(), err)
+    }
+}
+
+// Test_StateCommandsRejected checks commands invalid for the state aren't sent
+func Test_StateCommandsRejected(t *testing.T) {
+    testConn, toTest, _ := initialiseConnection()
+
+    _, err := toTest.Retrieve(1)
+    if !errors.Is(err, ErrInvalidState) {
+        t.Errorf("Expected ErrInvalidState, got %v", err)
+    }
+    _, err = toTest.RetrieveReader(1)
+    if !errors.Is(err, ErrInvalidState) {
+        t.Errorf("Expected ErrInvalidState, got %v", err)
+    }
+    err = toTest.Delete(1)
+    if !errors.Is(err, ErrInvalidState) {
+        t.Errorf("Expected ErrInvalidState, got %v", err)
+    }
+    err = toTest.Connect()
+    if !errors.Is(err, ErrInvalidState) {
+        t.Errorf("Expected ErrInvalidState, got %v", err)
+    }
+
+    toTest.state = StateTransaction
+    err = toTest.Auth()
+    if !errors.Is(err, ErrInvalidState) {
+        t.Errorf("Expected ErrInvalidState, got %v", err)
+    }
+
+    if len(testConn.Written) != 0 {
+        t.Errorf("Unexpected commands written %v", testConn.Written)
+    }
+}
+
+// Test_StateAfterClose checks commands after closing fail rather than panic
+func Test_StateAfterClose(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n")
+
+    err := toTest.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, _, err = toTest.Stat()
+    if !errors.Is(err, ErrNotConnected) {
+        t.Errorf("Expected ErrNotConnected, got %v", err)
+    }
+    err = toTest.Close()
+    if !errors.Is(err, ErrNotConnected) {
+        t.Errorf("Expected ErrNotConnected, got %v", err)
+    }
+}
+
+// Test_StateUpdateFailed checks a failure to remove deleted messages is returned
+func Test_StateUpdateFailed(t *testing.T) {
+    testConn, toTest, _ := initialiseSession()
+    testConn.ToRead = append(testConn.ToRead, "-ERR [SYS/TEMP] some deleted messages not removed\r\n")
+
+    err := toTest.Close()
+    var protoErr *ProtocolError
+    if !errors.As(err, &protoErr) || protoErr.Command != "QUIT" || !protoErr.Temporary() {
+        t.Errorf("Expected a QUIT error, got %v", err)
+    }
+    if toTest.State() != StateClosed || !testConn.Closed {
+        t.Error("Connection wasn't closed")
+    }
+}
+
+// Test_StateGreetingFailed checks a rejected connection is closed
+func Test_StateGreetingFailed(t *testing.T) {
+    conf := config.NewConfig()
+    conf.UseTLS = false
+
+    testConn := NewTestConnection()
+    testConn.ToRead = append(testConn.ToRead, "-ERR [SYS/TEMP] too busy\r\n")
+
+    toTest := NewClient(*conf)
+    toTest.Dialer = func(net string, server string) (net.Conn, error) {
+        return testConn, nil
+    }
+
+    err := toTest.Connect()
+    if !errors.Is(err, ErrTemporary) {
+        t.Errorf("Expected ErrTemporary, got %v", err)
+    }
+    if toTest.State() != StateClosed || !testConn.Closed {
+        t.Error("Connection wasn't closed")
+    }
+}
+
+// Test_StateString checks the state names
+func Test_StateString(t *testing.T) {
+    if StateUpdate.String() != "UPDATE" || State(9).String() != "State(9)" {
+        t.Errorf("Incorrect names %v %v", StateUpdate, State(9))
+    }
+}
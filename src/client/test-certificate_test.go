@@ -0,0 +1,80 @@
+package client
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "math/big"
+    "net"
+    "testing"
+    "time"
+)
+
+// newTestCertificate creates a self-signed certificate for localhost and 127.0.0.1
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.Certificate) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    template := &x509.Certificate {
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name { CommonName: "localhost" },
+        DNSNames: []string { "localhost" },
+        IPAddresses: []net.IP { net.ParseIP("127.0.0.1"), net.ParseIP("::1") },
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage: []x509.ExtKeyUsage { x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth },
+        BasicConstraintsValid: true,
+        IsCA: true,
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return tls.Certificate { Certificate: [][]byte { der }, PrivateKey: key, Leaf: cert }, cert
+}
+
+// newTestTLSPipe returns both ends of a TLS connection over net.Pipe after completing the handshake,
+// the underlying pipe is closed when the test finishes
+func newTestTLSPipe(t *testing.T, version uint16) (*tls.Conn, *tls.Conn) {
+    cert, parsed := newTestCertificate(t)
+    pool := x509.NewCertPool()
+    pool.AddCert(parsed)
+
+    clientConn, serverConn := net.Pipe()
+    t.Cleanup(func() {
+        clientConn.Close()
+        serverConn.Close()
+    })
+
+    server := tls.Server(serverConn, &tls.Config { Certificates: []tls.Certificate { cert }, MinVersion: version, MaxVersion: version, SessionTicketsDisabled: true })
+    client := tls.Client(clientConn, &tls.Config { ServerName: "localhost", RootCAs: pool, MinVersion: version, MaxVersion: version })
+
+    errs := make(chan error, 1)
+    go func() {
+        errs <- server.Handshake()
+    }()
+
+    err := client.Handshake()
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = <-errs
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return client, server
+}
@@ -3,6 +3,7 @@ package client
 import (
     "time"
     "net"
+    "os"
     "errors"
 )
 
@@ -18,7 +19,8 @@ type TestConnection struct {
     WriteError error
     // CloseError holds an error to return upon Close
     CloseError error
-    // WriteCount allows the length to be set when calling write
+    // WriteCount limits the length written by each call to write, the data written is
+    // still recorded in Written
     WriteCount int
     // Closed holds whether close has been called
     Closed bool
@@ -30,6 +32,10 @@ type TestConnection struct {
     ThrowReadErrorAfter int
     // ThrowWriteErrorAfter is the TimesWriteCalled to throw the error after
     ThrowWriteErrorAfter int
+    // ReadDeadline holds the last read deadline set, zero if there isn't one
+    ReadDeadline time.Time
+    // WriteDeadline holds the last write deadline set, zero if there isn't one
+    WriteDeadline time.Time
 }
 
 // NewTestConnection returns a new TestConnection
@@ -57,6 +63,10 @@ func (c *TestConnection) Read(b []byte) (n int, err error) {
         return 0, c.ReadError
     }
 
+    if !c.ReadDeadline.IsZero() && time.Now().After(c.ReadDeadline) {
+        return 0, os.ErrDeadlineExceeded
+    }
+
     if len(c.ToRead) == 0 {
         return 0, nil
     } 
@@ -87,13 +97,18 @@ func (c *TestConnection) Write(b []byte) (n int, err error) {
         return 0, c.WriteError
     }
 
-    if c.WriteCount > -1 {
-        return c.WriteCount, nil
+    if !c.WriteDeadline.IsZero() && time.Now().After(c.WriteDeadline) {
+        return 0, os.ErrDeadlineExceeded
+    }
+
+    written := len(b)
+    if c.WriteCount > -1 && c.WriteCount < written {
+        written = c.WriteCount
     }
 
     c.TimesWriteCalled++
-    c.Written = append(c.Written, string(b))
-    return len(b), nil
+    c.Written = append(c.Written, string(b[:written]))
+    return written, nil
 }
 
 // Close closes the connection.
@@ -116,17 +131,22 @@ func (c *TestConnection) RemoteAddr() net. Addr {
     return nil
 }
 
-// SetDeadline not yet implemented
+// SetDeadline sets both the read and write deadlines, reads and writes after the
+// deadline return os.ErrDeadlineExceeded
 func (c *TestConnection) SetDeadline(t time.Time) error {
-    return errors.New("Not implemented")
+    c.ReadDeadline = t
+    c.WriteDeadline = t
+    return nil
 }
 
-// SetReadDeadline not yet implemented
+// SetReadDeadline sets the read deadline
 func (c *TestConnection) SetReadDeadline(t time.Time) error {
-    return errors.New("Not implemented")
+    c.ReadDeadline = t
+    return nil
 }
 
-// SetWriteDeadline not yet implemented
+// SetWriteDeadline sets the write deadline
 func (c *TestConnection) SetWriteDeadline(t time.Time) error {
-    return errors.New("Not implemented")
-}
\ No newline at end of file
+    c.WriteDeadline = t
+    return nil
+}
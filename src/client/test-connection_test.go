@@ -3,6 +3,7 @@ package client
 import (
     "testing"
     "errors"
+    "os"
     "time"
 )
 
@@ -68,30 +69,45 @@ func Test_RemoteAddr(t *testing.T) {
     }
 }
 
-// Test_SetDeadline tests an error is returned
+// Test_SetDeadline tests both deadlines are set and enforced
 func Test_SetDeadline(t *testing.T) {
-    toTest := NewTestConnection()  
-    ret := toTest.SetDeadline(time.Now())
-    if ret == nil {
-        t.Error("Expected an error to be returned")
+    toTest := NewTestConnection()
+    toTest.ToRead = append(toTest.ToRead, "+OK\r\n")
+
+    deadline := time.Now().Add(-time.Second)
+    ret := toTest.SetDeadline(deadline)
+    if ret != nil || !toTest.ReadDeadline.Equal(deadline) || !toTest.WriteDeadline.Equal(deadline) {
+        t.Error("Expected the deadlines to be set")
+    }
+
+    _, err := toTest.Read(make([]byte, 10))
+    if !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Errorf("Expected os.ErrDeadlineExceeded, got %v", err)
+    }
+
+    _, err = toTest.Write([]byte("a"))
+    if !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Errorf("Expected os.ErrDeadlineExceeded, got %v", err)
     }
 }
 
-// Test_SetReadDeadline tests an error is returned
+// Test_SetReadDeadline tests the read deadline is set
 func Test_SetReadDeadline(t *testing.T) {
-    toTest := NewTestConnection()  
-    ret := toTest.SetReadDeadline(time.Now())
-    if ret == nil {
-        t.Error("Expected an error to be returned")
+    toTest := NewTestConnection()
+    deadline := time.Now().Add(time.Minute)
+    ret := toTest.SetReadDeadline(deadline)
+    if ret != nil || !toTest.ReadDeadline.Equal(deadline) || !toTest.WriteDeadline.IsZero() {
+        t.Error("Expected only the read deadline to be set")
     }
 }
 
-// Test_SetWriteDeadline tests an error is returned
+// Test_SetWriteDeadline tests the write deadline is set
 func Test_SetWriteDeadline(t *testing.T) {
-    toTest := NewTestConnection()  
-    ret := toTest.SetWriteDeadline(time.Now())
-    if ret == nil {
-        t.Error("Expected an error to be returned")
+    toTest := NewTestConnection()
+    deadline := time.Now().Add(time.Minute)
+    ret := toTest.SetWriteDeadline(deadline)
+    if ret != nil || !toTest.WriteDeadline.Equal(deadline) || !toTest.ReadDeadline.IsZero() {
+        t.Error("Expected only the write deadline to be set")
     }
 }
 
@@ -133,4 +149,13 @@ func Test_Write(t *testing.T) {
     if written != 0 || err != nil {
         t.Errorf("Unexpected response when writing")
     }
+
+    toTest.WriteCount = 2
+    written, err = toTest.Write([]byte("abc"))
+    if written != 2 || err != nil {
+        t.Errorf("Unexpected response when writing")
+    }
+    if len(toTest.Written) != 2 || toTest.Written[0] != "" || toTest.Written[1] != "ab" {
+        t.Errorf("Partial writes weren't recorded, %q", toTest.Written)
+    }
 }
\ No newline at end of file
@@ -0,0 +1,180 @@
+package client
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/pem"
+    "errors"
+    "net"
+    "net/textproto"
+    "testing"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+)
+
+// newTLSConfigClient returns a client for implicit TLS dialing a server over net.Pipe that
+// requires a client certificate signed by its own CA
+func newTLSConfigClient(t *testing.T, conf *config.Config) (*Client, tls.Certificate) {
+    cert, parsed := newTestCertificate(t)
+    pool := x509.NewCertPool()
+    pool.AddCert(parsed)
+    serverConf := &tls.Config { Certificates: []tls.Certificate { cert }, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool }
+
+    toTest := NewClient(*conf)
+    toTest.TLSDialer = func(network string, addr string, tlsConf *tls.Config) (net.Conn, error) {
+        clientConn, serverConn := net.Pipe()
+        t.Cleanup(func() {
+            clientConn.Close()
+            serverConn.Close()
+        })
+
+        go func() {
+            server := tls.Server(serverConn, serverConf)
+            if server.Handshake() != nil {
+                return
+            }
+
+            text := textproto.NewConn(server)
+            text.PrintfLine("+OK ready")
+            text.ReadLine()
+            text.PrintfLine("-ERR no CAPA")
+        }()
+
+        conn := tls.Client(clientConn, tlsConf)
+        return conn, conn.Handshake()
+    }
+
+    return toTest, cert
+}
+
+// Test_ConnectTLSConfigApplied checks the CA, client certificate and server name are used for implicit TLS
+func Test_ConnectTLSConfigApplied(t *testing.T) {
+    conf := config.NewConfig()
+    conf.Server = "192.0.2.10"
+    conf.TLSServerName = "localhost"
+    toTest, cert := newTLSConfigClient(t, conf)
+
+    keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    certPEM := pem.EncodeToMemory(&pem.Block { Type: "CERTIFICATE", Bytes: cert.Certificate[0] })
+    conf.TLSCAPEM = certPEM
+    conf.TLSCertPEM = certPEM
+    conf.TLSKeyPEM = pem.EncodeToMemory(&pem.Block { Type: "PRIVATE KEY", Bytes: keyDER })
+    toTest.config = *conf
+
+    err = toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if toTest.Greeting() != "+OK ready" {
+        t.Errorf("Incorrect greeting %v", toTest.Greeting())
+    }
+}
+
+// Test_ConnectTLSUntrusted checks the server certificate is verified
+func Test_ConnectTLSUntrusted(t *testing.T) {
+    conf := config.NewConfig()
+    conf.Server = "localhost"
+    toTest, _ := newTLSConfigClient(t, conf)
+
+    err := toTest.Connect()
+    var unknown x509.UnknownAuthorityError
+    if err == nil || !errors.As(err, &unknown) {
+        t.Errorf("Expected an unknown authority error, got %v", err)
+    }
+}
+
+// Test_ConnectTLSConfigInvalid checks invalid TLS settings are reported before connecting
+func Test_ConnectTLSConfigInvalid(t *testing.T) {
+    conf := config.NewConfig()
+    conf.TLSCAPEM = []byte("not a certificate")
+
+    toTest := NewClient(*conf)
+    toTest.TLSDialer = func(network string, addr string, tlsConf *tls.Config) (net.Conn, error) {
+        t.Error("Dialled with invalid TLS settings")
+        return nil, nil
+    }
+
+    err := toTest.Connect()
+    if err == nil {
+        t.Error("No error returned")
+    }
+}
+
+// Test_STLSTLSConfigApplied checks the TLS settings are used when upgrading with STLS
+func Test_STLSTLSConfigApplied(t *testing.T) {
+    conf := config.NewConfig()
+    conf.TLSMode = config.TLSStartRequired
+    conf.Server = "192.0.2.10"
+    conf.TLSServerName = "mail.example.com"
+    conf.TLSMinVersion = tls.VersionTLS13
+
+    testConn := NewTestConnection()
+    testConn.ToRead = append(testConn.ToRead, "+OK\r\n", "+OK\r\nSTLS\r\n.\r\n", "+OK begin TLS\r\n", capaResponse)
+
+    toTest := NewClient(*conf)
+    toTest.Dialer = func(net string, server string) (net.Conn, error) {
+        return testConn, nil
+    }
+    toTest.TLSClient = func(conn net.Conn, tlsConf *tls.Config) net.Conn {
+        if tlsConf.ServerName != "mail.example.com" || tlsConf.MinVersion != tls.VersionTLS13 {
+            t.Errorf("TLS settings not applied %+v", tlsConf)
+        }
+        return conn
+    }
+
+    err := toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Test_ConnectTLSPinned checks a server matching a pin is accepted without trusting its CA
+func Test_ConnectTLSPinned(t *testing.T) {
+    conf := config.NewConfig()
+    conf.Server = "localhost"
+    toTest, cert := newTLSConfigClient(t, conf)
+
+    parsed, err := x509.ParseCertificate(cert.Certificate[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conf.TLSCertPEM = pem.EncodeToMemory(&pem.Block { Type: "CERTIFICATE", Bytes: cert.Certificate[0] })
+    conf.TLSKeyPEM = pem.EncodeToMemory(&pem.Block { Type: "PRIVATE KEY", Bytes: keyDER })
+    conf.TLSPins = []string { config.SPKIPin(parsed) }
+    toTest.config = *conf
+
+    err = toTest.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    pins := toTest.ServerPins()
+    if len(pins) != 1 || pins[0] != config.SPKIPin(parsed) {
+        t.Errorf("Incorrect server pins %v", pins)
+    }
+}
+
+// Test_ConnectTLSPinMismatch checks a server not matching the pins is rejected with a PinError
+func Test_ConnectTLSPinMismatch(t *testing.T) {
+    _, other := newTestCertificate(t)
+
+    conf := config.NewConfig()
+    conf.Server = "localhost"
+    conf.TLSPins = []string { config.SPKIPin(other) }
+    toTest, _ := newTLSConfigClient(t, conf)
+
+    err := toTest.Connect()
+    var pinErr *config.PinError
+    if !errors.As(err, &pinErr) {
+        t.Fatalf("Expected a pin error, got %v", err)
+    }
+    if pinErr.Server != "localhost" || len(pinErr.Got) != 1 {
+        t.Errorf("Unexpected pin error %+v", pinErr)
+    }
+}
@@ -0,0 +1,329 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transcriptTime is the layout of the timestamp starting each transcript record, fixed
+// width so transcripts line up
+const transcriptTime = "2006-01-02T15:04:05.000000Z"
+
+// WithTranscript records the session to w, e.g. to report a server quirk or to replay
+// it in a test using NewReplayConn. Each line is a record holding a UTC timestamp, the
+// direction and the data exactly as sent, quoted as a Go string:
+//
+//	2024-01-02T15:04:05.000000Z C "STAT\r\n"
+//	2024-01-02T15:04:05.012345Z S "+OK 2 320\r\n"
+//	2024-01-02T15:04:05.012400Z * connection closed by server
+//
+// C records are sent by the client, S records by the server and * records are notes
+// such as connecting or a read error. Credentials are replaced with [redacted]. Errors
+// writing to w are ignored so they don't affect the session
+func WithTranscript(w io.Writer) Option {
+	return func(c *Client) {
+		if w == nil {
+			c.transcript = nil
+			return
+		}
+		c.transcript = &transcript{w: w, now: time.Now}
+	}
+}
+
+// transcript writes the records of a session, methods do nothing on a nil transcript
+type transcript struct {
+	lock sync.Mutex
+	w    io.Writer
+	now  func() time.Time
+	// partial holds the start of a server line not yet received in full
+	partial []byte
+}
+
+// sent records the lines of a command, or commands when pipelined
+func (t *transcript) sent(data string, inAuth bool) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for len(data) > 0 {
+		line := data
+		if end := strings.IndexByte(data, '\n'); end >= 0 {
+			line = data[:end+1]
+		}
+		data = data[len(line):]
+
+		content := strings.TrimRight(line, "\r\n")
+		t.record("C", redact(content, inAuth)+line[len(content):])
+	}
+}
+
+// received records the complete server lines in data, holding back any partial line
+// until the rest arrives
+func (t *transcript) received(data []byte, inAuth bool) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.partial = append(t.partial, data...)
+	for {
+		end := bytes.IndexByte(t.partial, '\n')
+		if end < 0 {
+			break
+		}
+
+		t.receivedLine(string(t.partial[:end+1]), inAuth)
+		t.partial = t.partial[end+1:]
+	}
+
+	// overlong lines are split rather than held in memory
+	if len(t.partial) > maxLineLength {
+		t.receivedLine(string(t.partial), inAuth)
+		t.partial = nil
+	}
+}
+
+// receivedLine records a line from the server, redacting SASL challenges which can
+// echo the credentials back
+func (t *transcript) receivedLine(line string, inAuth bool) {
+	content := strings.TrimRight(line, "\r\n")
+	if inAuth && (content == "+" || strings.HasPrefix(content, "+ ")) {
+		line = "+ [redacted]" + line[len(content):]
+	}
+
+	t.record("S", line)
+}
+
+// note records an event, any partial server line is recorded first so the transcript
+// shows a response cut short
+func (t *transcript) note(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.partial) > 0 {
+		t.record("S", string(t.partial))
+		t.partial = nil
+	}
+
+	line := fmt.Sprintf(format, args...)
+	fmt.Fprintf(t.w, "%v * %v\n", t.now().UTC().Format(transcriptTime), strings.ReplaceAll(line, "\n", " "))
+}
+
+// record writes a single record
+func (t *transcript) record(direction string, data string) {
+	fmt.Fprintf(t.w, "%v %v %v\n", t.now().UTC().Format(transcriptTime), direction, strconv.Quote(data))
+}
+
+// transcriptRecord is a C or S record read from a transcript
+type transcriptRecord struct {
+	fromClient bool
+	data       string
+}
+
+// ReplayConn plays back a transcript recorded using WithTranscript as a net.Conn, acting
+// as the server for regression tests. The server data is returned once the client has
+// sent the commands recorded before it, and each command must match the recording with
+// any [redacted] part matching anything. Notes are ignored and once the transcript has
+// been played reads return io.EOF. To replay a session upgraded using STLS set the
+// client's TLSClient to return the connection as it is. It's not safe for concurrent use
+type ReplayConn struct {
+	records []transcriptRecord
+	// readPos is the next record to read server data from, offset is the data already read from it
+	readPos int
+	offset  int
+	// writePos is the record after the last command matched
+	writePos int
+	// partial holds the start of a command written without its line ending
+	partial []byte
+	closed  bool
+}
+
+// NewReplayConn reads the transcript from r. Blank lines and lines starting with # are
+// skipped so transcripts used as test fixtures can be annotated
+func NewReplayConn(r io.Reader) (*ReplayConn, error) {
+	conn := &ReplayConn{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 4*maxLineLength)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Invalid transcript record on line %v", number)
+		}
+		if fields[1] == "*" {
+			continue
+		}
+		if fields[1] != "C" && fields[1] != "S" {
+			return nil, fmt.Errorf("Invalid transcript direction %q on line %v", fields[1], number)
+		}
+
+		data, err := strconv.Unquote(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid transcript data on line %v: %w", number, err)
+		}
+		conn.records = append(conn.records, transcriptRecord{fromClient: fields[1] == "C", data: data})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Done returns whether the whole transcript has been played
+func (c *ReplayConn) Done() bool {
+	for pos := c.readPos; pos < len(c.records); pos++ {
+		if !c.records[pos].fromClient || pos >= c.writePos {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Read returns the server data recorded before the next command the client hasn't sent,
+// returning an error if there's none as the client would wait forever
+func (c *ReplayConn) Read(b []byte) (int, error) {
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	read := 0
+	for read < len(b) && c.readPos < len(c.records) {
+		record := c.records[c.readPos]
+		if record.fromClient {
+			if c.readPos >= c.writePos {
+				break
+			}
+			c.readPos++
+			continue
+		}
+
+		copied := copy(b[read:], record.data[c.offset:])
+		read += copied
+		c.offset += copied
+		if c.offset == len(record.data) {
+			c.readPos++
+			c.offset = 0
+		}
+	}
+
+	if read > 0 {
+		return read, nil
+	}
+	if c.readPos == len(c.records) {
+		return 0, io.EOF
+	}
+
+	return 0, fmt.Errorf("Transcript is waiting for the client to send %q", c.records[c.readPos].data)
+}
+
+// Write checks each complete command line written against the transcript
+func (c *ReplayConn) Write(b []byte) (int, error) {
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	c.partial = append(c.partial, b...)
+	for {
+		end := bytes.IndexByte(c.partial, '\n')
+		if end < 0 {
+			break
+		}
+
+		line := string(c.partial[:end+1])
+		c.partial = c.partial[end+1:]
+
+		next := c.nextCommand(c.writePos)
+		if next == len(c.records) {
+			return 0, fmt.Errorf("Transcript has ended but the client sent %q", line)
+		}
+		if !commandMatches(c.records[next].data, line) {
+			return 0, fmt.Errorf("Transcript expected the client to send %q but got %q", c.records[next].data, line)
+		}
+		c.writePos = next + 1
+	}
+
+	return len(b), nil
+}
+
+// nextCommand returns the index of the first command recorded from pos, or the number
+// of records if there isn't one
+func (c *ReplayConn) nextCommand(pos int) int {
+	for pos < len(c.records) && !c.records[pos].fromClient {
+		pos++
+	}
+
+	return pos
+}
+
+// commandMatches checks the line sent matches the recorded command, where anything from
+// [redacted] onwards matches the rest of the line
+func commandMatches(recorded string, line string) bool {
+	prefix, _, redacted := strings.Cut(recorded, "[redacted]")
+	if redacted {
+		return strings.HasPrefix(line, prefix)
+	}
+
+	return recorded == line
+}
+
+// Close closes the connection
+func (c *ReplayConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// LocalAddr returns the local network address
+func (c *ReplayConn) LocalAddr() net.Addr {
+	return replayAddr{}
+}
+
+// RemoteAddr returns the remote network address
+func (c *ReplayConn) RemoteAddr() net.Addr {
+	return replayAddr{}
+}
+
+// SetDeadline does nothing as reads and writes never block
+func (c *ReplayConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline does nothing as reads never block
+func (c *ReplayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline does nothing as writes never block
+func (c *ReplayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// replayAddr is the address of both ends of a ReplayConn
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "transcript" }
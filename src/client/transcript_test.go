@@ -0,0 +1,247 @@
+package client
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "net"
+    "regexp"
+    "strings"
+    "testing"
+    "time"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+)
+
+// transcriptLine matches a record written by WithTranscript
+var transcriptLine = regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z ([CS] "|\* )`)
+
+// recordSession runs a session against a pop3test mailbox recording it, returning the
+// transcript and the message retrieved
+func recordSession(t *testing.T, conf func(*config.Config)) (string, *Email) {
+    server, _ := newTestMailbox(t, 2)
+    mailboxConf := server.Config("user")
+    if conf != nil {
+        conf(mailboxConf)
+    }
+
+    var transcript bytes.Buffer
+    toTest := NewClient(*mailboxConf, WithTranscript(&transcript))
+    toTest.Dialer = server.Dial
+    connectMailbox(t, toTest)
+
+    email := runTranscriptCommands(t, toTest)
+    return transcript.String(), email
+}
+
+// runTranscriptCommands runs the commands recorded and replayed by the tests
+func runTranscriptCommands(t *testing.T, toTest *Client) *Email {
+    count, _, err := toTest.Stat()
+    if err != nil || count != 2 {
+        t.Errorf("Unexpected STAT %v, %v", count, err)
+    }
+
+    err = toTest.RetrieveMany([]int { 1, 2 }, func(ID int, body io.Reader) error {
+        _, err := io.Copy(io.Discard, body)
+        return err
+    })
+    if err != nil {
+        t.Error(err)
+    }
+
+    email, err := toTest.Retrieve(2)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = toTest.Close()
+    if err != nil {
+        t.Error(err)
+    }
+
+    return email
+}
+
+// Test_TranscriptRecords checks every command and response is recorded in order with the credentials redacted
+func Test_TranscriptRecords(t *testing.T) {
+    transcript, _ := recordSession(t, nil)
+
+    lines := strings.Split(strings.TrimSuffix(transcript, "\n"), "\n")
+    for _, line := range lines {
+        if !transcriptLine.MatchString(line) {
+            t.Errorf("Invalid transcript line %q", line)
+        }
+    }
+
+    if strings.Contains(transcript, "secret") {
+        t.Errorf("Password recorded in %v", transcript)
+    }
+
+    expected := []string {
+        `* connected to `,
+        `S "+OK `,
+        `C "CAPA\r\n"`,
+        `S "SASL PLAIN\r\n"`,
+        `C "USER [redacted]\r\n"`,
+        `C "PASS [redacted]\r\n"`,
+        `C "STAT\r\n"`,
+        `C "RETR 1\r\n"`,
+        `C "RETR 2\r\n"`,
+        `S "..line 2\r\n"`,
+        `S ".\r\n"`,
+        `C "QUIT\r\n"`,
+        `* connection closed`,
+    }
+    position := 0
+    for _, line := range lines {
+        if position < len(expected) && strings.Contains(line, expected[position]) {
+            position++
+        }
+    }
+    if position != len(expected) {
+        t.Errorf("Expected %q in order in\n%v", expected[position], transcript)
+    }
+}
+
+// Test_TranscriptRedactsSASL checks SASL responses aren't recorded
+func Test_TranscriptRedactsSASL(t *testing.T) {
+    transcript, _ := recordSession(t, func(conf *config.Config) {
+        conf.AuthMethod = config.AuthSASL
+        conf.SASLMechanism = "PLAIN"
+    })
+
+    if !strings.Contains(transcript, `C "AUTH PLAIN`) || !strings.Contains(transcript, `[redacted]\r\n"`) {
+        t.Errorf("Expected AUTH to be recorded redacted in\n%v", transcript)
+    }
+    if strings.Contains(transcript, "c2VjcmV0") || strings.Contains(transcript, "secret") {
+        t.Errorf("Credentials recorded in\n%v", transcript)
+    }
+}
+
+// Test_TranscriptReplay checks a recorded session replays giving the same results
+func Test_TranscriptReplay(t *testing.T) {
+    transcript, recorded := recordSession(t, nil)
+
+    replay, err := NewReplayConn(strings.NewReader("# recorded by Test_TranscriptReplay\n\n" + transcript))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    conf := config.NewConfig()
+    conf.UseTLS = false
+    conf.Username = "someone"
+    conf.Password = "else"
+    toTest := NewClient(*conf)
+    toTest.Dialer = func(network string, addr string) (net.Conn, error) {
+        return replay, nil
+    }
+    connectMailbox(t, toTest)
+
+    if replay.Done() {
+        t.Error("Expected the replay not to be done")
+    }
+
+    email := runTranscriptCommands(t, toTest)
+    if email.Message != recorded.Message {
+        t.Errorf("Replayed message %q doesn't match %q", email.Message, recorded.Message)
+    }
+    if !replay.Done() {
+        t.Error("Expected the whole transcript to be replayed")
+    }
+}
+
+// Test_TranscriptCutShort checks a response cut short by the server is recorded along with the disconnect
+func Test_TranscriptCutShort(t *testing.T) {
+    conn := newFaultMailbox()
+    conn.Chunks = []int { 1 }
+
+    var transcript bytes.Buffer
+    toTest := newFaultClient(t, *config.NewConfig(), conn)
+    WithTranscript(&transcript)(toTest)
+    toTest.transcript.now = func() time.Time {
+        return time.Date(2024, 1, 2, 15, 4, 5, 6000, time.FixedZone("BST", 3600))
+    }
+    connectFault(t, toTest)
+
+    conn.Inject("RETR", connFault { Disconnect: true, After: 20 })
+    toTest.Retrieve(1)
+
+    expected := "2024-01-02T14:04:05.000006Z C \"RETR 1\\r\\n\"\n" +
+        "2024-01-02T14:04:05.000006Z S \"+OK 44 octets\\r\\n\"\n" +
+        "2024-01-02T14:04:05.000006Z S \"Subje\"\n" +
+        "2024-01-02T14:04:05.000006Z * connection closed by server\n"
+    if !strings.HasSuffix(transcript.String(), expected) {
+        t.Errorf("Unexpected transcript\n%v", transcript.String())
+    }
+}
+
+// Test_ReplayMismatch checks the client sending something other than the recording is an error
+func Test_ReplayMismatch(t *testing.T) {
+    transcript := `2024-01-02T15:04:05.000000Z S "+OK ready\r\n"
+2024-01-02T15:04:05.000000Z C "PASS [redacted]\r\n"
+2024-01-02T15:04:05.000000Z C "STAT\r\n"
+2024-01-02T15:04:05.000000Z * a note
+2024-01-02T15:04:05.000000Z S "+OK\r\n"
+2024-01-02T15:04:05.000000Z S "+OK 1 2\r\n"
+`
+    toTest, err := NewReplayConn(strings.NewReader(transcript))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    buff := make([]byte, 64)
+    read, err := toTest.Read(buff)
+    if err != nil || string(buff[:read]) != "+OK ready\r\n" {
+        t.Errorf("Unexpected read %q, %v", buff[:read], err)
+    }
+    _, err = toTest.Read(buff)
+    if err == nil || !strings.Contains(err.Error(), "waiting for the client") {
+        t.Errorf("Expected an error reading before the command is sent, got %v", err)
+    }
+
+    written, err := toTest.Write([]byte("PASS anything\r\nST"))
+    if written != 17 || err != nil {
+        t.Errorf("Unexpected write %v, %v", written, err)
+    }
+    _, err = toTest.Write([]byte("AT 1\r\n"))
+    if err == nil || !strings.Contains(err.Error(), `expected the client to send "STAT\r\n"`) {
+        t.Errorf("Expected a mismatch, got %v", err)
+    }
+
+    _, err = toTest.Write([]byte("STAT\r\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    read, _ = toTest.Read(buff)
+    if string(buff[:read]) != "+OK\r\n+OK 1 2\r\n" || !toTest.Done() {
+        t.Errorf("Unexpected read %q", buff[:read])
+    }
+    _, err = toTest.Read(buff)
+    if err != io.EOF {
+        t.Errorf("Expected io.EOF, got %v", err)
+    }
+
+    _, err = toTest.Write([]byte("QUIT\r\n"))
+    if err == nil {
+        t.Error("Expected an error writing after the transcript")
+    }
+
+    toTest.Close()
+    _, err = toTest.Read(buff)
+    if !errors.Is(err, net.ErrClosed) {
+        t.Errorf("Expected net.ErrClosed, got %v", err)
+    }
+}
+
+// Test_NewReplayConnErrors checks invalid transcripts are rejected
+func Test_NewReplayConnErrors(t *testing.T) {
+    for _, transcript := range []string {
+        "2024-01-02T15:04:05.000000Z",
+        `2024-01-02T15:04:05.000000Z X "STAT\r\n"`,
+        `2024-01-02T15:04:05.000000Z C STAT`,
+    } {
+        _, err := NewReplayConn(strings.NewReader(transcript))
+        if err == nil {
+            t.Errorf("Expected an error for %q", transcript)
+        }
+    }
+}
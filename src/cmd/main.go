@@ -4,19 +4,80 @@ import (
     "github.com/benmj87/gogo-pop3gadget/src/client"
     "github.com/benmj87/gogo-pop3gadget/src/config"
     "flag"
+    "fmt"
+    "io"
+    "os"
+    "strings"
 )
 
 // entry point for testing/development
 func main() {
     pass := flag.String("Password", "", "Password to auth with")
     username := flag.String("Username", "", "Username to auth with")
+    token := flag.String("Token", "", "OAuth 2.0 access token to auth with using SASL")
+    verbose := flag.Bool("Verbose", false, "Log the POP3 exchange to stderr, credentials are redacted")
+    server := flag.String("Server", "", "Server to connect to, defaults to pop.gmail.com")
+    port := flag.Int("Port", 0, "Port to connect to, defaults to 995")
+    pins := flag.String("Pins", "", "Comma separated SHA-256 pins of the server public key to accept instead of the CAs")
+    proxy := flag.String("Proxy", "", "Proxy URL to connect through, e.g. socks5://host:1080, defaults to ALL_PROXY")
+    printPin := flag.Bool("PrintPin", false, "Print the pins of the certificates presented by the server and exit")
+    transcript := flag.String("Transcript", "", "File to record the POP3 exchange to, credentials are redacted")
     flag.Parse()
 
-    config := config.NewConfig()
-    config.Password = *pass
-    config.Username = *username
+    conf := config.NewConfig()
+    if *server != "" {
+        conf.Server = *server
+    }
+    if *port != 0 {
+        conf.Port = *port
+    }
+    conf.Proxy = *proxy
+    conf.ProxyFromEnvironment = true
+    if *pins != "" {
+        conf.TLSPins = strings.Split(*pins, ",")
+    }
+    conf.Password = *pass
+    conf.Username = *username
+    if *token != "" {
+        conf.Token = *token
+        conf.AuthMethod = config.AuthSASL
+    }
+
+    level := client.LevelWarn
+    if *verbose {
+        level = client.LevelDebug
+    }
+
+    opts := []client.Option { client.WithLogger(client.NewTextLogger(os.Stderr, level)) }
+    if *transcript != "" {
+        file, err := os.Create(*transcript)
+        if err != nil {
+            panic(err)
+        }
+        defer file.Close()
+
+        opts = append(opts, client.WithTranscript(file))
+    }
 
-    client := client.NewClient(*config)
+    if *printPin {
+        // the certificate is only being inspected so it doesn't need to be trusted
+        conf.TLSPins = nil
+        conf.TLSInsecureSkipVerify = true
+
+        client := client.NewClient(*conf, opts...)
+        err := client.Connect()
+        if err != nil {
+            panic(err)
+        }
+        defer client.Close()
+
+        for _, pin := range client.ServerPins() {
+            fmt.Println(pin)
+        }
+        return
+    }
+
+    client := client.NewClient(*conf, opts...)
     err := client.Connect()
     if err != nil {
         panic(err)
@@ -39,21 +100,22 @@ func main() {
         panic(err)
     }
 
+    ids := make([]int, 0, len(emails))
     for _, email := range emails {
-        _, err = client.ListMessage(email.ID)
-        if err != nil {
-            panic(err)
-        }
+        ids = append(ids, email.ID)
+    }
 
-        _, err = client.Retrieve(email.ID) 
-        if err != nil {
-            panic(err)
-        }
+    err = client.RetrieveMany(ids, func(ID int, body io.Reader) error {
+        _, err := io.Copy(io.Discard, body)
+        return err
+    })
+    if err != nil {
+        panic(err)
+    }
 
-        err = client.Delete(email.ID)
-        if err != nil {
-            panic(err)
-        }
+    err = client.DeleteMany(ids)
+    if err != nil {
+        panic(err)
     }
 
     err = client.Reset()
@@ -0,0 +1,73 @@
+package config
+
+import (
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/hex"
+    "fmt"
+    "strings"
+)
+
+// PinError is returned when connecting if the server's certificate doesn't match any of
+// the pins in TLSPins
+type PinError struct {
+    // Server holds the server name the certificates were presented for
+    Server string
+    // Expected holds the configured pins
+    Expected []string
+    // Got holds the pin of the server's certificate, empty if it didn't present one
+    Got []string
+}
+
+// Error returns the description of the error along with the pins presented
+func (e *PinError) Error() string {
+    return fmt.Sprintf("Server public key doesn't match the pins for %v, got %v", e.Server, strings.Join(e.Got, ", "))
+}
+
+// SPKIPin returns the pin of the certificate's public key in the form sha256/<base64>,
+// i.e. the base64 SHA-256 hash of the DER encoded SubjectPublicKeyInfo
+func SPKIPin(cert *x509.Certificate) string {
+    hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+    return "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// parsePin normalises a pin to the form returned by SPKIPin. Pins may be given as base64,
+// optionally prefixed with sha256/ or sha256//, or as hex
+func parsePin(pin string) (string, error) {
+    value := strings.TrimSpace(pin)
+    value = strings.TrimPrefix(value, "sha256/")
+    value = strings.TrimPrefix(value, "/")
+
+    hash, err := base64.StdEncoding.DecodeString(value)
+    if err != nil || len(hash) != sha256.Size {
+        hash, err = hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+    }
+    if err != nil || len(hash) != sha256.Size {
+        return "", fmt.Errorf("Invalid pin %q, expected a base64 or hex SHA-256 hash", pin)
+    }
+
+    return "sha256/" + base64.StdEncoding.EncodeToString(hash), nil
+}
+
+// verifyPins returns a callback for tls.Config.VerifyConnection accepting the connection
+// if the server's own certificate matches one of pins. The rest of the chain isn't
+// checked, it isn't verified so any certificate could be appended to it, whereas the
+// handshake proves the server holds the key of the first
+func verifyPins(server string, pins []string) func(tls.ConnectionState) error {
+    return func(state tls.ConnectionState) error {
+        if len(state.PeerCertificates) == 0 {
+            return &PinError { Server: server, Expected: pins }
+        }
+
+        pin := SPKIPin(state.PeerCertificates[0])
+        for _, expected := range pins {
+            if pin == expected {
+                return nil
+            }
+        }
+
+        return &PinError { Server: server, Expected: pins, Got: []string { pin } }
+    }
+}
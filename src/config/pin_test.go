@@ -0,0 +1,112 @@
+package config
+
+import (
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
+    "encoding/pem"
+    "errors"
+    "strings"
+    "testing"
+)
+
+// newTestX509 creates a self-signed certificate returning it parsed
+func newTestX509(t *testing.T) *x509.Certificate {
+    certPEM, _ := newTestPEM(t)
+    block, _ := pem.Decode(certPEM)
+
+    cert, err := x509.ParseCertificate(block.Bytes)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return cert
+}
+
+// Test_SPKIPin checks the pin is the base64 SHA-256 of the public key
+func Test_SPKIPin(t *testing.T) {
+    cert := newTestX509(t)
+
+    pin := SPKIPin(cert)
+    if !strings.HasPrefix(pin, "sha256/") || len(pin) != len("sha256/") + 44 {
+        t.Errorf("Unexpected pin %v", pin)
+    }
+
+    hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+    parsed, err := parsePin(hex.EncodeToString(hash[:]))
+    if err != nil || parsed != pin {
+        t.Errorf("Hex pin parsed as %v, %v", parsed, err)
+    }
+
+    for _, form := range []string { pin, strings.TrimPrefix(pin, "sha256/"), "sha256//" + strings.TrimPrefix(pin, "sha256/") } {
+        parsed, err = parsePin(form)
+        if err != nil || parsed != pin {
+            t.Errorf("Pin %v parsed as %v, %v", form, parsed, err)
+        }
+    }
+}
+
+// Test_TLSConfigPins checks the pins replace the CA verification and are checked against the certificates presented
+func Test_TLSConfigPins(t *testing.T) {
+    cert := newTestX509(t)
+    other := newTestX509(t)
+
+    conf := NewConfig()
+    conf.TLSPins = []string { SPKIPin(other), SPKIPin(cert) }
+
+    tlsConf, err := conf.TLSConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !tlsConf.InsecureSkipVerify || tlsConf.VerifyConnection == nil {
+        t.Fatal("Pins not applied")
+    }
+
+    err = tlsConf.VerifyConnection(tls.ConnectionState { PeerCertificates: []*x509.Certificate { cert } })
+    if err != nil {
+        t.Errorf("Matching pin rejected %v", err)
+    }
+
+    conf.TLSPins = []string { SPKIPin(other) }
+    tlsConf, err = conf.TLSConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = tlsConf.VerifyConnection(tls.ConnectionState { PeerCertificates: []*x509.Certificate { cert } })
+    var pinErr *PinError
+    if !errors.As(err, &pinErr) {
+        t.Fatalf("Expected a pin error, got %v", err)
+    }
+    if pinErr.Server != "pop.gmail.com" || len(pinErr.Got) != 1 || pinErr.Got[0] != SPKIPin(cert) {
+        t.Errorf("Unexpected pin error %+v", pinErr)
+    }
+}
+
+// Test_TLSConfigPinsLeafOnly checks a pinned certificate appended to the chain after another isn't accepted
+func Test_TLSConfigPinsLeafOnly(t *testing.T) {
+    pinned := newTestX509(t)
+    attacker := newTestX509(t)
+
+    conf := NewConfig()
+    conf.TLSPins = []string { SPKIPin(pinned) }
+    tlsConf, err := conf.TLSConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = tlsConf.VerifyConnection(tls.ConnectionState { PeerCertificates: []*x509.Certificate { attacker, pinned } })
+    var pinErr *PinError
+    if !errors.As(err, &pinErr) {
+        t.Fatalf("Expected a spliced chain to be rejected, got %v", err)
+    }
+    if len(pinErr.Got) != 1 || pinErr.Got[0] != SPKIPin(attacker) {
+        t.Errorf("Unexpected pin error %+v", pinErr)
+    }
+
+    err = tlsConf.VerifyConnection(tls.ConnectionState {})
+    if !errors.As(err, &pinErr) {
+        t.Errorf("Expected no certificates to be rejected, got %v", err)
+    }
+}
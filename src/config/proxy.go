@@ -0,0 +1,93 @@
+package config
+
+import (
+    "fmt"
+    "net"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// ProxyURL returns the proxy to connect to the server through, nil to connect directly.
+// The proxy is taken from Proxy, or from the environment if ProxyFromEnvironment is set
+func (c *Config) ProxyURL() (*url.URL, error) {
+    proxy := c.Proxy
+    if proxy == "" && c.ProxyFromEnvironment {
+        if noProxy(getenv("NO_PROXY", "no_proxy"), c.Server, c.Port) {
+            return nil, nil
+        }
+        proxy = getenv("ALL_PROXY", "all_proxy")
+    }
+    if proxy == "" {
+        return nil, nil
+    }
+
+    proxyURL, err := url.Parse(proxy)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid proxy URL: %w", err)
+    }
+
+    switch proxyURL.Scheme {
+    case "socks5", "socks5h", "http":
+    default:
+        return nil, fmt.Errorf("Unsupported proxy scheme %q, expected socks5 or http", proxyURL.Scheme)
+    }
+    if proxyURL.Hostname() == "" {
+        return nil, fmt.Errorf("Proxy URL %v has no host", proxyURL.Redacted())
+    }
+
+    return proxyURL, nil
+}
+
+// getenv returns the first of the environment variables that is set
+func getenv(names ...string) string {
+    for _, name := range names {
+        if value := os.Getenv(name); value != "" {
+            return value
+        }
+    }
+
+    return ""
+}
+
+// noProxy checks whether the server matches the comma separated NO_PROXY list. Entries
+// are host names matching the host and its subdomains, IP addresses or CIDR ranges, each
+// optionally with a port, or * to match everything
+func noProxy(list string, server string, port int) bool {
+    host := strings.ToLower(strings.TrimSuffix(server, "."))
+    ip := net.ParseIP(host)
+
+    for _, entry := range strings.Split(list, ",") {
+        entry = strings.ToLower(strings.TrimSpace(entry))
+        if entry == "" {
+            continue
+        }
+        if entry == "*" {
+            return true
+        }
+
+        if _, cidr, err := net.ParseCIDR(entry); err == nil {
+            if ip != nil && cidr.Contains(ip) {
+                return true
+            }
+            continue
+        }
+
+        if entryHost, entryPort, err := net.SplitHostPort(entry); err == nil {
+            if entryPort != strconv.Itoa(port) {
+                continue
+            }
+            entry = entryHost
+        }
+
+        entry = strings.Trim(entry, "[]")
+        entry = strings.TrimPrefix(entry, "*")
+        entry = strings.TrimPrefix(entry, ".")
+        if host == entry || strings.HasSuffix(host, "." + entry) {
+            return true
+        }
+    }
+
+    return false
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "os"
+)
+
+// TLSConfig builds the TLS configuration used for implicit TLS and STLS from the TLS settings
+func (c *Config) TLSConfig() (*tls.Config, error) {
+    tlsConf := &tls.Config {
+        ServerName: c.TLSServerName,
+        MinVersion: c.TLSMinVersion,
+        MaxVersion: c.TLSMaxVersion,
+        CipherSuites: c.TLSCipherSuites,
+        InsecureSkipVerify: c.TLSInsecureSkipVerify,
+    }
+    if tlsConf.ServerName == "" {
+        tlsConf.ServerName = c.Server
+    }
+
+    if c.TLSMinVersion != 0 && c.TLSMaxVersion != 0 && c.TLSMinVersion > c.TLSMaxVersion {
+        return nil, fmt.Errorf("Invalid TLS versions, minimum %#04x is above maximum %#04x", c.TLSMinVersion, c.TLSMaxVersion)
+    }
+
+    if c.TLSCAFile != "" || len(c.TLSCAPEM) > 0 {
+        pool := x509.NewCertPool()
+
+        if c.TLSCAFile != "" {
+            pem, err := os.ReadFile(c.TLSCAFile)
+            if err != nil {
+                return nil, fmt.Errorf("Unable to read CA file %v: %w", c.TLSCAFile, err)
+            }
+            if !pool.AppendCertsFromPEM(pem) {
+                return nil, fmt.Errorf("No certificates found in CA file %v", c.TLSCAFile)
+            }
+        }
+
+        if len(c.TLSCAPEM) > 0 && !pool.AppendCertsFromPEM(c.TLSCAPEM) {
+            return nil, errors.New("No certificates found in TLSCAPEM")
+        }
+
+        tlsConf.RootCAs = pool
+    }
+
+    if len(c.TLSPins) > 0 {
+        pins := make([]string, 0, len(c.TLSPins))
+        for _, pin := range c.TLSPins {
+            parsed, err := parsePin(pin)
+            if err != nil {
+                return nil, err
+            }
+            pins = append(pins, parsed)
+        }
+
+        // the chain isn't verified against the CAs, the pins are checked once the handshake completes
+        tlsConf.InsecureSkipVerify = true
+        tlsConf.VerifyConnection = verifyPins(tlsConf.ServerName, pins)
+    }
+
+    var cert tls.Certificate
+    var err error
+    switch {
+    case len(c.TLSCertPEM) > 0 || len(c.TLSKeyPEM) > 0:
+        cert, err = tls.X509KeyPair(c.TLSCertPEM, c.TLSKeyPEM)
+    case c.TLSCertFile != "" || c.TLSKeyFile != "":
+        cert, err = tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+    default:
+        return tlsConf, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("Unable to load client certificate: %w", err)
+    }
+
+    tlsConf.Certificates = []tls.Certificate { cert }
+
+    return tlsConf, nil
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "math/big"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// newTestPEM creates a self-signed certificate and key returning them PEM encoded
+func newTestPEM(t *testing.T) ([]byte, []byte) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    template := &x509.Certificate {
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name { CommonName: "localhost" },
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        BasicConstraintsValid: true,
+        IsCA: true,
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return pem.EncodeToMemory(&pem.Block { Type: "CERTIFICATE", Bytes: der }), pem.EncodeToMemory(&pem.Block { Type: "EC PRIVATE KEY", Bytes: keyDER })
+}
+
+// Test_TLSConfigDefaults checks the server name defaults to the server and nothing else is set
+func Test_TLSConfigDefaults(t *testing.T) {
+    conf := NewConfig()
+
+    tlsConf, err := conf.TLSConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if tlsConf.ServerName != "pop.gmail.com" || tlsConf.RootCAs != nil || len(tlsConf.Certificates) != 0 || tlsConf.InsecureSkipVerify {
+        t.Errorf("Unexpected defaults %+v", tlsConf)
+    }
+}
+
+// Test_TLSConfigSettings checks the settings are copied over
+func Test_TLSConfigSettings(t *testing.T) {
+    certPEM, keyPEM := newTestPEM(t)
+
+    conf := NewConfig()
+    conf.Server = "192.0.2.1"
+    conf.TLSServerName = "mail.example.com"
+    conf.TLSMinVersion = tls.VersionTLS12
+    conf.TLSMaxVersion = tls.VersionTLS13
+    conf.TLSCipherSuites = []uint16 { tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 }
+    conf.TLSCAPEM = certPEM
+    conf.TLSCertPEM = certPEM
+    conf.TLSKeyPEM = keyPEM
+    conf.TLSInsecureSkipVerify = true
+
+    tlsConf, err := conf.TLSConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if tlsConf.ServerName != "mail.example.com" || tlsConf.MinVersion != tls.VersionTLS12 || tlsConf.MaxVersion != tls.VersionTLS13 {
+        t.Errorf("Incorrect server name or versions %+v", tlsConf)
+    }
+    if len(tlsConf.CipherSuites) != 1 || !tlsConf.InsecureSkipVerify {
+        t.Errorf("Incorrect cipher suites or verification %+v", tlsConf)
+    }
+    if tlsConf.RootCAs == nil || len(tlsConf.Certificates) != 1 {
+        t.Error("CA or client certificate not loaded")
+    }
+}
+
+// Test_TLSConfigFiles checks the CA bundle and client certificate are read from files
+func Test_TLSConfigFiles(t *testing.T) {
+    certPEM, keyPEM := newTestPEM(t)
+    dir := t.TempDir()
+
+    conf := NewConfig()
+    conf.TLSCAFile = filepath.Join(dir, "ca.pem")
+    conf.TLSCertFile = filepath.Join(dir, "cert.pem")
+    conf.TLSKeyFile = filepath.Join(dir, "key.pem")
+    os.WriteFile(conf.TLSCAFile, certPEM, 0600)
+    os.WriteFile(conf.TLSCertFile, certPEM, 0600)
+    os.WriteFile(conf.TLSKeyFile, keyPEM, 0600)
+
+    tlsConf, err := conf.TLSConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if tlsConf.RootCAs == nil || len(tlsConf.Certificates) != 1 {
+        t.Error("CA or client certificate not loaded")
+    }
+}
+
+// Test_TLSConfigErrors checks invalid settings are rejected
+func Test_TLSConfigErrors(t *testing.T) {
+    certPEM, _ := newTestPEM(t)
+
+    tests := map[string]func(*Config) {
+        "missing CA file": func(c *Config) { c.TLSCAFile = filepath.Join(t.TempDir(), "missing.pem") },
+        "invalid CA PEM": func(c *Config) { c.TLSCAPEM = []byte("not a certificate") },
+        "certificate without key": func(c *Config) { c.TLSCertPEM = certPEM },
+        "key file without certificate": func(c *Config) { c.TLSKeyFile = "key.pem" },
+        "invalid pin": func(c *Config) { c.TLSPins = []string { "sha256/not a pin" } },
+        "versions reversed": func(c *Config) {
+            c.TLSMinVersion = tls.VersionTLS13
+            c.TLSMaxVersion = tls.VersionTLS12
+        },
+    }
+
+    for name, setup := range tests {
+        conf := NewConfig()
+        setup(conf)
+
+        _, err := conf.TLSConfig()
+        if err == nil {
+            t.Errorf("Expected an error for %v", name)
+        }
+    }
+}
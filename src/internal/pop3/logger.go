@@ -0,0 +1,20 @@
+// Package pop3 holds the pieces of the protocol shared by the client, the server and
+// pop3test, so each has one implementation
+package pop3
+
+// Logger receives log messages. Args are alternating keys and values, e.g. "command",
+// "STAT", matching log/slog so a *slog.Logger can be used directly
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// NopLogger discards everything, it's used when no logger is given
+type NopLogger struct{}
+
+func (NopLogger) Debug(msg string, args ...interface{}) {}
+func (NopLogger) Info(msg string, args ...interface{})  {}
+func (NopLogger) Warn(msg string, args ...interface{})  {}
+func (NopLogger) Error(msg string, args ...interface{}) {}
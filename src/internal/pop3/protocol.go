@@ -0,0 +1,99 @@
+package pop3
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrInvalidPlain is returned by DecodePlain when the response isn't base64 encoded
+// identity, username and password separated by NUL
+var ErrInvalidPlain = errors.New("invalid PLAIN response")
+
+// ParseCommand splits a command line into the command name, upper cased, and its
+// arguments
+func ParseCommand(line string) (string, string) {
+	command, arg, _ := strings.Cut(line, " ")
+	return strings.ToUpper(command), arg
+}
+
+// NewTimestamp returns a greeting timestamp for APOP, unique to this process and time
+// (RFC 1939)
+func NewTimestamp(hostname string) string {
+	return fmt.Sprintf("<%d.%d@%v>", os.Getpid(), time.Now().UnixNano(), hostname)
+}
+
+// GreetingTimestamp returns the <...> timestamp from a greeting, or an empty string if
+// there isn't one
+func GreetingTimestamp(greeting string) string {
+	start := strings.Index(greeting, "<")
+	if start < 0 {
+		return ""
+	}
+
+	end := strings.Index(greeting[start:], ">")
+	if end < 0 {
+		return ""
+	}
+
+	return greeting[start : start+end+1]
+}
+
+// APOPDigest returns the hex MD5 digest of the timestamp followed by the password
+func APOPDigest(timestamp string, password string) string {
+	digest := md5.Sum([]byte(timestamp + password))
+	return hex.EncodeToString(digest[:])
+}
+
+// DecodePlain decodes a SASL PLAIN response (RFC 4616) into the authorization identity,
+// which is usually empty, the username and the password
+func DecodePlain(response string) (string, string, string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return "", "", "", fmt.Errorf("%w: %v", ErrInvalidPlain, err)
+	}
+
+	parts := strings.Split(string(decoded), "\x00")
+	if len(parts) != 3 {
+		return "", "", "", ErrInvalidPlain
+	}
+
+	return parts[0], parts[1], parts[2], nil
+}
+
+// CopyTop copies the headers of a message, the blank line after them and up to lines
+// lines of the body, as returned by TOP
+func CopyTop(w io.Writer, r io.Reader, lines int) error {
+	reader := bufio.NewReader(r)
+	inBody := false
+	for !inBody || lines > 0 {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if inBody {
+				lines--
+			} else if strings.TrimRight(line, "\r\n") == "" {
+				inBody = true
+			}
+
+			_, writeErr := io.WriteString(w, line)
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
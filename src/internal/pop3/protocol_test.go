@@ -0,0 +1,87 @@
+package pop3
+
+import (
+    "encoding/base64"
+    "errors"
+    "strings"
+    "testing"
+)
+
+// Test_ParseCommand checks the command name is upper cased and split from its arguments
+func Test_ParseCommand(t *testing.T) {
+    command, arg := ParseCommand("top 1 10")
+    if command != "TOP" || arg != "1 10" {
+        t.Errorf("Unexpected command %q, %q", command, arg)
+    }
+
+    command, arg = ParseCommand("QUIT")
+    if command != "QUIT" || arg != "" {
+        t.Errorf("Unexpected command %q, %q", command, arg)
+    }
+}
+
+// Test_GreetingTimestamp checks the timestamp is found in a greeting
+func Test_GreetingTimestamp(t *testing.T) {
+    tests := map[string]string {
+        "+OK POP3 server ready <1896.697170952@dbc.mtview.ca.us>": "<1896.697170952@dbc.mtview.ca.us>",
+        "+OK <a@b> and <c@d>": "<a@b>",
+        "+OK ready": "",
+        "+OK <unterminated": "",
+    }
+    for greeting, expected := range tests {
+        if timestamp := GreetingTimestamp(greeting); timestamp != expected {
+            t.Errorf("Expected %q from %q, got %q", expected, greeting, timestamp)
+        }
+    }
+
+    timestamp := NewTimestamp("example.com")
+    if GreetingTimestamp("+OK " + timestamp) != timestamp || !strings.HasSuffix(timestamp, "@example.com>") {
+        t.Errorf("Invalid timestamp %q", timestamp)
+    }
+}
+
+// Test_APOPDigest checks the digest matches the example in RFC 1939
+func Test_APOPDigest(t *testing.T) {
+    digest := APOPDigest("<1896.697170952@dbc.mtview.ca.us>", "tanstaaf")
+    if digest != "c4c9334bac560ecc979e58001b3e22fb" {
+        t.Errorf("Unexpected digest %v", digest)
+    }
+}
+
+// Test_DecodePlain checks PLAIN responses are decoded and invalid ones rejected
+func Test_DecodePlain(t *testing.T) {
+    identity, username, password, err := DecodePlain(base64.StdEncoding.EncodeToString([]byte("admin\x00user\x00pass word")))
+    if err != nil || identity != "admin" || username != "user" || password != "pass word" {
+        t.Errorf("Unexpected result %q, %q, %q, %v", identity, username, password, err)
+    }
+
+    for _, response := range []string { "not base64!", base64.StdEncoding.EncodeToString([]byte("user\x00pass")) } {
+        _, _, _, err = DecodePlain(response)
+        if !errors.Is(err, ErrInvalidPlain) {
+            t.Errorf("Expected ErrInvalidPlain for %q, got %v", response, err)
+        }
+    }
+}
+
+// Test_CopyTop checks the headers, blank line and requested body lines are copied
+func Test_CopyTop(t *testing.T) {
+    message := "Subject: test\r\nFrom: a@b\r\n\r\nline 1\r\nline 2\r\nline 3"
+    tests := map[int]string {
+        0: "Subject: test\r\nFrom: a@b\r\n\r\n",
+        2: "Subject: test\r\nFrom: a@b\r\n\r\nline 1\r\nline 2\r\n",
+        10: message,
+    }
+    for lines, expected := range tests {
+        var copied strings.Builder
+        err := CopyTop(&copied, strings.NewReader(message), lines)
+        if err != nil || copied.String() != expected {
+            t.Errorf("Unexpected copy of %v lines %q, %v", lines, copied.String(), err)
+        }
+    }
+
+    var copied strings.Builder
+    err := CopyTop(&copied, strings.NewReader("Subject: no body\n"), 5)
+    if err != nil || copied.String() != "Subject: no body\n" {
+        t.Errorf("Unexpected copy without a body %q, %v", copied.String(), err)
+    }
+}
@@ -0,0 +1,292 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/benmj87/gogo-pop3gadget/src/client"
+	"github.com/benmj87/gogo-pop3gadget/src/config"
+)
+
+// ErrPoolClosed is returned by Get once the pool has been closed
+var ErrPoolClosed = errors.New("pool closed")
+
+// Pool hands out authenticated sessions for many accounts. POP3 servers lock a mailbox
+// while it's in use so each account has at most one session, and the number of sessions
+// open to each server is capped. Released sessions are kept open and checked with NOOP
+// before being handed out again, broken ones are reconnected
+type Pool struct {
+	// MaxPerServer limits the sessions open to each server, 0 for no limit
+	MaxPerServer int
+	// ServerLimits overrides MaxPerServer for individual servers, keyed by lower case host name
+	ServerLimits map[string]int
+	// NewClient creates the client for an account, by default client.NewClient with the pool options
+	NewClient func(config.Config) *client.Client
+
+	lock sync.Mutex
+	// changed is closed and replaced whenever a session is released or closed
+	changed chan struct{}
+	// accounts holds the sessions of each account keyed by accountKey
+	accounts map[string]*account
+	// open holds the number of sessions open to each server keyed by serverKey
+	open   map[string]int
+	closed bool
+}
+
+// account holds the pooled session for one mailbox
+type account struct {
+	server string
+	inUse  bool
+	// idle holds a connected session waiting to be reused, nil if there isn't one
+	idle *Session
+}
+
+// Session is an authenticated client handed out by Get, it must be given back using
+// Release or Discard
+type Session struct {
+	*client.Client
+	key    string
+	server string
+}
+
+// NewPool creates a pool opening at most maxPerServer sessions to each server, opts are
+// passed to client.NewClient, e.g. client.WithLogger
+func NewPool(maxPerServer int, opts ...client.Option) *Pool {
+	return &Pool{
+		MaxPerServer: maxPerServer,
+		NewClient: func(conf config.Config) *client.Client {
+			return client.NewClient(conf, opts...)
+		},
+		changed:  make(chan struct{}),
+		accounts: make(map[string]*account),
+		open:     make(map[string]int),
+	}
+}
+
+// Get returns an authenticated session for the account, waiting while the account's
+// session is in use or the server has no sessions to spare
+func (p *Pool) Get(ctx context.Context, conf config.Config) (*Session, error) {
+	key := accountKey(conf)
+	server := serverKey(conf)
+
+	p.lock.Lock()
+	for {
+		if p.closed {
+			p.lock.Unlock()
+			return nil, ErrPoolClosed
+		}
+		// nothing can be evicted for a caller that has given up
+		if ctx.Err() != nil {
+			p.lock.Unlock()
+			return nil, ctx.Err()
+		}
+
+		acct := p.accounts[key]
+		if acct == nil {
+			acct = &account{server: server}
+			p.accounts[key] = acct
+		}
+
+		if !acct.inUse && acct.idle != nil {
+			sess := acct.idle
+			acct.idle = nil
+			acct.inUse = true
+			p.lock.Unlock()
+
+			err := sess.NoopContext(ctx)
+			if err == nil {
+				return sess, nil
+			}
+			if ctx.Err() != nil {
+				p.Discard(sess)
+				return nil, ctx.Err()
+			}
+
+			// the server slot is kept for the new connection. It's closed regardless of ctx
+			// so the server releases the mailbox lock
+			sess.Client.Close()
+			return p.connect(ctx, conf, key, server)
+		}
+
+		if !acct.inUse {
+			evicted, ok := p.reserve(server)
+			if ok {
+				acct.inUse = true
+				p.lock.Unlock()
+
+				if evicted != nil {
+					evicted.Client.Close()
+				}
+				return p.connect(ctx, conf, key, server)
+			}
+		}
+
+		changed := p.changed
+		p.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		p.lock.Lock()
+	}
+}
+
+// Do runs fn with a session for the account, releasing it afterwards. If fn returns
+// an error the session is discarded instead, without removing any messages fn deleted
+func (p *Pool) Do(ctx context.Context, conf config.Config, fn func(*client.Client) error) error {
+	sess, err := p.Get(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	err = fn(sess.Client)
+	if err != nil {
+		// QUIT would remove the messages deleted so they're restored first, if that fails
+		// the connection is dropped without QUIT
+		if sess.State() == client.StateTransaction && sess.Reset() != nil {
+			sess.Abort()
+		}
+		p.Discard(sess)
+		return err
+	}
+
+	p.Release(sess)
+	return nil
+}
+
+// Release gives the session back to be reused, a session that is no longer logged in
+// is closed instead
+func (p *Pool) Release(sess *Session) {
+	p.lock.Lock()
+	acct := p.accounts[sess.key]
+	acct.inUse = false
+
+	if p.closed || sess.State() != client.StateTransaction {
+		p.open[sess.server]--
+		p.notify()
+		p.lock.Unlock()
+
+		sess.Client.Close()
+		return
+	}
+
+	acct.idle = sess
+	p.notify()
+	p.lock.Unlock()
+}
+
+// Discard closes the session rather than reusing it. The server removes any messages
+// deleted in the session
+func (p *Pool) Discard(sess *Session) error {
+	p.lock.Lock()
+	p.accounts[sess.key].inUse = false
+	p.open[sess.server]--
+	p.notify()
+	p.lock.Unlock()
+
+	if sess.State() == client.StateClosed {
+		return nil
+	}
+	return sess.Client.Close()
+}
+
+// Close closes the idle sessions, sessions in use are closed when they're released.
+// Get returns ErrPoolClosed afterwards
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	p.closed = true
+
+	var idle []*Session
+	for _, acct := range p.accounts {
+		if acct.idle != nil {
+			idle = append(idle, acct.idle)
+			p.open[acct.server]--
+			acct.idle = nil
+		}
+	}
+	p.notify()
+	p.lock.Unlock()
+
+	var firstErr error
+	for _, sess := range idle {
+		err := sess.Client.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// connect opens and authenticates a session for the account, the account and a server
+// slot must already be reserved and are given back if it fails
+func (p *Pool) connect(ctx context.Context, conf config.Config, key string, server string) (*Session, error) {
+	c := p.NewClient(conf)
+
+	err := c.ConnectContext(ctx)
+	if err == nil {
+		err = c.AuthContext(ctx)
+		if err != nil {
+			c.Close()
+		}
+	}
+
+	if err != nil {
+		p.lock.Lock()
+		p.accounts[key].inUse = false
+		p.open[server]--
+		p.notify()
+		p.lock.Unlock()
+
+		return nil, fmt.Errorf("Unable to open session for %v: %w", key, err)
+	}
+
+	return &Session{Client: c, key: key, server: server}, nil
+}
+
+// reserve takes a slot on the server, closing an idle session on the same server if
+// there are none left. The evicted session, if any, must be closed by the caller
+func (p *Pool) reserve(server string) (*Session, bool) {
+	limit := p.MaxPerServer
+	if serverLimit, ok := p.ServerLimits[server]; ok {
+		limit = serverLimit
+	}
+
+	if limit <= 0 || p.open[server] < limit {
+		p.open[server]++
+		return nil, true
+	}
+
+	for _, acct := range p.accounts {
+		if acct.server == server && !acct.inUse && acct.idle != nil {
+			// the evicted session's slot is handed over
+			evicted := acct.idle
+			acct.idle = nil
+			return evicted, true
+		}
+	}
+
+	return nil, false
+}
+
+// notify wakes up any Get waiting for a session, the lock must be held
+func (p *Pool) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// accountKey identifies the mailbox of conf
+func accountKey(conf config.Config) string {
+	return fmt.Sprintf("%v@%v:%v", conf.Username, serverKey(conf), conf.Port)
+}
+
+// serverKey identifies the server of conf for the concurrency limits
+func serverKey(conf config.Config) string {
+	return strings.ToLower(conf.Server)
+}
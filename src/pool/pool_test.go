@@ -0,0 +1,339 @@
+package pool
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+    "github.com/benmj87/gogo-pop3gadget/src/client"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+    "github.com/benmj87/gogo-pop3gadget/src/pop3test"
+)
+
+// newTestPool returns a pool connecting to a pop3test server with mailboxes for tim and
+// bob, logins to any other account fail
+func newTestPool(t *testing.T, maxPerServer int) (*Pool, *pop3test.Server) {
+    server := pop3test.NewServer()
+    server.AddMailbox("tim", "secret")
+    server.AddMailbox("bob", "secret")
+    t.Cleanup(func() { server.Close() })
+
+    toTest := NewPool(maxPerServer)
+    toTest.NewClient = func(conf config.Config) *client.Client {
+        c := client.NewClient(conf)
+        c.Dialer = server.Dial
+        return c
+    }
+
+    return toTest, server
+}
+
+// quits returns the number of QUIT commands the server has received
+func quits(server *pop3test.Server) int {
+    count := 0
+    for _, command := range server.Commands() {
+        if command == "QUIT" {
+            count++
+        }
+    }
+
+    return count
+}
+
+// testAccount returns the config for username on the test server
+func testAccount(username string) config.Config {
+    conf := config.NewConfig()
+    conf.UseTLS = false
+    conf.Server = "pop.example.com"
+    conf.Port = 110
+    conf.Username = username
+    conf.Password = "secret"
+
+    return *conf
+}
+
+// Test_PoolReusesSession checks a released session is handed out again
+func Test_PoolReusesSession(t *testing.T) {
+    toTest, server := newTestPool(t, 2)
+
+    sess, err := toTest.Get(context.Background(), testAccount("tim"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if sess.State() != client.StateTransaction {
+        t.Errorf("Expected an authenticated session, got %v", sess.State())
+    }
+    toTest.Release(sess)
+
+    again, err := toTest.Get(context.Background(), testAccount("tim"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if again.Client != sess.Client {
+        t.Error("Session wasn't reused")
+    }
+    if server.Connections() != 1 {
+        t.Errorf("Expected 1 connection, got %v", server.Connections())
+    }
+}
+
+// Test_PoolReconnectsBroken checks a session failing the health check is replaced
+func Test_PoolReconnectsBroken(t *testing.T) {
+    toTest, server := newTestPool(t, 1)
+
+    sess, err := toTest.Get(context.Background(), testAccount("tim"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    toTest.Release(sess)
+    server.Drop()
+
+    sess, err = toTest.Get(context.Background(), testAccount("tim"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if server.Connections() != 2 || sess.State() != client.StateTransaction {
+        t.Errorf("Expected a new connection, got %v connections", server.Connections())
+    }
+    if toTest.open["pop.example.com"] != 1 {
+        t.Errorf("Incorrect open count %v", toTest.open["pop.example.com"])
+    }
+}
+
+// Test_PoolAccountExclusive checks an account's session is only handed out once at a time
+func Test_PoolAccountExclusive(t *testing.T) {
+    toTest, _ := newTestPool(t, 0)
+
+    sess, err := toTest.Get(context.Background(), testAccount("tim"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+    _, err = toTest.Get(ctx, testAccount("tim"))
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+    }
+
+    // other accounts aren't held up
+    other, err := toTest.Get(context.Background(), testAccount("bob"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    toTest.Release(other)
+    toTest.Release(sess)
+}
+
+// Test_PoolServerLimit checks sessions to a full server wait, evicting idle sessions
+func Test_PoolServerLimit(t *testing.T) {
+    toTest, server := newTestPool(t, 1)
+
+    sess, err := toTest.Get(context.Background(), testAccount("tim"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    got := make(chan *Session)
+    go func() {
+        other, err := toTest.Get(context.Background(), testAccount("bob"))
+        if err != nil {
+            t.Error(err)
+        }
+        got <- other
+    }()
+
+    select {
+    case <-got:
+        t.Fatal("Server limit exceeded")
+    case <-time.After(50 * time.Millisecond):
+    }
+
+    toTest.Release(sess)
+    other := <-got
+    if other == nil || other.State() != client.StateTransaction {
+        t.Fatal("Waiting session wasn't handed out")
+    }
+    if quits(server) != 1 || server.Mailbox("tim").Locked() {
+        t.Error("Idle session wasn't closed to make room")
+    }
+    if toTest.open["pop.example.com"] != 1 {
+        t.Errorf("Incorrect open count %v", toTest.open["pop.example.com"])
+    }
+}
+
+// Test_PoolServerLimitCancelled checks a cancelled Get on a full server leaves the idle sessions alone
+func Test_PoolServerLimitCancelled(t *testing.T) {
+    toTest, server := newTestPool(t, 1)
+
+    sess, err := toTest.Get(context.Background(), testAccount("tim"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    toTest.Release(sess)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    _, err = toTest.Get(ctx, testAccount("bob"))
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("Expected context.Canceled, got %v", err)
+    }
+
+    if server.Connections() != 1 {
+        t.Errorf("Expected no connection for a cancelled Get, got %v connections", server.Connections())
+    }
+    if quits(server) != 0 || !server.Mailbox("tim").Locked() || sess.State() != client.StateTransaction {
+        t.Errorf("Idle session was evicted, state %v", sess.State())
+    }
+    if toTest.open["pop.example.com"] != 1 {
+        t.Errorf("Incorrect open count %v", toTest.open["pop.example.com"])
+    }
+
+    again, err := toTest.Get(context.Background(), testAccount("tim"))
+    if err != nil || again.Client != sess.Client {
+        t.Errorf("Expected the idle session to be reused, got %v", err)
+    }
+}
+
+// Test_PoolServerLimitsOverride checks the per-server limits take precedence
+func Test_PoolServerLimitsOverride(t *testing.T) {
+    toTest, _ := newTestPool(t, 1)
+    toTest.ServerLimits = map[string]int { "pop.example.com": 2 }
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+
+    _, err := toTest.Get(ctx, testAccount("tim"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = toTest.Get(ctx, testAccount("bob"))
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Test_PoolAuthFailed checks a failed login is returned and frees the server slot
+func Test_PoolAuthFailed(t *testing.T) {
+    toTest, _ := newTestPool(t, 1)
+
+    _, err := toTest.Get(context.Background(), testAccount("bad"))
+    if !errors.Is(err, client.ErrAuthFailed) {
+        t.Errorf("Expected ErrAuthFailed, got %v", err)
+    }
+    if toTest.open["pop.example.com"] != 0 {
+        t.Errorf("Server slot wasn't freed %v", toTest.open["pop.example.com"])
+    }
+
+    sess, err := toTest.Get(context.Background(), testAccount("tim"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    toTest.Release(sess)
+}
+
+// Test_PoolDoDiscardsOnError checks a session is closed when the work fails
+func Test_PoolDoDiscardsOnError(t *testing.T) {
+    toTest, server := newTestPool(t, 1)
+
+    failed := errors.New("disk full")
+    err := toTest.Do(context.Background(), testAccount("tim"), func(c *client.Client) error {
+        return failed
+    })
+    if err != failed {
+        t.Errorf("Expected the work error, got %v", err)
+    }
+
+    err = toTest.Do(context.Background(), testAccount("tim"), func(c *client.Client) error {
+        return c.Noop()
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if server.Connections() != 2 || quits(server) != 1 {
+        t.Errorf("Expected the failed session to be closed, got %v connections %v quits", server.Connections(), quits(server))
+    }
+}
+
+// Test_PoolDoKeepsDeletedOnError checks messages deleted by work that then fails aren't removed
+func Test_PoolDoKeepsDeletedOnError(t *testing.T) {
+    toTest, server := newTestPool(t, 1)
+    server.AddMailbox("tim", "secret", "Subject: one\r\n\r\nbody\r\n", "Subject: two\r\n\r\nbody\r\n")
+
+    failed := errors.New("disk full")
+    err := toTest.Do(context.Background(), testAccount("tim"), func(c *client.Client) error {
+        err := c.Delete(1)
+        if err != nil {
+            return err
+        }
+        return failed
+    })
+    if err != failed {
+        t.Errorf("Expected the work error, got %v", err)
+    }
+
+    messages := server.Mailbox("tim").Messages()
+    if len(messages) != 2 || messages[0].UID != "uid-1" {
+        t.Errorf("Expected the deleted message to be kept, got %v", messages)
+    }
+    if server.Mailbox("tim").Locked() {
+        t.Error("Expected the failed session to be closed")
+    }
+}
+
+// Test_PoolDoDropsOnFailedReset checks a session is dropped without QUIT when RSET fails
+func Test_PoolDoDropsOnFailedReset(t *testing.T) {
+    toTest, server := newTestPool(t, 1)
+    server.AddMailbox("tim", "secret", "Subject: one\r\n\r\nbody\r\n")
+    server.Inject(pop3test.Fault { Command: "RSET", Response: "-ERR not now" })
+
+    failed := errors.New("disk full")
+    err := toTest.Do(context.Background(), testAccount("tim"), func(c *client.Client) error {
+        err := c.Delete(1)
+        if err != nil {
+            return err
+        }
+        return failed
+    })
+    if err != failed {
+        t.Errorf("Expected the work error, got %v", err)
+    }
+
+    server.Drop()
+    if quits(server) != 0 || len(server.Mailbox("tim").Messages()) != 1 {
+        t.Errorf("Expected the session to be dropped without QUIT, got %v quits %v", quits(server), server.Mailbox("tim").Messages())
+    }
+}
+
+// Test_PoolClose checks idle sessions are closed and no more are handed out
+func Test_PoolClose(t *testing.T) {
+    toTest, server := newTestPool(t, 2)
+
+    sess, err := toTest.Get(context.Background(), testAccount("tim"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    inUse, err := toTest.Get(context.Background(), testAccount("bob"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    toTest.Release(sess)
+
+    err = toTest.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if quits(server) != 1 || server.Mailbox("tim").Locked() {
+        t.Error("Idle session wasn't closed")
+    }
+
+    toTest.Release(inUse)
+    if quits(server) != 2 || server.Mailbox("bob").Locked() {
+        t.Error("Session released after closing wasn't closed")
+    }
+
+    _, err = toTest.Get(context.Background(), testAccount("tim"))
+    if !errors.Is(err, ErrPoolClosed) {
+        t.Errorf("Expected ErrPoolClosed, got %v", err)
+    }
+}
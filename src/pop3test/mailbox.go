@@ -0,0 +1,107 @@
+package pop3test
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Message is a message held in a Mailbox
+type Message struct {
+	// UID is the unique-id returned by UIDL
+	UID string
+	// Body holds the whole message, headers and content, with CRLF line endings
+	Body string
+}
+
+// Mailbox is an in-memory mailbox. Messages deleted in a session are only removed when
+// the session ends with QUIT, and the mailbox is locked while a session is logged in
+type Mailbox struct {
+	// Password is checked by PASS, APOP and AUTH PLAIN
+	Password string
+
+	lock     sync.Mutex
+	messages []Message
+	locked   bool
+	// added counts the messages added so generated unique-ids aren't reused
+	added int
+}
+
+// Add appends messages with the given bodies, generating the unique-ids uid-1, uid-2 and
+// so on. It returns the unique-ids
+func (m *Mailbox) Add(bodies ...string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	uids := make([]string, 0, len(bodies))
+	for _, body := range bodies {
+		m.added++
+		uid := fmt.Sprintf("uid-%d", m.added)
+		m.messages = append(m.messages, Message{UID: uid, Body: body})
+		uids = append(uids, uid)
+	}
+
+	return uids
+}
+
+// AddMessage appends messages with their own unique-ids
+func (m *Mailbox) AddMessage(messages ...Message) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.added += len(messages)
+	m.messages = append(m.messages, messages...)
+}
+
+// Messages returns a copy of the messages in the mailbox
+func (m *Mailbox) Messages() []Message {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]Message{}, m.messages...)
+}
+
+// Locked returns whether a session is logged in to the mailbox
+func (m *Mailbox) Locked() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.locked
+}
+
+// SetLocked locks or unlocks the mailbox, e.g. to act as if another client were logged in
+func (m *Mailbox) SetLocked(locked bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.locked = locked
+}
+
+// open locks the mailbox for a session returning a snapshot of its messages, false if it's
+// already locked
+func (m *Mailbox) open() ([]Message, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.locked {
+		return nil, false
+	}
+
+	m.locked = true
+	return append([]Message{}, m.messages...), true
+}
+
+// close unlocks the mailbox, removing the messages with the unique-ids in deleted
+func (m *Mailbox) close(deleted map[string]bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	kept := m.messages[:0]
+	for _, message := range m.messages {
+		if !deleted[message.UID] {
+			kept = append(kept, message)
+		}
+	}
+
+	m.messages = kept
+	m.locked = false
+}
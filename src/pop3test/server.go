@@ -0,0 +1,306 @@
+// Package pop3test provides an in-memory POP3 server for testing clients. The server is
+// stateful, following RFC 1939, so tests can check what a client actually did rather than
+// scripting the responses up front
+package pop3test
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benmj87/gogo-pop3gadget/src/config"
+	"github.com/benmj87/gogo-pop3gadget/src/internal/pop3"
+)
+
+// DefaultCapabilities are advertised by NewServer
+var DefaultCapabilities = []string{"TOP", "UIDL", "USER", "PIPELINING", "RESP-CODES", "AUTH-RESP-CODE", "SASL PLAIN"}
+
+// Fault replaces the normal handling of a command, for testing how a client copes with
+// failures
+type Fault struct {
+	// Command holds the command name to match, e.g. RETR, empty matches any command
+	Command string
+	// Count limits how many commands the fault applies to, 0 for every one
+	Count int
+	// After lets that many matching commands be handled normally before the fault applies,
+	// e.g. 1 to fail the second RETR
+	After int
+	// Delay waits before responding
+	Delay time.Duration
+	// Interval waits before each line of the response and before a message body, acting
+	// as a slow server
+	Interval time.Duration
+	// Response is sent instead of the normal response, e.g. "-ERR [SYS/TEMP] busy". If
+	// empty and Close isn't set the command is handled normally after Delay
+	Response string
+	// Close closes the connection instead of handling the command, after sending Response
+	// if there is one
+	Close bool
+	// Stall stops answering instead of handling the command, after sending Response if
+	// there is one. Commands are read and ignored until the connection is closed
+	Stall bool
+}
+
+// Server is an in-memory POP3 server. Connections are served using Listen, Pipe or Serve
+type Server struct {
+	// Greeting is sent when a connection is opened, it should include a timestamp for APOP
+	Greeting string
+	// Capabilities are returned by CAPA, which fails if there are none. STLS is added when
+	// TLSConfig is set
+	Capabilities []string
+	// TLSConfig enables STLS when set
+	TLSConfig *tls.Config
+
+	lock      sync.Mutex
+	mailboxes map[string]*Mailbox
+	faults    []*Fault
+	commands  []string
+	listener  net.Listener
+	conns     map[net.Conn]bool
+	// ended is signalled when a connection is removed from conns
+	ended *sync.Cond
+	// connections counts the connections served
+	connections int
+	wait        sync.WaitGroup
+}
+
+// NewServer creates a server with no mailboxes advertising DefaultCapabilities
+func NewServer() *Server {
+	s := &Server{
+		Greeting:     "+OK pop3test ready " + pop3.NewTimestamp("pop3test"),
+		Capabilities: append([]string{}, DefaultCapabilities...),
+		mailboxes:    make(map[string]*Mailbox),
+		conns:        make(map[net.Conn]bool),
+	}
+	s.ended = sync.NewCond(&s.lock)
+
+	return s
+}
+
+// AddMailbox creates the mailbox for username holding messages with the given bodies,
+// replacing any existing mailbox
+func (s *Server) AddMailbox(username string, password string, bodies ...string) *Mailbox {
+	mailbox := &Mailbox{Password: password}
+	mailbox.Add(bodies...)
+
+	s.lock.Lock()
+	s.mailboxes[username] = mailbox
+	s.lock.Unlock()
+
+	return mailbox
+}
+
+// Mailbox returns the mailbox for username, nil if there isn't one
+func (s *Server) Mailbox(username string) *Mailbox {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.mailboxes[username]
+}
+
+// Inject adds a fault, faults are matched in the order they're added
+func (s *Server) Inject(fault Fault) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fault.Command = strings.ToUpper(fault.Command)
+	s.faults = append(s.faults, &fault)
+}
+
+// ClearFaults removes the injected faults
+func (s *Server) ClearFaults() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.faults = nil
+}
+
+// Commands returns the command lines received on every connection in the order received
+func (s *Server) Commands() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string{}, s.commands...)
+}
+
+// Connections returns the number of connections served, including those still open
+func (s *Server) Connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.connections
+}
+
+// Listen starts serving on a loopback port, returning the address to connect to
+func (s *Server) Listen() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	s.listener = listener
+	s.lock.Unlock()
+
+	s.wait.Add(1)
+	go func() {
+		defer s.wait.Done()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.start(conn)
+		}
+	}()
+
+	return listener.Addr().String(), nil
+}
+
+// Pipe returns the client end of an in-memory connection served by the server
+func (s *Server) Pipe() net.Conn {
+	clientConn, serverConn := net.Pipe()
+	s.start(serverConn)
+
+	return clientConn
+}
+
+// Dial returns a connection from Pipe ignoring the address, it can be used as the
+// client's Dialer
+func (s *Server) Dial(network string, addr string) (net.Conn, error) {
+	return s.Pipe(), nil
+}
+
+// Config returns a plaintext config for the mailbox of username, connecting to the
+// address from Listen if it's been called
+func (s *Server) Config(username string) *config.Config {
+	conf := config.NewConfig()
+	conf.UseTLS = false
+	conf.Server = "pop3test"
+	conf.Port = 110
+	conf.Username = username
+
+	s.lock.Lock()
+	if s.listener != nil {
+		addr := s.listener.Addr().(*net.TCPAddr)
+		conf.Server = addr.IP.String()
+		conf.Port = addr.Port
+	}
+	if mailbox := s.mailboxes[username]; mailbox != nil {
+		conf.Password = mailbox.Password
+	}
+	s.lock.Unlock()
+
+	return conf
+}
+
+// Serve answers commands on conn until the session ends
+func (s *Server) Serve(conn net.Conn) {
+	s.lock.Lock()
+	s.conns[conn] = true
+	s.connections++
+	s.lock.Unlock()
+
+	newSession(s, conn).serve()
+
+	s.lock.Lock()
+	delete(s.conns, conn)
+	s.ended.Broadcast()
+	s.lock.Unlock()
+}
+
+// Drop closes the open connections as if the server had timed them out, waiting for the
+// sessions to end without removing any deleted messages. New connections can still be made
+func (s *Server) Drop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	dropped := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conn.Close()
+		dropped = append(dropped, conn)
+	}
+
+	for _, conn := range dropped {
+		for s.conns[conn] {
+			s.ended.Wait()
+		}
+	}
+}
+
+// Close stops listening and closes any open connections, waiting for them to finish
+func (s *Server) Close() error {
+	s.lock.Lock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.lock.Unlock()
+
+	s.Drop()
+	s.wait.Wait()
+	return err
+}
+
+// start serves conn in the background
+func (s *Server) start(conn net.Conn) {
+	s.wait.Add(1)
+	go func() {
+		defer s.wait.Done()
+		s.Serve(conn)
+	}()
+}
+
+// record saves a command line received
+func (s *Server) record(line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.commands = append(s.commands, line)
+}
+
+// fault returns the fault to apply to command, nil if there isn't one
+func (s *Server) fault(command string) *Fault {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, fault := range s.faults {
+		if fault.Command != "" && fault.Command != command {
+			continue
+		}
+		if fault.After > 0 {
+			fault.After--
+			continue
+		}
+
+		if fault.Count > 0 {
+			fault.Count--
+			if fault.Count == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+
+	return nil
+}
+
+// capabilities returns the CAPA response lines
+func (s *Server) capabilities(tlsAvailable bool) []string {
+	caps := append([]string{}, s.Capabilities...)
+	if tlsAvailable {
+		caps = append(caps, "STLS")
+	}
+
+	return caps
+}
+
+// parseID parses a message number
+func parseID(arg string) (int, bool) {
+	id, err := strconv.Atoi(arg)
+	return id, err == nil
+}
@@ -0,0 +1,326 @@
+package pop3test
+
+import (
+    "crypto/md5"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "io"
+    "net"
+    "net/textproto"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+    "github.com/benmj87/gogo-pop3gadget/src/internal/pop3"
+)
+
+// testConn is the client end of a connection to the server
+type testConn struct {
+    t *testing.T
+    text *textproto.Conn
+}
+
+// newTestServer returns a server with a mailbox for user holding two messages
+func newTestServer(t *testing.T) *Server {
+    server := NewServer()
+    server.AddMailbox("user", "secret", "Subject: one\r\n\r\nfirst\r\n.dot\r\n", "Subject: two\r\n\r\nline 1\r\nline 2\r\nline 3\r\n")
+    t.Cleanup(func() { server.Close() })
+
+    return server
+}
+
+// connect opens a connection reading the greeting
+func connect(t *testing.T, conn net.Conn) *testConn {
+    c := &testConn { t: t, text: textproto.NewConn(conn) }
+    t.Cleanup(func() { c.text.Close() })
+
+    greeting, err := c.text.ReadLine()
+    if err != nil || !strings.HasPrefix(greeting, "+OK") {
+        t.Fatalf("Unexpected greeting %v, %v", greeting, err)
+    }
+
+    return c
+}
+
+// send sends a command returning the status line
+func (c *testConn) send(command string) string {
+    err := c.text.PrintfLine("%s", command)
+    if err != nil {
+        c.t.Fatal(err)
+    }
+
+    line, err := c.text.ReadLine()
+    if err != nil {
+        c.t.Fatalf("No response to %v: %v", command, err)
+    }
+
+    return line
+}
+
+// expect sends a command failing the test unless the status line starts with prefix
+func (c *testConn) expect(command string, prefix string) string {
+    line := c.send(command)
+    if !strings.HasPrefix(line, prefix) {
+        c.t.Fatalf("Unexpected response to %v: %v", command, line)
+    }
+
+    return line
+}
+
+// multiline reads a dot terminated response
+func (c *testConn) multiline() string {
+    lines, err := c.text.ReadDotLines()
+    if err != nil {
+        c.t.Fatal(err)
+    }
+
+    return strings.Join(lines, "\n")
+}
+
+// login logs in to the mailbox of user
+func (c *testConn) login() {
+    c.expect("USER user", "+OK")
+    c.expect("PASS secret", "+OK 2 messages")
+}
+
+// Test_Session checks a full session, with deletes removed on QUIT
+func Test_Session(t *testing.T) {
+    server := newTestServer(t)
+    c := connect(t, server.Pipe())
+
+    c.expect("STAT", "-ERR")
+    c.login()
+
+    c.expect("STAT", "+OK 2 ")
+    c.expect("LIST", "+OK")
+    if list := c.multiline(); list != "1 29\n2 40" {
+        t.Errorf("Unexpected LIST %q", list)
+    }
+    c.expect("UIDL 2", "+OK 2 uid-2")
+
+    c.expect("RETR 1", "+OK 29 octets")
+    if body := c.multiline(); body != "Subject: one\n\nfirst\n.dot" {
+        t.Errorf("Unexpected RETR %q", body)
+    }
+
+    c.expect("TOP 2 1", "+OK")
+    if top := c.multiline(); top != "Subject: two\n\nline 1" {
+        t.Errorf("Unexpected TOP %q", top)
+    }
+
+    c.expect("DELE 1", "+OK")
+    c.expect("DELE 1", "-ERR")
+    c.expect("RETR 1", "-ERR")
+    c.expect("RSET", "+OK")
+    c.expect("DELE 1", "+OK")
+    c.expect("UIDL", "+OK")
+    if uidl := c.multiline(); uidl != "2 uid-2" {
+        t.Errorf("Unexpected UIDL %q", uidl)
+    }
+
+    mailbox := server.Mailbox("user")
+    if !mailbox.Locked() || len(mailbox.Messages()) != 2 {
+        t.Error("Mailbox changed before QUIT")
+    }
+
+    c.expect("QUIT", "+OK")
+    messages := mailbox.Messages()
+    if mailbox.Locked() || len(messages) != 1 || messages[0].UID != "uid-2" {
+        t.Errorf("Delete not committed %v", messages)
+    }
+
+    if commands := server.Commands(); len(commands) != 15 || commands[0] != "STAT" {
+        t.Errorf("Unexpected commands %v", commands)
+    }
+}
+
+// Test_SessionDropped checks nothing is deleted and the lock is released when the connection closes without QUIT
+func Test_SessionDropped(t *testing.T) {
+    server := newTestServer(t)
+    c := connect(t, server.Pipe())
+    c.login()
+    c.expect("DELE 1", "+OK")
+
+    other := connect(t, server.Pipe())
+    other.expect("USER user", "+OK")
+    other.expect("PASS secret", "-ERR [IN-USE]")
+
+    c.text.Close()
+    server.Close()
+
+    mailbox := server.Mailbox("user")
+    if mailbox.Locked() || len(mailbox.Messages()) != 2 {
+        t.Error("Mailbox changed without QUIT")
+    }
+}
+
+// Test_Login checks USER/PASS, APOP and AUTH PLAIN
+func Test_Login(t *testing.T) {
+    server := newTestServer(t)
+
+    c := connect(t, server.Pipe())
+    c.expect("PASS secret", "-ERR")
+    c.expect("USER user", "+OK")
+    c.expect("PASS wrong", "-ERR [AUTH]")
+    c.expect("USER other", "+OK")
+    c.expect("PASS secret", "-ERR [AUTH]")
+    c.expect("QUIT", "+OK")
+
+    digest := md5.Sum([]byte(pop3.GreetingTimestamp(server.Greeting) + "secret"))
+    c = connect(t, server.Pipe())
+    c.expect("APOP user " + hex.EncodeToString(digest[:]), "+OK")
+    c.expect("QUIT", "+OK")
+
+    c = connect(t, server.Pipe())
+    c.expect("AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")), "+OK")
+    c.expect("QUIT", "+OK")
+
+    c = connect(t, server.Pipe())
+    c.expect("AUTH PLAIN", "+ ")
+    c.expect(base64.StdEncoding.EncodeToString([]byte("\x00user\x00wrong")), "-ERR [AUTH]")
+}
+
+// Test_Capabilities checks CAPA lists the capabilities and fails if there are none
+func Test_Capabilities(t *testing.T) {
+    server := newTestServer(t)
+
+    c := connect(t, server.Pipe())
+    c.expect("CAPA", "+OK")
+    if caps := c.multiline(); caps != strings.Join(DefaultCapabilities, "\n") {
+        t.Errorf("Unexpected capabilities %q", caps)
+    }
+
+    server.Capabilities = nil
+    c = connect(t, server.Pipe())
+    c.expect("CAPA", "-ERR")
+}
+
+// Test_Faults checks injected faults replace the normal responses
+func Test_Faults(t *testing.T) {
+    server := newTestServer(t)
+    server.Inject(Fault { Command: "retr", Count: 1, Response: "-ERR [SYS/TEMP] busy" })
+    server.Inject(Fault { Command: "DELE", Close: true })
+
+    c := connect(t, server.Pipe())
+    c.login()
+    c.expect("RETR 1", "-ERR [SYS/TEMP] busy")
+    c.expect("RETR 1", "+OK")
+    c.multiline()
+
+    c.text.PrintfLine("DELE 1")
+    _, err := c.text.ReadLine()
+    if err == nil {
+        t.Error("Connection not closed")
+    }
+
+    server.ClearFaults()
+    server.Close()
+    c = connect(t, server.Pipe())
+    c.login()
+    c.expect("DELE 1", "+OK")
+}
+
+// Test_FaultTiming checks After lets commands through, Interval slows the response and Stall stops answering
+func Test_FaultTiming(t *testing.T) {
+    server := newTestServer(t)
+    server.Inject(Fault { Command: "LIST", After: 1, Count: 1, Interval: 20 * time.Millisecond })
+    server.Inject(Fault { Command: "NOOP", Response: "+OK stalling", Stall: true })
+
+    conn := server.Pipe()
+    c := connect(t, conn)
+    c.login()
+    c.expect("LIST", "+OK")
+    c.multiline()
+
+    start := time.Now()
+    c.expect("LIST", "+OK")
+    c.multiline()
+    if time.Since(start) < 60 * time.Millisecond {
+        t.Errorf("Response wasn't slowed, took %v", time.Since(start))
+    }
+
+    c.expect("NOOP", "+OK stalling")
+    c.text.PrintfLine("STAT")
+    conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+    _, err := c.text.ReadLine()
+    var netErr net.Error
+    if !errors.As(err, &netErr) || !netErr.Timeout() {
+        t.Errorf("Expected a timeout waiting for a stalled response, got %v", err)
+    }
+}
+
+// Test_Drop checks dropped connections end without applying deletes and new ones can be made
+func Test_Drop(t *testing.T) {
+    server := newTestServer(t)
+
+    c := connect(t, server.Pipe())
+    c.login()
+    c.expect("DELE 1", "+OK")
+
+    server.Drop()
+    _, err := c.text.ReadLine()
+    if err == nil {
+        t.Error("Connection not closed")
+    }
+
+    c = connect(t, server.Pipe())
+    c.login()
+    c.expect("STAT", "+OK 2 ")
+    if server.Connections() != 2 {
+        t.Errorf("Expected 2 connections, got %v", server.Connections())
+    }
+}
+
+// Test_PipeliningUnbuffered checks a batch of commands written over net.Pipe doesn't deadlock while the responses
+// to the first ones are unread
+func Test_PipeliningUnbuffered(t *testing.T) {
+    server := newTestServer(t)
+
+    conn := server.Pipe()
+    c := connect(t, conn)
+    c.login()
+
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    _, err := io.WriteString(conn, strings.Repeat("RETR 2\r\n", 1000))
+    if err != nil {
+        t.Fatalf("Writing the batch blocked, %v", err)
+    }
+
+    for i := 0; i < 1000; i++ {
+        c.text.ReadLine()
+        if body := c.multiline(); body != "Subject: two\n\nline 1\nline 2\nline 3" {
+            t.Fatalf("Unexpected response %v %q", i, body)
+        }
+    }
+}
+
+// Test_Listen checks the server accepts connections on the loopback interface and Config points to it
+func Test_Listen(t *testing.T) {
+    server := newTestServer(t)
+    addr, err := server.Listen()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    conf := server.Config("user")
+    if conf.Server != "127.0.0.1" || conf.Password != "secret" || conf.UseTLS || net.JoinHostPort(conf.Server, strconv.Itoa(conf.Port)) != addr {
+        t.Errorf("Unexpected config %+v", conf)
+    }
+
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c := connect(t, conn)
+    c.login()
+    c.expect("QUIT", "+OK")
+
+    err = server.Close()
+    if err != nil {
+        t.Error(err)
+    }
+    if _, err = net.Dial("tcp", addr); err == nil {
+        t.Error("Still listening after Close")
+    }
+}
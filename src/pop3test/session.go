@@ -0,0 +1,416 @@
+package pop3test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/benmj87/gogo-pop3gadget/src/internal/pop3"
+)
+
+// session is a connection to the Server, serving the in-memory mailboxes after applying
+// any injected faults
+type session struct {
+	server *Server
+	// raw is the connection as accepted, before any STLS upgrade
+	raw  net.Conn
+	conn net.Conn
+	// writer sends the replies, text reads from conn and writes to it
+	writer *queueWriter
+	text   *textproto.Conn
+	isTLS  bool
+	// user holds the name given by USER
+	user string
+	// mailbox is set once logged in, i.e. in the TRANSACTION state
+	mailbox *Mailbox
+	// messages holds the snapshot of the mailbox taken when logging in
+	messages []Message
+	deleted  map[int]bool
+	// interval holds the Fault.Interval applying to the command being answered
+	interval time.Duration
+}
+
+// newSession creates the session for conn
+func newSession(server *Server, conn net.Conn) *session {
+	_, isTLS := conn.(*tls.Conn)
+	s := &session{
+		server: server,
+		raw:    conn,
+		isTLS:  isTLS,
+	}
+	s.setConn(conn)
+
+	return s
+}
+
+// setConn sets the connection read and written, e.g. after upgrading with STLS
+func (s *session) setConn(conn net.Conn) {
+	s.conn = conn
+	s.writer = newQueueWriter(conn)
+	s.text = textproto.NewConn(struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{conn, s.writer, conn})
+}
+
+// serve runs the session, recording each command line and applying the first fault
+// matching it before it's handled
+func (s *session) serve() {
+	defer func() {
+		// the session ended without QUIT so nothing is deleted
+		if s.mailbox != nil {
+			s.mailbox.close(nil)
+		}
+		// the replies are sent before closing, closing the TLS connection would wait for
+		// the client to read close_notify
+		s.writer.Stop()
+		s.raw.Close()
+	}()
+
+	s.reply(s.server.Greeting)
+	for {
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.server.record(line)
+
+		command, arg := pop3.ParseCommand(strings.TrimSpace(line))
+		if command == "" {
+			s.reply("-ERR empty command")
+			continue
+		}
+		args := strings.Fields(arg)
+
+		if fault := s.server.fault(command); fault != nil {
+			time.Sleep(fault.Delay)
+			s.interval = fault.Interval
+			if fault.Response != "" {
+				s.reply(fault.Response)
+			}
+			if fault.Close {
+				return
+			}
+			if fault.Stall {
+				s.ignore()
+				return
+			}
+			if fault.Response != "" {
+				s.interval = 0
+				continue
+			}
+		}
+
+		open := s.handle(command, args)
+		s.interval = 0
+		if !open {
+			return
+		}
+	}
+}
+
+// ignore reads commands without answering them until the connection is closed
+func (s *session) ignore() {
+	for {
+		_, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handle checks a command is valid in the current state before running it, returning
+// false once the connection should be closed
+func (s *session) handle(command string, args []string) bool {
+	switch command {
+	case "CAPA":
+		s.capa()
+	case "QUIT":
+		s.quit()
+		return false
+	case "STLS":
+		return s.stls()
+	case "USER", "PASS", "APOP", "AUTH":
+		if s.mailbox != nil {
+			s.reply("-ERR already logged in")
+			return true
+		}
+		s.login(command, args)
+	case "STAT", "LIST", "UIDL", "RETR", "TOP", "DELE", "NOOP", "RSET":
+		if s.mailbox == nil {
+			s.reply("-ERR not logged in")
+			return true
+		}
+		s.transaction(command, args)
+	default:
+		s.reply("-ERR unknown command")
+	}
+
+	return true
+}
+
+// capa lists Server.Capabilities, failing if there are none as servers without CAPA do
+func (s *session) capa() {
+	caps := s.server.capabilities(s.server.TLSConfig != nil && !s.isTLS && s.mailbox == nil)
+	if len(caps) == 0 {
+		s.reply("-ERR CAPA not supported")
+		return
+	}
+
+	s.reply("+OK capability list follows")
+	for _, capability := range caps {
+		s.reply(capability)
+	}
+	s.reply(".")
+}
+
+// quit unlocks the mailbox, applying the deletions made in the session
+func (s *session) quit() {
+	if s.mailbox != nil {
+		deleted := make(map[string]bool)
+		for id := range s.deleted {
+			deleted[s.messages[id-1].UID] = true
+		}
+		s.mailbox.close(deleted)
+		s.mailbox = nil
+	}
+
+	s.reply("+OK bye")
+}
+
+// stls upgrades the connection using Server.TLSConfig, returning false if the handshake
+// fails
+func (s *session) stls() bool {
+	if s.server.TLSConfig == nil || s.isTLS || s.mailbox != nil {
+		s.reply("-ERR STLS not available")
+		return true
+	}
+
+	s.reply("+OK begin TLS negotiation")
+	if s.writer.Stop() != nil {
+		return false
+	}
+
+	conn := tls.Server(s.conn, s.server.TLSConfig)
+	err := conn.Handshake()
+	if err != nil {
+		return false
+	}
+
+	s.setConn(conn)
+	s.isTLS = true
+	return true
+}
+
+// login checks the credentials given by USER and PASS, APOP or AUTH against the mailbox
+// passwords
+func (s *session) login(command string, args []string) {
+	switch command {
+	case "USER":
+		if len(args) != 1 {
+			s.reply("-ERR USER requires a name")
+			return
+		}
+		s.user = args[0]
+		s.reply("+OK")
+	case "PASS":
+		if s.user == "" {
+			s.reply("-ERR USER first")
+			return
+		}
+		s.open(s.user, func(mailbox *Mailbox) bool {
+			return len(args) > 0 && strings.Join(args, " ") == mailbox.Password
+		})
+	case "APOP":
+		if len(args) != 2 {
+			s.reply("-ERR APOP requires a name and digest")
+			return
+		}
+		s.open(args[0], func(mailbox *Mailbox) bool {
+			digest := pop3.APOPDigest(pop3.GreetingTimestamp(s.server.Greeting), mailbox.Password)
+			return strings.EqualFold(args[1], digest)
+		})
+	case "AUTH":
+		s.auth(args)
+	}
+}
+
+// auth runs an AUTH PLAIN exchange, with the response on the command line or sent after
+// the + continuation
+func (s *session) auth(args []string) {
+	if len(args) == 0 || !strings.EqualFold(args[0], "PLAIN") {
+		s.reply("-ERR unsupported mechanism")
+		return
+	}
+
+	response := ""
+	if len(args) > 1 {
+		response = args[1]
+	} else {
+		s.reply("+ ")
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+		response = line
+	}
+	if response == "*" {
+		s.reply("-ERR authentication cancelled")
+		return
+	}
+
+	_, username, password, err := pop3.DecodePlain(response)
+	if err != nil {
+		s.reply("-ERR [AUTH] invalid PLAIN response")
+		return
+	}
+
+	s.open(username, func(mailbox *Mailbox) bool {
+		return password == mailbox.Password
+	})
+}
+
+// open logs in to the mailbox of user if check accepts the credentials
+func (s *session) open(user string, check func(*Mailbox) bool) {
+	mailbox := s.server.Mailbox(user)
+	if mailbox == nil || !check(mailbox) {
+		s.reply("-ERR [AUTH] invalid credentials")
+		return
+	}
+
+	messages, ok := mailbox.open()
+	if !ok {
+		s.reply("-ERR [IN-USE] mailbox locked")
+		return
+	}
+
+	s.mailbox = mailbox
+	s.messages = messages
+	s.deleted = make(map[int]bool)
+	s.reply(fmt.Sprintf("+OK %d messages", len(messages)))
+}
+
+// transaction answers the commands used once logged in, from the snapshot of the mailbox
+func (s *session) transaction(command string, args []string) {
+	switch command {
+	case "STAT":
+		count, size := 0, 0
+		for id, message := range s.messages {
+			if !s.deleted[id+1] {
+				count++
+				size += len(message.Body)
+			}
+		}
+		s.reply(fmt.Sprintf("+OK %d %d", count, size))
+	case "LIST", "UIDL":
+		s.list(command, args)
+	case "RETR":
+		message, ok := s.message(args)
+		if !ok {
+			return
+		}
+		s.reply(fmt.Sprintf("+OK %d octets", len(message.Body)))
+		s.body(message.Body)
+	case "TOP":
+		s.top(args)
+	case "DELE":
+		message, ok := s.message(args)
+		if !ok {
+			return
+		}
+		id, _ := parseID(args[0])
+		s.deleted[id] = true
+		s.reply(fmt.Sprintf("+OK message %d deleted (%v)", id, message.UID))
+	case "NOOP":
+		s.reply("+OK")
+	case "RSET":
+		s.deleted = make(map[int]bool)
+		s.reply(fmt.Sprintf("+OK %d messages", len(s.messages)))
+	}
+}
+
+// list answers LIST with the body sizes or UIDL with the unique-ids
+func (s *session) list(command string, args []string) {
+	entry := func(id int, message Message) string {
+		if command == "UIDL" {
+			return fmt.Sprintf("%d %v", id, message.UID)
+		}
+		return fmt.Sprintf("%d %d", id, len(message.Body))
+	}
+
+	if len(args) > 0 {
+		message, ok := s.message(args)
+		if ok {
+			id, _ := parseID(args[0])
+			s.reply("+OK " + entry(id, message))
+		}
+		return
+	}
+
+	s.reply("+OK")
+	for id, message := range s.messages {
+		if !s.deleted[id+1] {
+			s.reply(entry(id+1, message))
+		}
+	}
+	s.reply(".")
+}
+
+// top validates the TOP arguments and sends the start of the message
+func (s *session) top(args []string) {
+	if len(args) != 2 {
+		s.reply("-ERR TOP requires a message and line count")
+		return
+	}
+	lines, ok := parseID(args[1])
+	if !ok || lines < 0 {
+		s.reply("-ERR invalid line count")
+		return
+	}
+	message, ok := s.message(args)
+	if !ok {
+		return
+	}
+
+	var content strings.Builder
+	pop3.CopyTop(&content, strings.NewReader(message.Body), lines)
+
+	s.reply("+OK")
+	s.body(content.String())
+}
+
+// message looks up the message numbered by the first argument in the snapshot, replying
+// with -ERR if it's missing or deleted
+func (s *session) message(args []string) (Message, bool) {
+	if len(args) == 0 {
+		s.reply("-ERR message number required")
+		return Message{}, false
+	}
+
+	id, ok := parseID(args[0])
+	if !ok || id < 1 || id > len(s.messages) || s.deleted[id] {
+		s.reply("-ERR no such message")
+		return Message{}, false
+	}
+
+	return s.messages[id-1], true
+}
+
+// body sends content dot-stuffed and terminated with a single dot
+func (s *session) body(content string) {
+	time.Sleep(s.interval)
+	writer := s.text.DotWriter()
+	io.WriteString(writer, content)
+	writer.Close()
+}
+
+// reply sends a line, errors are picked up by the next read
+func (s *session) reply(line string) {
+	time.Sleep(s.interval)
+	s.text.PrintfLine("%s", line)
+}
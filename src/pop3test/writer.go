@@ -0,0 +1,96 @@
+package pop3test
+
+import (
+	"io"
+	"sync"
+)
+
+// queueWriter queues writes and sends them on its own goroutine, so a session answering
+// pipelined commands keeps reading while the client is still writing the rest of them.
+// Without it both ends of an unbuffered connection such as net.Pipe can block writing
+type queueWriter struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	w       io.Writer
+	pending []byte
+	writing bool
+	stopped bool
+	// err holds the first write error, returned by later writes
+	err error
+}
+
+// newQueueWriter starts sending writes to w
+func newQueueWriter(w io.Writer) *queueWriter {
+	q := &queueWriter{w: w}
+	q.changed = sync.NewCond(&q.lock)
+	go q.run()
+
+	return q
+}
+
+// Write queues b to be sent
+func (q *queueWriter) Write(b []byte) (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.err != nil {
+		return 0, q.err
+	}
+
+	q.pending = append(q.pending, b...)
+	q.changed.Broadcast()
+	return len(b), nil
+}
+
+// Flush waits until everything queued has been sent or a write fails
+func (q *queueWriter) Flush() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for q.err == nil && (len(q.pending) > 0 || q.writing) {
+		q.changed.Wait()
+	}
+
+	return q.err
+}
+
+// Stop sends what's queued and then stops the goroutine, the connection isn't closed
+func (q *queueWriter) Stop() error {
+	err := q.Flush()
+
+	q.lock.Lock()
+	q.stopped = true
+	q.changed.Broadcast()
+	q.lock.Unlock()
+
+	return err
+}
+
+// run sends the queued writes until stopped
+func (q *queueWriter) run() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		for !q.stopped && q.err == nil && len(q.pending) == 0 {
+			q.changed.Wait()
+		}
+		if q.stopped || q.err != nil {
+			return
+		}
+
+		data := q.pending
+		q.pending = nil
+		q.writing = true
+		q.lock.Unlock()
+
+		_, err := q.w.Write(data)
+
+		q.lock.Lock()
+		q.writing = false
+		if err != nil {
+			q.err = err
+		}
+		q.changed.Broadcast()
+	}
+}
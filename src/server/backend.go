@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrAuthFailed is returned by a Backend when the credentials are wrong, the client
+	// is sent [AUTH]
+	ErrAuthFailed = errors.New("invalid credentials")
+	// ErrMailboxLocked is returned by a Backend when the mailbox is already in use, the
+	// client is sent [IN-USE]
+	ErrMailboxLocked = errors.New("mailbox locked")
+)
+
+// Backend authenticates users and opens their mailboxes
+type Backend interface {
+	// Login checks the password and returns the user's mailbox locked for the session,
+	// returning ErrAuthFailed or ErrMailboxLocked if it can't be opened
+	Login(username string, password string) (Mailbox, error)
+}
+
+// APOPBackend is implemented by backends able to check APOP digests, i.e. those with
+// access to the plaintext password. The server only includes the APOP timestamp in its
+// greeting when the backend implements it
+type APOPBackend interface {
+	Backend
+	// LoginAPOP checks digest is the hex MD5 of timestamp followed by the user's password
+	LoginAPOP(username string, timestamp string, digest string) (Mailbox, error)
+}
+
+// MessageInfo describes a message in a mailbox
+type MessageInfo struct {
+	// UID is the unique-id returned by UIDL, 1 to 70 characters from 0x21 to 0x7E
+	UID string
+	// Size is the size of the message in octets with CRLF line endings
+	Size int64
+}
+
+// Mailbox is a mailbox opened for one session. Messages are numbered by their index in
+// List, which mustn't change during the session
+type Mailbox interface {
+	// List returns the messages in the mailbox when the session started
+	List() ([]MessageInfo, error)
+	// Open returns the content of the message at index. Line endings may be LF or CRLF,
+	// they're sent as CRLF
+	Open(index int) (io.ReadCloser, error)
+	// Delete removes the messages at the indexes, it's called once the client ends the
+	// session with QUIT (the UPDATE state)
+	Delete(indexes []int) error
+	// Close releases the mailbox lock, it's called when the session ends
+	Close() error
+}
@@ -0,0 +1,539 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benmj87/gogo-pop3gadget/src/internal/pop3"
+)
+
+// maxLine limits the length of a command line, RFC 2449 allows 255 octets for commands
+// but SASL responses may be longer
+const maxLine = 4096
+
+// maxAuthFailures is the number of failed logins allowed before the connection is closed
+const maxAuthFailures = 3
+
+// errLineTooLong is returned by readLine when the line doesn't fit in the buffer
+var errLineTooLong = errors.New("line too long")
+
+// conn holds the state of a single connection
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	isTLS   bool
+	remote  string
+	// timestamp holds the greeting timestamp used by APOP, empty if the backend doesn't support it
+	timestamp string
+	// user holds the name given by USER
+	user         string
+	authFailures int
+	// mailbox is set once logged in, i.e. in the TRANSACTION state
+	mailbox  Mailbox
+	messages []MessageInfo
+	deleted  map[int]bool
+}
+
+// newConn creates the session state for netConn
+func newConn(server *Server, netConn net.Conn) *conn {
+	_, isTLS := netConn.(*tls.Conn)
+	c := &conn{
+		server:  server,
+		netConn: netConn,
+		isTLS:   isTLS,
+		remote:  netConn.RemoteAddr().String(),
+	}
+	c.setConn(netConn)
+
+	return c
+}
+
+// setConn sets the connection read and written, e.g. after upgrading with STLS
+func (c *conn) setConn(netConn net.Conn) {
+	c.netConn = netConn
+	c.reader = bufio.NewReaderSize(netConn, maxLine)
+	c.writer = bufio.NewWriter(&deadlineWriter{conn: netConn, timeout: c.server.idleTimeout()})
+}
+
+// deadlineWriter sets the write deadline before each write, so a client that stops
+// reading a response is disconnected rather than blocking the session, and its mailbox
+// lock, forever. Large responses have as long as they keep being read
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// Write writes to the connection
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	err := w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	if err != nil {
+		return 0, err
+	}
+
+	return w.conn.Write(b)
+}
+
+// serve sends the greeting and answers commands until the session ends
+func (c *conn) serve() {
+	logger := c.server.logger()
+	logger.Info("Session started", "remote", c.remote, "tls", c.isTLS)
+
+	defer func() {
+		// the session ended without QUIT so nothing is removed
+		if c.mailbox != nil {
+			c.mailbox.Close()
+		}
+		c.netConn.Close()
+		logger.Info("Session ended", "remote", c.remote)
+	}()
+
+	// the timestamp tells clients APOP is available (RFC 1939)
+	greeting := "+OK POP3 server ready"
+	if _, ok := c.server.Backend.(APOPBackend); ok {
+		c.timestamp = pop3.NewTimestamp(c.server.hostname())
+		greeting += " " + c.timestamp
+	}
+	c.reply(greeting)
+
+	for {
+		// responses to pipelined commands are sent together
+		if c.reader.Buffered() == 0 {
+			if c.writer.Flush() != nil {
+				return
+			}
+		}
+
+		// once idle Shutdown may move the deadline, commands already read are still answered
+		c.netConn.SetReadDeadline(time.Now().Add(c.server.idleTimeout()))
+		if !c.server.setIdle(c, true) && c.reader.Buffered() == 0 {
+			logger.Info("Ending idle session for shutdown", "remote", c.remote)
+			return
+		}
+		line, err := c.readLine()
+		c.server.setIdle(c, false)
+		if errors.Is(err, errLineTooLong) {
+			c.reply("-ERR line too long")
+			c.writer.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		command, arg := pop3.ParseCommand(line)
+		logger.Debug("Received", "remote", c.remote, "command", command)
+
+		if !c.handle(command, arg) {
+			c.writer.Flush()
+			return
+		}
+	}
+}
+
+// readLine reads a line without the line ending
+func (c *conn) readLine() (string, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// handle answers a command, returning false once the session has ended
+func (c *conn) handle(command string, arg string) bool {
+	switch command {
+	case "CAPA":
+		c.capa()
+		return true
+	case "QUIT":
+		c.quit()
+		return false
+	}
+
+	if c.mailbox == nil {
+		return c.authorization(command, arg)
+	}
+
+	c.transaction(command, arg)
+	return true
+}
+
+// capa lists the capabilities (RFC 2449)
+func (c *conn) capa() {
+	caps := []string{"TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING"}
+	if c.mailbox == nil {
+		if c.canStartTLS() {
+			caps = append(caps, "STLS")
+		}
+		if c.authAllowed() {
+			caps = append(caps, "USER", "SASL PLAIN")
+		}
+	}
+	caps = append(caps, "IMPLEMENTATION gogo-pop3gadget")
+
+	c.reply("+OK capability list follows")
+	for _, capability := range caps {
+		c.reply(capability)
+	}
+	c.reply(".")
+}
+
+// quit ends the session, removing the deleted messages if logged in (the UPDATE state)
+func (c *conn) quit() {
+	if c.mailbox == nil {
+		c.reply("+OK bye")
+		return
+	}
+
+	indexes := make([]int, 0, len(c.deleted))
+	for index := range c.deleted {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var err error
+	if len(indexes) > 0 {
+		err = c.mailbox.Delete(indexes)
+	}
+	c.mailbox.Close()
+	c.mailbox = nil
+
+	if err != nil {
+		c.server.logger().Error("Unable to remove deleted messages", "remote", c.remote, "user", c.user, "error", err)
+		c.reply("-ERR [SYS/TEMP] some deleted messages not removed")
+		return
+	}
+
+	c.reply(fmt.Sprintf("+OK bye, %d messages removed", len(indexes)))
+}
+
+// authorization handles the commands before logging in, returning false if the
+// connection should be closed
+func (c *conn) authorization(command string, arg string) bool {
+	switch command {
+	case "STLS":
+		return c.startTLS()
+	case "USER":
+		if !c.authAllowed() {
+			c.reply("-ERR STLS required before logging in")
+			return true
+		}
+		if arg == "" {
+			c.reply("-ERR USER requires a name")
+			return true
+		}
+		c.user = arg
+		c.reply("+OK")
+	case "PASS":
+		if !c.authAllowed() {
+			c.reply("-ERR STLS required before logging in")
+			return true
+		}
+		if c.user == "" {
+			c.reply("-ERR USER first")
+			return true
+		}
+		return c.login(c.user, func() (Mailbox, error) {
+			return c.server.Backend.Login(c.user, arg)
+		})
+	case "APOP":
+		backend, ok := c.server.Backend.(APOPBackend)
+		name, digest, found := strings.Cut(arg, " ")
+		if !ok {
+			c.reply("-ERR APOP not supported")
+			return true
+		}
+		if !found {
+			c.reply("-ERR APOP requires a name and digest")
+			return true
+		}
+		return c.login(name, func() (Mailbox, error) {
+			return backend.LoginAPOP(name, c.timestamp, digest)
+		})
+	case "AUTH":
+		return c.auth(arg)
+	default:
+		c.reply("-ERR command not valid before logging in")
+	}
+
+	return true
+}
+
+// auth handles AUTH (RFC 5034), only PLAIN (RFC 4616) is supported
+func (c *conn) auth(arg string) bool {
+	if !c.authAllowed() {
+		c.reply("-ERR STLS required before logging in")
+		return true
+	}
+
+	mechanism, response, found := strings.Cut(arg, " ")
+	if !strings.EqualFold(mechanism, "PLAIN") {
+		c.reply("-ERR unsupported SASL mechanism")
+		return true
+	}
+
+	if !found {
+		c.reply("+ ")
+		if c.writer.Flush() != nil {
+			return false
+		}
+
+		line, err := c.readLine()
+		if err != nil {
+			return false
+		}
+		response = line
+	}
+	if response == "*" {
+		c.reply("-ERR authentication cancelled")
+		return true
+	}
+
+	identity, username, password, err := pop3.DecodePlain(response)
+	if err != nil {
+		c.reply("-ERR invalid PLAIN response")
+		return true
+	}
+
+	// logging in as another user isn't supported
+	if identity != "" && identity != username {
+		c.reply("-ERR [AUTH] authorization identity not permitted")
+		return true
+	}
+
+	return c.login(username, func() (Mailbox, error) {
+		return c.server.Backend.Login(username, password)
+	})
+}
+
+// login opens the mailbox, moving to the TRANSACTION state. It returns false once there
+// have been too many failures
+func (c *conn) login(user string, open func() (Mailbox, error)) bool {
+	logger := c.server.logger()
+
+	mailbox, err := open()
+	switch {
+	case errors.Is(err, ErrAuthFailed):
+		c.authFailures++
+		logger.Warn("Login failed", "remote", c.remote, "user", user)
+		if c.authFailures >= maxAuthFailures {
+			c.reply("-ERR [AUTH] too many failures")
+			return false
+		}
+		c.reply("-ERR [AUTH] invalid credentials")
+		return true
+	case errors.Is(err, ErrMailboxLocked):
+		c.reply("-ERR [IN-USE] mailbox locked")
+		return true
+	case err != nil:
+		logger.Error("Unable to open mailbox", "remote", c.remote, "user", user, "error", err)
+		c.reply("-ERR [SYS/TEMP] unable to open mailbox")
+		return true
+	}
+
+	messages, err := mailbox.List()
+	if err != nil {
+		mailbox.Close()
+		logger.Error("Unable to list mailbox", "remote", c.remote, "user", user, "error", err)
+		c.reply("-ERR [SYS/TEMP] unable to open mailbox")
+		return true
+	}
+
+	c.user = user
+	c.mailbox = mailbox
+	c.messages = messages
+	c.deleted = make(map[int]bool)
+
+	logger.Info("Logged in", "remote", c.remote, "user", user, "messages", len(messages))
+	c.reply(fmt.Sprintf("+OK %d messages", len(messages)))
+	return true
+}
+
+// startTLS upgrades the connection (RFC 2595), returning false if the handshake fails
+func (c *conn) startTLS() bool {
+	if !c.canStartTLS() {
+		c.reply("-ERR STLS not available")
+		return true
+	}
+
+	c.reply("+OK begin TLS negotiation")
+	if c.writer.Flush() != nil {
+		return false
+	}
+
+	// anything pipelined after STLS was sent in plaintext and is discarded
+	tlsConn := tls.Server(c.netConn, c.server.TLSConfig)
+	tlsConn.SetDeadline(time.Now().Add(c.server.idleTimeout()))
+	err := tlsConn.Handshake()
+	if err != nil {
+		c.server.logger().Warn("TLS handshake failed", "remote", c.remote, "error", err)
+		return false
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	c.setConn(tlsConn)
+	c.isTLS = true
+	c.user = ""
+	return true
+}
+
+// canStartTLS returns whether STLS is available
+func (c *conn) canStartTLS() bool {
+	return c.server.TLSConfig != nil && !c.isTLS && c.mailbox == nil
+}
+
+// authAllowed returns whether passwords may be sent
+func (c *conn) authAllowed() bool {
+	return c.isTLS || c.server.AllowInsecureAuth
+}
+
+// transaction handles the commands once logged in
+func (c *conn) transaction(command string, arg string) {
+	switch command {
+	case "STAT":
+		count, size := 0, int64(0)
+		for index, message := range c.messages {
+			if !c.deleted[index] {
+				count++
+				size += message.Size
+			}
+		}
+		c.reply(fmt.Sprintf("+OK %d %d", count, size))
+	case "LIST", "UIDL":
+		c.list(command, arg)
+	case "RETR":
+		index, ok := c.message(arg)
+		if ok {
+			c.send(index, -1)
+		}
+	case "TOP":
+		c.top(arg)
+	case "DELE":
+		index, ok := c.message(arg)
+		if ok {
+			c.deleted[index] = true
+			c.reply(fmt.Sprintf("+OK message %d deleted", index+1))
+		}
+	case "NOOP":
+		c.reply("+OK")
+	case "RSET":
+		c.deleted = make(map[int]bool)
+		c.reply(fmt.Sprintf("+OK %d messages", len(c.messages)))
+	case "STLS", "USER", "PASS", "APOP", "AUTH":
+		c.reply("-ERR already logged in")
+	default:
+		c.reply("-ERR unknown command")
+	}
+}
+
+// list handles LIST and UIDL, for a single message or the whole mailbox
+func (c *conn) list(command string, arg string) {
+	entry := func(index int) string {
+		if command == "UIDL" {
+			return fmt.Sprintf("%d %v", index+1, c.messages[index].UID)
+		}
+		return fmt.Sprintf("%d %d", index+1, c.messages[index].Size)
+	}
+
+	if arg != "" {
+		index, ok := c.message(arg)
+		if ok {
+			c.reply("+OK " + entry(index))
+		}
+		return
+	}
+
+	c.reply("+OK")
+	for index := range c.messages {
+		if !c.deleted[index] {
+			c.reply(entry(index))
+		}
+	}
+	c.reply(".")
+}
+
+// top handles TOP, sending the headers and the first lines of the body
+func (c *conn) top(arg string) {
+	id, count, _ := strings.Cut(arg, " ")
+	lines, err := strconv.Atoi(count)
+	if err != nil || lines < 0 {
+		c.reply("-ERR TOP requires a message number and line count")
+		return
+	}
+
+	index, ok := c.message(id)
+	if ok {
+		c.send(index, lines)
+	}
+}
+
+// message returns the index of the message numbered by arg, replying with an error if
+// there isn't one
+func (c *conn) message(arg string) (int, bool) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		c.reply("-ERR message number required")
+		return 0, false
+	}
+
+	index := id - 1
+	if index < 0 || index >= len(c.messages) || c.deleted[index] {
+		c.reply("-ERR no such message")
+		return 0, false
+	}
+
+	return index, true
+}
+
+// send sends the message at index, or the headers and the first lines of the body for
+// TOP if lines isn't negative. The connection is closed if the message can't be read
+// once the response has started
+func (c *conn) send(index int, lines int) {
+	content, err := c.mailbox.Open(index)
+	if err != nil {
+		c.server.logger().Error("Unable to open message", "remote", c.remote, "user", c.user, "message", index+1, "error", err)
+		c.reply("-ERR [SYS/TEMP] unable to read message")
+		return
+	}
+	defer content.Close()
+
+	if lines < 0 {
+		c.reply(fmt.Sprintf("+OK %d octets", c.messages[index].Size))
+	} else {
+		c.reply("+OK")
+	}
+
+	body := textproto.NewWriter(c.writer).DotWriter()
+	if lines < 0 {
+		_, err = io.Copy(body, content)
+	} else {
+		err = pop3.CopyTop(body, content, lines)
+	}
+	if err != nil {
+		c.server.logger().Error("Unable to read message", "remote", c.remote, "user", c.user, "message", index+1, "error", err)
+		c.netConn.Close()
+		return
+	}
+
+	body.Close()
+}
+
+// reply queues a response line, it's sent before waiting for the next command
+func (c *conn) reply(line string) {
+	c.writer.WriteString(line + "\r\n")
+}
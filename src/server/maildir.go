@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MaildirBackend serves mailboxes stored as Maildirs, one for each user under Root. New
+// messages are moved to cur when a session lists them, and the unique-id of a message is
+// its Maildir file name. Mailboxes are only locked against other sessions of the same
+// backend, not other processes
+type MaildirBackend struct {
+	// Root holds the Maildir of each user, e.g. Root/alice/cur
+	Root string
+	// Authenticate checks the password for a user, returning ErrAuthFailed if it's wrong.
+	// Every login fails if it isn't set
+	Authenticate func(username string, password string) error
+
+	lock   sync.Mutex
+	locked map[string]bool
+}
+
+// NewMaildirBackend creates a backend serving the Maildirs under root
+func NewMaildirBackend(root string, authenticate func(username string, password string) error) *MaildirBackend {
+	return &MaildirBackend{
+		Root:         root,
+		Authenticate: authenticate,
+		locked:       make(map[string]bool),
+	}
+}
+
+// Login checks the password and locks the user's Maildir
+func (b *MaildirBackend) Login(username string, password string) (Mailbox, error) {
+	// the name is used in the path so mustn't be able to leave Root
+	if b.Authenticate == nil || username == "" || username == "." || username == ".." || strings.ContainsAny(username, `/\`) {
+		return nil, ErrAuthFailed
+	}
+
+	err := b.Authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(b.Root, username)
+	info, err := os.Stat(filepath.Join(dir, "cur"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open Maildir for %v: %w", username, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("Maildir for %v has no cur directory", username)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.locked == nil {
+		b.locked = make(map[string]bool)
+	}
+	if b.locked[username] {
+		return nil, ErrMailboxLocked
+	}
+	b.locked[username] = true
+
+	return &maildirMailbox{backend: b, username: username, dir: dir}, nil
+}
+
+// unlock releases the lock on the user's Maildir
+func (b *MaildirBackend) unlock(username string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.locked, username)
+}
+
+// maildirMailbox is a Maildir opened for a session
+type maildirMailbox struct {
+	backend  *MaildirBackend
+	username string
+	dir      string
+	// files holds the path of each message listed
+	files  []string
+	closed bool
+}
+
+// List moves any new messages to cur and returns the messages in cur, oldest first
+func (m *maildirMailbox) List() ([]MessageInfo, error) {
+	err := m.deliverNew()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(m.dir, "cur"))
+	if err != nil {
+		return nil, err
+	}
+
+	type entry struct {
+		name string
+		info fs.FileInfo
+	}
+	var found []entry
+	for _, dirEntry := range entries {
+		if strings.HasPrefix(dirEntry.Name(), ".") || !dirEntry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := dirEntry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, entry{dirEntry.Name(), info})
+	}
+
+	sort.Slice(found, func(i int, j int) bool {
+		if !found[i].info.ModTime().Equal(found[j].info.ModTime()) {
+			return found[i].info.ModTime().Before(found[j].info.ModTime())
+		}
+		return found[i].name < found[j].name
+	})
+
+	m.files = make([]string, 0, len(found))
+	messages := make([]MessageInfo, 0, len(found))
+	for _, message := range found {
+		path := filepath.Join(m.dir, "cur", message.name)
+		size, err := messageSize(path, message.name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		m.files = append(m.files, path)
+		messages = append(messages, MessageInfo{UID: maildirUID(message.name), Size: size})
+	}
+
+	return messages, nil
+}
+
+// deliverNew moves the messages in new to cur, marking them as seen by a client
+func (m *maildirMailbox) deliverNew() error {
+	entries, err := os.ReadDir(filepath.Join(m.dir, "new"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, dirEntry := range entries {
+		name := dirEntry.Name()
+		if strings.HasPrefix(name, ".") || !dirEntry.Type().IsRegular() {
+			continue
+		}
+
+		target := name
+		if !strings.Contains(name, ":") {
+			target += ":2,"
+		}
+
+		err = os.Rename(filepath.Join(m.dir, "new", name), filepath.Join(m.dir, "cur", target))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Open opens the message file
+func (m *maildirMailbox) Open(index int) (io.ReadCloser, error) {
+	if index < 0 || index >= len(m.files) {
+		return nil, fmt.Errorf("No message at index %v", index)
+	}
+
+	return os.Open(m.files[index])
+}
+
+// Delete removes the message files, ignoring any already removed
+func (m *maildirMailbox) Delete(indexes []int) error {
+	var firstErr error
+	for _, index := range indexes {
+		if index < 0 || index >= len(m.files) {
+			continue
+		}
+
+		err := os.Remove(m.files[index])
+		if err != nil && !errors.Is(err, fs.ErrNotExist) && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Close unlocks the Maildir
+func (m *maildirMailbox) Close() error {
+	if !m.closed {
+		m.closed = true
+		m.backend.unlock(m.username)
+	}
+
+	return nil
+}
+
+// messageSize returns the size of the message with CRLF line endings, taken from the
+// W= field of the file name if there is one, otherwise by reading the file
+func messageSize(path string, name string) (int64, error) {
+	base, _, _ := strings.Cut(name, ":")
+	for _, field := range strings.Split(base, ",")[1:] {
+		if strings.HasPrefix(field, "W=") {
+			if size, err := strconv.ParseInt(field[2:], 10, 64); err == nil {
+				return size, nil
+			}
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// each bare LF is sent as CRLF
+	var size int64
+	var previous byte
+	reader := bufio.NewReader(file)
+	for {
+		b, err := reader.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		size++
+		if b == '\n' && previous != '\r' {
+			size++
+		}
+		previous = b
+	}
+}
+
+// maildirUID returns the unique-id for the Maildir file name, its base name before the
+// flags. Names that aren't valid unique-ids are hashed
+func maildirUID(name string) string {
+	base, _, _ := strings.Cut(name, ":")
+
+	valid := len(base) > 0 && len(base) <= 70
+	for i := 0; valid && i < len(base); i++ {
+		valid = base[i] >= 0x21 && base[i] <= 0x7E
+	}
+	if valid {
+		return base
+	}
+
+	hash := sha256.Sum256([]byte(base))
+	return hex.EncodeToString(hash[:])[:40]
+}
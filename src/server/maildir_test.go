@@ -0,0 +1,150 @@
+package server
+
+import (
+    "errors"
+    "io"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// newTestMaildir creates the Maildir for user under root holding messages, the keys are
+// paths relative to the Maildir, e.g. new/1.host. Messages are given increasing times
+func newTestMaildir(t *testing.T, root string, user string, messages map[string]string, order []string) {
+    for _, dir := range []string { "cur", "new", "tmp" } {
+        err := os.MkdirAll(filepath.Join(root, user, dir), 0700)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    start := time.Now().Add(-time.Hour)
+    for i, name := range order {
+        path := filepath.Join(root, user, name)
+        err := os.WriteFile(path, []byte(messages[name]), 0600)
+        if err != nil {
+            t.Fatal(err)
+        }
+        os.Chtimes(path, start.Add(time.Duration(i) * time.Minute), start.Add(time.Duration(i) * time.Minute))
+    }
+}
+
+// checkPassword accepts alice with the password secret
+func checkPassword(username string, password string) error {
+    if username != "alice" || password != "secret" {
+        return ErrAuthFailed
+    }
+    return nil
+}
+
+// Test_MaildirList checks new messages are moved to cur and listed oldest first with CRLF sizes
+func Test_MaildirList(t *testing.T) {
+    root := t.TempDir()
+    messages := map[string]string {
+        "cur/1.a.host:2,S": "Subject: one\n\nbody\n",
+        "new/2.b.host": "Subject: two\r\n\r\nbody\r\n",
+        "cur/3.c.host,S=5,W=99:2,": "short",
+    }
+    newTestMaildir(t, root, "alice", messages, []string { "cur/1.a.host:2,S", "new/2.b.host", "cur/3.c.host,S=5,W=99:2," })
+
+    backend := NewMaildirBackend(root, checkPassword)
+    mailbox, err := backend.Login("alice", "secret")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer mailbox.Close()
+
+    list, err := mailbox.List()
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := []MessageInfo { { "1.a.host", 22 }, { "2.b.host", 22 }, { "3.c.host,S=5,W=99", 99 } }
+    if len(list) != len(expected) {
+        t.Fatalf("Unexpected list %v", list)
+    }
+    for i := range expected {
+        if list[i] != expected[i] {
+            t.Errorf("Expected %v got %v", expected[i], list[i])
+        }
+    }
+
+    if _, err = os.Stat(filepath.Join(root, "alice", "cur", "2.b.host:2,")); err != nil {
+        t.Errorf("New message not moved to cur %v", err)
+    }
+
+    body, err := mailbox.Open(0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    content, _ := io.ReadAll(body)
+    body.Close()
+    if string(content) != messages["cur/1.a.host:2,S"] {
+        t.Errorf("Unexpected content %q", content)
+    }
+}
+
+// Test_MaildirDelete checks deleted messages are removed, ignoring those already gone
+func Test_MaildirDelete(t *testing.T) {
+    root := t.TempDir()
+    newTestMaildir(t, root, "alice", map[string]string { "cur/1": "one\n", "cur/2": "two\n" }, []string { "cur/1", "cur/2" })
+
+    mailbox, err := NewMaildirBackend(root, checkPassword).Login("alice", "secret")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer mailbox.Close()
+    mailbox.List()
+
+    os.Remove(filepath.Join(root, "alice", "cur", "2"))
+    err = mailbox.Delete([]int { 0, 1 })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    entries, _ := os.ReadDir(filepath.Join(root, "alice", "cur"))
+    if len(entries) != 0 {
+        t.Errorf("Messages not removed %v", entries)
+    }
+}
+
+// Test_MaildirLogin checks credentials, locking and user names that would leave the root
+func Test_MaildirLogin(t *testing.T) {
+    root := t.TempDir()
+    newTestMaildir(t, root, "alice", nil, nil)
+    backend := NewMaildirBackend(root, func(username string, password string) error { return nil })
+
+    for _, username := range []string { "", "..", "../alice", "alice/cur" } {
+        _, err := backend.Login(username, "secret")
+        if !errors.Is(err, ErrAuthFailed) {
+            t.Errorf("Expected auth failure for %q, got %v", username, err)
+        }
+    }
+
+    _, err := backend.Login("bob", "secret")
+    if err == nil {
+        t.Error("Opened a missing Maildir")
+    }
+
+    mailbox, err := backend.Login("alice", "secret")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = backend.Login("alice", "secret")
+    if !errors.Is(err, ErrMailboxLocked) {
+        t.Errorf("Expected mailbox locked, got %v", err)
+    }
+
+    mailbox.Close()
+    mailbox, err = backend.Login("alice", "secret")
+    if err != nil {
+        t.Errorf("Mailbox not unlocked %v", err)
+    }
+    mailbox.Close()
+
+    backend.Authenticate = checkPassword
+    _, err = backend.Login("alice", "wrong")
+    if !errors.Is(err, ErrAuthFailed) {
+        t.Errorf("Expected auth failure, got %v", err)
+    }
+}
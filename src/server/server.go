@@ -0,0 +1,288 @@
+// Package server implements a POP3 server (RFC 1939) with the CAPA, UIDL, TOP, STLS and
+// SASL PLAIN extensions, serving mailboxes from a pluggable Backend
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/benmj87/gogo-pop3gadget/src/internal/pop3"
+)
+
+// Logger receives log messages from the server. It's the same interface as client.Logger
+// so one logger, e.g. a *slog.Logger, can be shared
+type Logger = pop3.Logger
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown or Close
+var ErrServerClosed = errors.New("pop3: server closed")
+
+// Server serves POP3 connections, each on its own goroutine
+type Server struct {
+	// Backend authenticates users and opens their mailboxes
+	Backend Backend
+	// Hostname is used in the APOP greeting timestamp, defaults to os.Hostname
+	Hostname string
+	// TLSConfig enables STLS when set. For implicit TLS pass a listener from tls.NewListener to Serve
+	TLSConfig *tls.Config
+	// AllowInsecureAuth accepts passwords over connections without TLS. By default USER
+	// and AUTH are only offered once STLS has been used or the listener is TLS
+	AllowInsecureAuth bool
+	// IdleTimeout closes connections left idle for longer, waiting for a command or for the
+	// client to read a response. Zero uses the RFC 1939 minimum of 10 minutes
+	IdleTimeout time.Duration
+	// Logger receives log messages, nil to discard them
+	Logger Logger
+
+	lock      sync.Mutex
+	listeners map[net.Listener]bool
+	// conns maps each open connection to whether it's waiting for a command
+	conns  map[*conn]bool
+	wait   sync.WaitGroup
+	closed bool
+}
+
+// ListenAndServe listens on the TCP address and serves connections until Shutdown or Close
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on listener until Shutdown or Close, which make it return
+// ErrServerClosed. The listener is closed when Serve returns
+func (s *Server) Serve(listener net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]bool)
+	}
+	s.listeners[listener] = true
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, listener)
+		s.lock.Unlock()
+		listener.Close()
+	}()
+
+	s.logger().Info("Serving POP3", "address", listener.Addr().String())
+
+	var backoff time.Duration
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+
+			// back off on temporary errors such as running out of file descriptors, doubling
+			// the delay up to a second
+			if temporaryAcceptError(err) {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else {
+					backoff *= 2
+				}
+				if backoff > time.Second {
+					backoff = time.Second
+				}
+				s.logger().Warn("Accept failed, retrying", "error", err, "delay", backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+
+		c := newConn(s, netConn)
+		if !s.track(c) {
+			netConn.Close()
+			return ErrServerClosed
+		}
+
+		go func() {
+			defer s.untrack(c)
+			c.serve()
+		}()
+	}
+}
+
+// temporaryAcceptError returns whether Accept may succeed if tried again, e.g. once file
+// descriptors have been freed or after a client aborted its connection
+func temporaryAcceptError(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ECONNABORTED, syscall.ECONNRESET, syscall.ENOBUFS, syscall.ENOMEM} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Shutdown stops accepting connections and waits for the open sessions to end. Sessions
+// waiting for a command are ended straight away, those running one end once it has been
+// answered, so QUIT still removes the deleted messages. Once ctx is done the remaining
+// connections are closed, without removing any deleted messages, and the context error
+// is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+	s.interruptIdle()
+
+	done := make(chan struct{})
+	go func() {
+		s.wait.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.closeConns()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections and closes those open straight away, sessions end
+// without removing any deleted messages
+func (s *Server) Close() error {
+	s.stop()
+	s.closeConns()
+	s.wait.Wait()
+
+	return nil
+}
+
+// stop marks the server closed and closes the listeners
+func (s *Server) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+}
+
+// interruptIdle unblocks the sessions waiting for a command, their read fails and they
+// end as if the client had gone
+func (s *Server) interruptIdle() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for c, idle := range s.conns {
+		if idle {
+			c.netConn.SetReadDeadline(time.Unix(1, 0))
+		}
+	}
+}
+
+// closeConns closes the open connections
+func (s *Server) closeConns() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for c := range s.conns {
+		c.netConn.Close()
+	}
+}
+
+// isClosed returns whether Shutdown or Close has been called
+func (s *Server) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.closed
+}
+
+// track records an open connection, false if the server has been closed
+func (s *Server) track(c *conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*conn]bool)
+	}
+
+	s.conns[c] = false
+	s.wait.Add(1)
+	return true
+}
+
+// setIdle records whether c is waiting for a command, returning false if the server is
+// shutting down so the session should end rather than wait
+func (s *Server) setIdle(c *conn, idle bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.conns[c] = idle
+	return !s.closed
+}
+
+// untrack removes a connection once its session has ended
+func (s *Server) untrack(c *conn) {
+	s.lock.Lock()
+	delete(s.conns, c)
+	s.lock.Unlock()
+
+	s.wait.Done()
+}
+
+// logger returns the logger, discarding messages if there isn't one
+func (s *Server) logger() Logger {
+	if s.Logger == nil {
+		return pop3.NopLogger{}
+	}
+
+	return s.Logger
+}
+
+// hostname returns the host name for the greeting
+func (s *Server) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+
+	return hostname
+}
+
+// idleTimeout returns how long to wait for a command
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+
+	return 10 * time.Minute
+}
@@ -0,0 +1,655 @@
+package server
+
+import (
+    "bufio"
+    "context"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/md5"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/hex"
+    "encoding/pem"
+    "errors"
+    "io"
+    "math/big"
+    "net"
+    "net/textproto"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "syscall"
+    "testing"
+    "time"
+    "github.com/benmj87/gogo-pop3gadget/src/client"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+)
+
+// testServer is a server for alice's Maildir listening on the loopback interface
+type testServer struct {
+    *Server
+    root string
+    addr *net.TCPAddr
+    // served receives the error returned by Serve
+    served chan error
+}
+
+// newTestServer starts a server for a Maildir holding two messages, configure is called before serving
+func newTestServer(t *testing.T, configure func(*Server)) *testServer {
+    root := t.TempDir()
+    messages := map[string]string {
+        "cur/1.host:2,": "Subject: one\n\n.dotted\nbody\n",
+        "new/2.host": "Subject: two\r\n\r\nline 1\r\nline 2\r\n",
+    }
+    newTestMaildir(t, root, "alice", messages, []string { "cur/1.host:2,", "new/2.host" })
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    s := &testServer {
+        Server: &Server { Backend: NewMaildirBackend(root, checkPassword), Hostname: "test", AllowInsecureAuth: true },
+        root: root,
+        addr: listener.Addr().(*net.TCPAddr),
+        served: make(chan error, 1),
+    }
+    if configure != nil {
+        configure(s.Server)
+    }
+
+    go func() {
+        s.served <- s.Serve(listener)
+    }()
+    t.Cleanup(func() { s.Close() })
+
+    return s
+}
+
+// config returns a plaintext client config for alice
+func (s *testServer) config() *config.Config {
+    conf := config.NewConfig()
+    conf.UseTLS = false
+    conf.Server = s.addr.IP.String()
+    conf.Port = s.addr.Port
+    conf.Username = "alice"
+    conf.Password = "secret"
+
+    return conf
+}
+
+// login returns a client logged in to alice's mailbox
+func (s *testServer) login(t *testing.T, conf *config.Config) *client.Client {
+    c := client.NewClient(*conf)
+    err := c.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = c.Auth()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return c
+}
+
+// newTestTLSConfig returns a server TLS config with a self-signed certificate for localhost and its PEM
+func newTestTLSConfig(t *testing.T) (*tls.Config, []byte) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    template := &x509.Certificate {
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name { CommonName: "localhost" },
+        DNSNames: []string { "localhost" },
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage: []x509.ExtKeyUsage { x509.ExtKeyUsageServerAuth },
+        BasicConstraintsValid: true,
+        IsCA: true,
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cert := tls.Certificate { Certificate: [][]byte { der }, PrivateKey: key }
+    return &tls.Config { Certificates: []tls.Certificate { cert } }, pem.EncodeToMemory(&pem.Block { Type: "CERTIFICATE", Bytes: der })
+}
+
+// Test_ServerSession checks a client can list, retrieve and delete messages, with deletes applied on QUIT
+func Test_ServerSession(t *testing.T) {
+    s := newTestServer(t, nil)
+    c := s.login(t, s.config())
+
+    count, size, err := c.Stat()
+    if err != nil || count != 2 || size != 31 + 32 {
+        t.Errorf("Unexpected STAT %v %v, %v", count, size, err)
+    }
+
+    emails, err := c.UIDL()
+    if err != nil || len(emails) != 2 || emails[0].UID != "1.host" || emails[1].UID != "2.host" {
+        t.Fatalf("Unexpected UIDL %v, %v", emails, err)
+    }
+
+    email, err := c.Retrieve(1)
+    if err != nil || email.Message != "Subject: one\r\n\r\n.dotted\r\nbody" {
+        t.Errorf("Unexpected message %q, %v", email.Message, err)
+    }
+
+    top, err := c.Top(2, 1)
+    if err != nil || top.Message != "Subject: two\r\n\r\nline 1" {
+        t.Errorf("Unexpected TOP %q, %v", top.Message, err)
+    }
+
+    err = c.Delete(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = c.Retrieve(1)
+    if !errors.Is(err, client.ErrNoSuchMessage) {
+        t.Errorf("Expected no such message, got %v", err)
+    }
+
+    err = c.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    entries, _ := os.ReadDir(filepath.Join(s.root, "alice", "cur"))
+    if len(entries) != 1 || entries[0].Name() != "2.host:2," {
+        t.Errorf("Unexpected messages left %v", entries)
+    }
+}
+
+// Test_ServerDropped checks nothing is removed and the mailbox is unlocked when the connection drops
+func Test_ServerDropped(t *testing.T) {
+    s := newTestServer(t, nil)
+
+    var raw net.Conn
+    c := client.NewClient(*s.config())
+    c.Dialer = func(network string, addr string) (net.Conn, error) {
+        var err error
+        raw, err = net.Dial(network, addr)
+        return raw, err
+    }
+    err := c.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = c.Auth()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    other := client.NewClient(*s.config())
+    other.Connect()
+    err = other.Auth()
+    if !errors.Is(err, client.ErrMailboxLocked) {
+        t.Errorf("Expected mailbox locked, got %v", err)
+    }
+
+    err = c.DeleteMany([]int { 1, 2 })
+    if err != nil {
+        t.Fatal(err)
+    }
+    raw.Close()
+
+    // the server unlocks the mailbox once it sees the connection close
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        c = client.NewClient(*s.config())
+        c.Connect()
+        err = c.Auth()
+        if err == nil || time.Now().After(deadline) {
+            break
+        }
+        c.Close()
+        time.Sleep(10 * time.Millisecond)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    count, _, err := c.Stat()
+    if err != nil || count != 2 {
+        t.Errorf("Messages removed without QUIT %v, %v", count, err)
+    }
+    c.Close()
+}
+
+// Test_ServerAuth checks wrong passwords and SASL PLAIN
+func Test_ServerAuth(t *testing.T) {
+    s := newTestServer(t, nil)
+
+    conf := s.config()
+    conf.Password = "wrong"
+    c := client.NewClient(*conf)
+    c.Connect()
+    err := c.Auth()
+    if !errors.Is(err, client.ErrAuthFailed) {
+        t.Errorf("Expected auth failure, got %v", err)
+    }
+    c.Close()
+
+    conf = s.config()
+    conf.AuthMethod = config.AuthSASL
+    c = s.login(t, conf)
+    c.Close()
+}
+
+// Test_ServerInsecureAuth checks passwords are refused without TLS unless allowed
+func Test_ServerInsecureAuth(t *testing.T) {
+    s := newTestServer(t, func(s *Server) { s.AllowInsecureAuth = false })
+
+    c := client.NewClient(*s.config())
+    err := c.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    caps, err := c.Capabilities()
+    if err != nil || caps.User || len(caps.SASL) != 0 {
+        t.Errorf("Login advertised without TLS %v, %v", caps, err)
+    }
+
+    err = c.Auth()
+    if err == nil {
+        t.Error("Logged in without TLS")
+    }
+    c.Close()
+}
+
+// Test_ServerSTLS checks the connection can be upgraded before logging in
+func Test_ServerSTLS(t *testing.T) {
+    tlsConf, certPEM := newTestTLSConfig(t)
+    s := newTestServer(t, func(s *Server) {
+        s.TLSConfig = tlsConf
+        s.AllowInsecureAuth = false
+    })
+
+    conf := s.config()
+    conf.TLSMode = config.TLSStartRequired
+    conf.TLSServerName = "localhost"
+    conf.TLSCAPEM = certPEM
+    c := s.login(t, conf)
+
+    count, _, err := c.Stat()
+    if err != nil || count != 2 {
+        t.Errorf("Unexpected STAT %v, %v", count, err)
+    }
+    c.Close()
+}
+
+// Test_ServerImplicitTLS checks a TLS listener can be served
+func Test_ServerImplicitTLS(t *testing.T) {
+    tlsConf, certPEM := newTestTLSConfig(t)
+
+    s := newTestServer(t, func(s *Server) { s.AllowInsecureAuth = false })
+    listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    go s.Serve(listener)
+
+    conf := s.config()
+    conf.UseTLS = true
+    conf.Port = listener.Addr().(*net.TCPAddr).Port
+    conf.TLSServerName = "localhost"
+    conf.TLSCAPEM = certPEM
+    c := s.login(t, conf)
+    c.Close()
+}
+
+// Test_ServerPipelining checks pipelined commands are answered in order
+func Test_ServerPipelining(t *testing.T) {
+    s := newTestServer(t, nil)
+    c := s.login(t, s.config())
+
+    var retrieved []int
+    err := c.RetrieveMany([]int { 2, 1, 2 }, func(ID int, body io.Reader) error {
+        content, err := io.ReadAll(body)
+        if err == nil && !strings.Contains(string(content), "Subject: ") {
+            err = errors.New("Unexpected content " + string(content))
+        }
+        retrieved = append(retrieved, ID)
+        return err
+    })
+    if err != nil || len(retrieved) != 3 {
+        t.Errorf("Retrieved %v, %v", retrieved, err)
+    }
+    c.Close()
+}
+
+// Test_ServerLineTooLong checks overlong commands close the connection
+func Test_ServerLineTooLong(t *testing.T) {
+    s := newTestServer(t, nil)
+
+    conn, err := net.Dial("tcp", s.addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    reader := bufio.NewReader(conn)
+    reader.ReadString('\n')
+    conn.Write([]byte(strings.Repeat("X", maxLine + 10) + "\r\n"))
+
+    line, _ := reader.ReadString('\n')
+    if !strings.HasPrefix(line, "-ERR line too long") {
+        t.Errorf("Unexpected response %q", line)
+    }
+    if _, err = reader.ReadString('\n'); err == nil {
+        t.Error("Connection not closed")
+    }
+}
+
+// blockingBackend wraps the Maildir backend so opening a message waits for release,
+// keeping the command running
+type blockingBackend struct {
+    *MaildirBackend
+    opened chan struct{}
+    release chan struct{}
+}
+
+func (b blockingBackend) Login(username string, password string) (Mailbox, error) {
+    mailbox, err := b.MaildirBackend.Login(username, password)
+    if err != nil {
+        return nil, err
+    }
+
+    return blockingMailbox { Mailbox: mailbox, backend: b }, nil
+}
+
+// blockingMailbox is a mailbox opened by blockingBackend
+type blockingMailbox struct {
+    Mailbox
+    backend blockingBackend
+}
+
+func (m blockingMailbox) Open(index int) (io.ReadCloser, error) {
+    m.backend.opened <- struct{}{}
+    <-m.backend.release
+
+    return m.Mailbox.Open(index)
+}
+
+// newBlockingServer returns a test server whose RETR waits for the backend to be released
+func newBlockingServer(t *testing.T) (*testServer, blockingBackend) {
+    var backend blockingBackend
+    s := newTestServer(t, func(server *Server) {
+        backend = blockingBackend {
+            MaildirBackend: server.Backend.(*MaildirBackend),
+            opened: make(chan struct{}, 1),
+            release: make(chan struct{}),
+        }
+        server.Backend = backend
+    })
+
+    return s, backend
+}
+
+// Test_ServerShutdown checks Shutdown ends idle sessions straight away and stops accepting
+func Test_ServerShutdown(t *testing.T) {
+    s := newTestServer(t, nil)
+    c := s.login(t, s.config())
+    err := c.Delete(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    start := time.Now()
+    err = s.Shutdown(ctx)
+    if err != nil || time.Since(start) > time.Second {
+        t.Errorf("Graceful shutdown waited for the idle session, %v after %v", err, time.Since(start))
+    }
+    if err = <-s.served; !errors.Is(err, ErrServerClosed) {
+        t.Errorf("Expected ErrServerClosed from Serve, got %v", err)
+    }
+    if _, err = net.Dial("tcp", s.addr.String()); err == nil {
+        t.Error("Still accepting connections")
+    }
+    if _, _, err = c.Stat(); err == nil {
+        t.Error("Session not closed")
+    }
+
+    // the session ended without QUIT so the message is kept
+    if _, err = os.Stat(filepath.Join(s.root, "alice", "cur", "1.host:2,")); err != nil {
+        t.Errorf("Message deleted without QUIT, %v", err)
+    }
+}
+
+// Test_ServerShutdownRunningCommand checks Shutdown lets a command being run finish
+func Test_ServerShutdownRunningCommand(t *testing.T) {
+    s, backend := newBlockingServer(t)
+    c := s.login(t, s.config())
+
+    retrieved := make(chan error, 1)
+    go func() {
+        _, err := c.Retrieve(1)
+        retrieved <- err
+    }()
+    <-backend.opened
+
+    shutdown := make(chan error, 1)
+    go func() {
+        shutdown <- s.Shutdown(context.Background())
+    }()
+
+    select {
+    case err := <-shutdown:
+        t.Fatalf("Shutdown returned while the command was running, %v", err)
+    case <-time.After(50 * time.Millisecond):
+    }
+
+    close(backend.release)
+    if err := <-retrieved; err != nil {
+        t.Errorf("Running command failed %v", err)
+    }
+    if err := <-shutdown; err != nil {
+        t.Errorf("Graceful shutdown failed %v", err)
+    }
+}
+
+// Test_ServerShutdownDeadline checks sessions still running a command are closed once ctx is done
+func Test_ServerShutdownDeadline(t *testing.T) {
+    s, backend := newBlockingServer(t)
+    c := s.login(t, s.config())
+
+    retrieved := make(chan error, 1)
+    go func() {
+        _, err := c.Retrieve(1)
+        retrieved <- err
+    }()
+    <-backend.opened
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+    // the backend can't be interrupted, it finishes once the connection has been closed
+    go func() {
+        <-ctx.Done()
+        close(backend.release)
+    }()
+    err := s.Shutdown(ctx)
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("Expected the deadline to pass, got %v", err)
+    }
+
+    // the response may have been sent before the connection was closed
+    <-retrieved
+    if _, _, err = c.Stat(); err == nil {
+        t.Error("Session not closed")
+    }
+}
+
+// pipeListener accepts connections made over net.Pipe, which has no buffering so a
+// client that stops reading blocks the server's writes straight away
+type pipeListener struct {
+    conns chan net.Conn
+    done chan struct{}
+    once sync.Once
+}
+
+// newPipeListener returns a listener serving connections opened by dial
+func newPipeListener() *pipeListener {
+    return &pipeListener { conns: make(chan net.Conn), done: make(chan struct{}) }
+}
+
+// dial opens a connection to the listener
+func (l *pipeListener) dial() net.Conn {
+    clientConn, serverConn := net.Pipe()
+    l.conns <- serverConn
+    return clientConn
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+    select {
+    case conn := <-l.conns:
+        return conn, nil
+    case <-l.done:
+        return nil, net.ErrClosed
+    }
+}
+
+func (l *pipeListener) Close() error {
+    l.once.Do(func() { close(l.done) })
+    return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+    return &net.TCPAddr { IP: net.IPv4(127, 0, 0, 1) }
+}
+
+// failingListener fails the first failures calls to Accept with err before accepting
+// connections from the pipeListener
+type failingListener struct {
+    *pipeListener
+    err error
+    lock sync.Mutex
+    failures int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+    l.lock.Lock()
+    if l.failures > 0 {
+        l.failures--
+        l.lock.Unlock()
+        return nil, l.err
+    }
+    l.lock.Unlock()
+
+    return l.pipeListener.Accept()
+}
+
+// Test_ServerAcceptRetries checks Serve keeps accepting after temporary errors such as running out of file descriptors
+func Test_ServerAcceptRetries(t *testing.T) {
+    for _, errno := range []syscall.Errno { syscall.EMFILE, syscall.ENFILE, syscall.ECONNABORTED } {
+        s := newTestServer(t, nil)
+        listener := &failingListener {
+            pipeListener: &pipeListener { conns: make(chan net.Conn, 1), done: make(chan struct{}) },
+            err: &net.OpError { Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", errno) },
+            failures: 3,
+        }
+        served := make(chan error, 1)
+        go func() { served <- s.Serve(listener) }()
+
+        conn := listener.dial()
+        conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        line, err := textproto.NewConn(conn).ReadLine()
+        if err != nil || !strings.HasPrefix(line, "+OK") {
+            t.Errorf("Unexpected greeting after %v %q, %v", errno, line, err)
+        }
+        conn.Close()
+
+        s.Close()
+        if err = <-served; !errors.Is(err, ErrServerClosed) {
+            t.Errorf("Expected ErrServerClosed from Serve, got %v", err)
+        }
+    }
+
+    // other errors stop serving
+    s := newTestServer(t, nil)
+    failed := errors.New("listener broken")
+    err := s.Serve(&failingListener { pipeListener: newPipeListener(), err: failed, failures: 1 })
+    if err != failed {
+        t.Errorf("Expected the accept error, got %v", err)
+    }
+}
+
+// Test_ServerClientStopsReading checks a client that stops reading a response is disconnected, releasing the mailbox
+func Test_ServerClientStopsReading(t *testing.T) {
+    s := newTestServer(t, func(s *Server) { s.IdleTimeout = 100 * time.Millisecond })
+    listener := newPipeListener()
+    go s.Serve(listener)
+
+    conn := listener.dial()
+    defer conn.Close()
+    text := textproto.NewConn(conn)
+    for _, command := range []string { "", "USER alice", "PASS secret" } {
+        if command != "" {
+            text.PrintfLine("%s", command)
+        }
+        line, err := text.ReadLine()
+        if err != nil || !strings.HasPrefix(line, "+OK") {
+            t.Fatalf("Unexpected response to %q: %q, %v", command, line, err)
+        }
+    }
+    text.PrintfLine("RETR 1")
+
+    // the stalled session must end for the mailbox to be unlocked
+    time.Sleep(300 * time.Millisecond)
+    c := s.login(t, s.config())
+    c.Close()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    err := s.Shutdown(ctx)
+    if err != nil {
+        t.Errorf("Shutdown waited for the stalled session, %v", err)
+    }
+}
+
+// apopBackend adds APOP to the Maildir backend, alice's password is secret
+type apopBackend struct {
+    *MaildirBackend
+}
+
+func (b apopBackend) LoginAPOP(username string, timestamp string, digest string) (Mailbox, error) {
+    expected := md5.Sum([]byte(timestamp + "secret"))
+    if username != "alice" || digest != hex.EncodeToString(expected[:]) {
+        return nil, ErrAuthFailed
+    }
+
+    return b.MaildirBackend.Login(username, "secret")
+}
+
+// Test_ServerAPOPTimestamp checks the greeting only has a timestamp when the backend supports APOP
+func Test_ServerAPOPTimestamp(t *testing.T) {
+    s := newTestServer(t, nil)
+    c := client.NewClient(*s.config())
+    err := c.Connect()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(c.Greeting(), "<") {
+        t.Errorf("Unexpected timestamp in %q", c.Greeting())
+    }
+    c.Close()
+
+    s = newTestServer(t, func(s *Server) { s.Backend = apopBackend { s.Backend.(*MaildirBackend) } })
+    conf := s.config()
+    conf.AuthMethod = config.AuthAPOP
+    c = s.login(t, conf)
+    if !strings.Contains(c.Greeting(), "@test>") {
+        t.Errorf("Expected a timestamp in %q", c.Greeting())
+    }
+    c.Close()
+}
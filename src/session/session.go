@@ -0,0 +1,233 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/benmj87/gogo-pop3gadget/src/client"
+	"github.com/benmj87/gogo-pop3gadget/src/config"
+)
+
+// Session downloads a mailbox surviving dropped connections. Messages are tracked by
+// their unique-id (UIDL) so after reconnecting the remaining work resumes without
+// handing a message over twice, and DELE is issued using the message number of the new
+// session. The server must support UIDL
+type Session struct {
+	// MaxAttempts limits the reconnects in a row that fail without progress, 0 for no limit
+	MaxAttempts int
+	// MinBackoff is the wait before the first reconnect, doubling for each attempt after
+	MinBackoff time.Duration
+	// MaxBackoff caps the wait between reconnects
+	MaxBackoff time.Duration
+	// NewClient creates the client for each connection, by default client.NewClient with the session options
+	NewClient func(config.Config) *client.Client
+
+	conf config.Config
+	// lock guards delivered
+	lock sync.Mutex
+	// delivered holds the unique-ids of the messages handed to the handler
+	delivered map[string]bool
+}
+
+// handlerError holds an error returned by the handler so it isn't retried
+type handlerError struct {
+	err error
+}
+
+func (e *handlerError) Error() string {
+	return e.err.Error()
+}
+
+// NewSession creates a session for the account in conf, opts are passed to client.NewClient
+func NewSession(conf config.Config, opts ...client.Option) *Session {
+	return &Session{
+		MaxAttempts: 5,
+		MinBackoff:  time.Second,
+		MaxBackoff:  time.Minute,
+		NewClient: func(conf config.Config) *client.Client {
+			return client.NewClient(conf, opts...)
+		},
+		conf:      conf,
+		delivered: make(map[string]bool),
+	}
+}
+
+// Download hands each message not yet delivered to handler, leaving them on the server.
+// The body is only passed over once it has been received in full. If the connection is
+// lost the session reconnects and continues with the remaining messages. An error
+// returned by handler stops the download and is returned as is
+func (s *Session) Download(ctx context.Context, handler func(uid string, body io.Reader) error) error {
+	return s.run(ctx, handler, false)
+}
+
+// Drain is Download removing each message from the server once handler has returned
+// successfully. Messages are only removed when the session ends with QUIT, so deletes
+// lost with a dropped connection are issued again after reconnecting
+func (s *Session) Drain(ctx context.Context, handler func(uid string, body io.Reader) error) error {
+	return s.run(ctx, handler, true)
+}
+
+// MarkDelivered records unique-ids as already delivered, e.g. from a previous run
+func (s *Session) MarkDelivered(uids ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, uid := range uids {
+		s.delivered[uid] = true
+	}
+}
+
+// Delivered returns the unique-ids of the messages delivered so far
+func (s *Session) Delivered() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	uids := make([]string, 0, len(s.delivered))
+	for uid := range s.delivered {
+		uids = append(uids, uid)
+	}
+
+	return uids
+}
+
+// run connects and works through the mailbox until done, reconnecting with exponential
+// backoff when the connection is lost
+func (s *Session) run(ctx context.Context, handler func(uid string, body io.Reader) error, remove bool) error {
+	attempts := 0
+	for {
+		progress, err := s.pass(ctx, handler, remove)
+		if err == nil {
+			return nil
+		}
+
+		var handlerErr *handlerError
+		if errors.As(err, &handlerErr) {
+			return handlerErr.err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !retryable(err) {
+			return err
+		}
+
+		if progress {
+			attempts = 0
+		}
+		attempts++
+		if s.MaxAttempts > 0 && attempts >= s.MaxAttempts {
+			return fmt.Errorf("Giving up after %v attempts: %w", attempts, err)
+		}
+
+		timer := time.NewTimer(s.backoff(attempts))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// pass makes a single connection, delivering and deleting what it can. progress is set
+// if any message was delivered
+func (s *Session) pass(ctx context.Context, handler func(uid string, body io.Reader) error, remove bool) (bool, error) {
+	c := s.NewClient(s.conf)
+
+	err := c.ConnectContext(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// the connection is broken if a command fails other than with -ERR
+	defer func() {
+		if c.State() != client.StateClosed {
+			c.CloseContext(ctx)
+		}
+	}()
+
+	err = c.AuthContext(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// message numbers are only valid for this connection, the unique-ids are used to
+	// find the messages again
+	emails, err := c.UIDLContext(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	progress := false
+	for _, email := range emails {
+		s.lock.Lock()
+		done := s.delivered[email.UID]
+		s.lock.Unlock()
+
+		if !done {
+			var body bytes.Buffer
+			_, err = c.RetrieveToContext(ctx, email.ID, &body)
+			if errors.Is(err, client.ErrNoSuchMessage) {
+				continue
+			}
+			if err != nil {
+				return progress, err
+			}
+
+			err = handler(email.UID, &body)
+			if err != nil {
+				return progress, &handlerError{err: err}
+			}
+
+			s.MarkDelivered(email.UID)
+			progress = true
+		}
+
+		if remove {
+			err = c.DeleteContext(ctx, email.ID)
+			if err != nil && !errors.Is(err, client.ErrNoSuchMessage) {
+				return progress, err
+			}
+		}
+	}
+
+	// deletes are committed by QUIT
+	return progress, c.CloseContext(ctx)
+}
+
+// backoff returns the wait before the attempt, doubling from MinBackoff up to MaxBackoff
+func (s *Session) backoff(attempt int) time.Duration {
+	wait := s.MinBackoff
+	for i := 1; i < attempt && wait < s.MaxBackoff; i++ {
+		wait *= 2
+	}
+
+	if s.MaxBackoff > 0 && wait > s.MaxBackoff {
+		wait = s.MaxBackoff
+	}
+
+	return wait
+}
+
+// retryable checks whether err may go away by reconnecting, i.e. a network error or
+// a temporary server failure
+func retryable(err error) bool {
+	var protoErr *client.ProtocolError
+	if errors.As(err, &protoErr) {
+		return protoErr.Temporary()
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, client.ErrNotConnected)
+}
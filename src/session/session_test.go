@@ -0,0 +1,217 @@
+package session
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "time"
+    "github.com/benmj87/gogo-pop3gadget/src/client"
+    "github.com/benmj87/gogo-pop3gadget/src/config"
+    "github.com/benmj87/gogo-pop3gadget/src/pop3test"
+)
+
+// newTestSession returns a session for tim's mailbox on a pop3test server holding messages
+// with the given unique-ids
+func newTestSession(t *testing.T, uids ...string) (*Session, *pop3test.Server) {
+    server := pop3test.NewServer()
+    mailbox := server.AddMailbox("tim", "secret")
+    for _, uid := range uids {
+        mailbox.AddMessage(testMessage(uid))
+    }
+    t.Cleanup(func() { server.Close() })
+
+    toTest := NewSession(*server.Config("tim"))
+    toTest.MinBackoff = time.Millisecond
+    toTest.MaxBackoff = 5 * time.Millisecond
+    toTest.NewClient = func(conf config.Config) *client.Client {
+        c := client.NewClient(conf)
+        c.Dialer = server.Dial
+        return c
+    }
+
+    return toTest, server
+}
+
+// testMessage returns the message with the unique-id uid
+func testMessage(uid string) pop3test.Message {
+    return pop3test.Message { UID: uid, Body: fmt.Sprintf("Subject: %s\r\n\r\nbody of %s\r\n", uid, uid) }
+}
+
+// dropRetr drops the connection part way through sending a message
+var dropRetr = pop3test.Fault { Command: "RETR", Response: "+OK\r\nSubje", Close: true }
+
+// uids returns the unique-ids of the messages left in tim's mailbox
+func uids(server *pop3test.Server) []string {
+    var uids []string
+    for _, message := range server.Mailbox("tim").Messages() {
+        uids = append(uids, message.UID)
+    }
+
+    return uids
+}
+
+// collect returns a handler recording the bodies delivered
+func collect(delivered map[string]string) func(string, io.Reader) error {
+    return func(uid string, body io.Reader) error {
+        content, err := io.ReadAll(body)
+        if _, ok := delivered[uid]; ok {
+            return fmt.Errorf("%v delivered twice", uid)
+        }
+        delivered[uid] = string(content)
+        return err
+    }
+}
+
+// Test_DrainResumesAfterDrop checks a dropped connection resumes using the new message numbers
+func Test_DrainResumesAfterDrop(t *testing.T) {
+    toTest, server := newTestSession(t, "uid-a", "uid-b", "uid-c")
+    drop := dropRetr
+    drop.After = 1
+    drop.Count = 1
+    server.Inject(drop)
+
+    // new mail renumbers the messages of the next session
+    reconnected := 0
+    toTest.NewClient = func(conf config.Config) *client.Client {
+        c := client.NewClient(conf)
+        c.Dialer = func(network string, addr string) (net.Conn, error) {
+            if server.Connections() == 1 {
+                old := server.Mailbox("tim").Messages()
+                server.AddMailbox("tim", "secret").AddMessage(append([]pop3test.Message { testMessage("uid-new") }, old...)...)
+                reconnected = len(server.Commands())
+            }
+            return server.Dial(network, addr)
+        }
+        return c
+    }
+
+    delivered := make(map[string]string)
+    err := toTest.Drain(context.Background(), collect(delivered))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(delivered) != 4 || delivered["uid-b"] != "Subject: uid-b\r\n\r\nbody of uid-b\r\n" {
+        t.Errorf("Incorrect messages delivered %q", delivered)
+    }
+    if left := uids(server); len(left) != 0 {
+        t.Errorf("Messages left on the server %v", left)
+    }
+
+    // uid-a was deleted before the drop, the delete was lost so it's deleted again by its new number
+    second := strings.Join(server.Commands()[reconnected:], ",")
+    if !strings.Contains(second, "DELE 2") || strings.Contains(second, "RETR 2") {
+        t.Errorf("Incorrect commands after reconnecting %v", second)
+    }
+}
+
+// Test_DownloadKeepsMessages checks Download doesn't delete anything
+func Test_DownloadKeepsMessages(t *testing.T) {
+    toTest, server := newTestSession(t, "uid-a", "uid-b")
+    toTest.MarkDelivered("uid-a")
+
+    delivered := make(map[string]string)
+    err := toTest.Download(context.Background(), collect(delivered))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(delivered) != 1 || delivered["uid-b"] == "" {
+        t.Errorf("Incorrect messages delivered %q", delivered)
+    }
+    if left := uids(server); len(left) != 2 {
+        t.Errorf("Messages deleted, %v left", left)
+    }
+    if len(toTest.Delivered()) != 2 {
+        t.Errorf("Incorrect delivered %v", toTest.Delivered())
+    }
+}
+
+// Test_DrainHandlerError checks the handler error is returned without retrying
+func Test_DrainHandlerError(t *testing.T) {
+    toTest, server := newTestSession(t, "uid-a", "uid-b")
+
+    failed := errors.New("disk full")
+    err := toTest.Drain(context.Background(), func(uid string, body io.Reader) error {
+        if uid == "uid-b" {
+            return failed
+        }
+        return nil
+    })
+    if err != failed {
+        t.Errorf("Expected the handler error, got %v", err)
+    }
+
+    if server.Connections() != 1 {
+        t.Errorf("Expected a single session, got %v", server.Connections())
+    }
+    if left := uids(server); len(left) != 1 || left[0] != "uid-b" {
+        t.Errorf("Expected only the delivered message to be removed, got %v", left)
+    }
+}
+
+// Test_DrainAuthFailed checks failures that reconnecting can't fix aren't retried
+func Test_DrainAuthFailed(t *testing.T) {
+    toTest, server := newTestSession(t, "uid-a")
+    toTest.conf.Password = "bad"
+
+    err := toTest.Drain(context.Background(), collect(make(map[string]string)))
+    if !errors.Is(err, client.ErrAuthFailed) {
+        t.Errorf("Expected ErrAuthFailed, got %v", err)
+    }
+    if server.Connections() != 1 {
+        t.Errorf("Expected a single session, got %v", server.Connections())
+    }
+}
+
+// Test_DrainGivesUp checks reconnecting stops after MaxAttempts without progress
+func Test_DrainGivesUp(t *testing.T) {
+    toTest, server := newTestSession(t, "uid-a")
+    toTest.MaxAttempts = 3
+    server.Inject(dropRetr)
+
+    err := toTest.Drain(context.Background(), collect(make(map[string]string)))
+    if !errors.Is(err, io.ErrUnexpectedEOF) {
+        t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+    }
+    if server.Connections() != 3 {
+        t.Errorf("Expected 3 sessions, got %v", server.Connections())
+    }
+}
+
+// Test_DrainCancelled checks cancelling stops waiting to reconnect
+func Test_DrainCancelled(t *testing.T) {
+    toTest, server := newTestSession(t, "uid-a")
+    toTest.MinBackoff = time.Hour
+    toTest.MaxBackoff = time.Hour
+    drop := dropRetr
+    drop.Count = 1
+    server.Inject(drop)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+
+    err := toTest.Drain(ctx, collect(make(map[string]string)))
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+    }
+}
+
+// Test_Backoff checks the wait doubles up to the maximum
+func Test_Backoff(t *testing.T) {
+    toTest := NewSession(*config.NewConfig())
+
+    expected := []time.Duration { time.Second, 2 * time.Second, 4 * time.Second }
+    for i, wait := range expected {
+        if toTest.backoff(i + 1) != wait {
+            t.Errorf("Expected %v for attempt %v, got %v", wait, i + 1, toTest.backoff(i + 1))
+        }
+    }
+    if toTest.backoff(20) != time.Minute {
+        t.Errorf("Expected the maximum, got %v", toTest.backoff(20))
+    }
+}